@@ -74,12 +74,20 @@ func run(kernel, disk, format, shared string, vcpus, ram int, cmdline string) er
 	if err != nil {
 		return err
 	}
-	if err := ctx.AddDisk(krun.DiskConfig{BlockID: "vda", Path: disk, Format: diskFmt}); err != nil {
+	// The disk is writable, so its format is given rather than detected:
+	// the guest could otherwise rewrite its header to pick the format.
+	diskCfg := krun.DiskConfig{BlockID: "vda", Path: disk, Format: diskFmt}
+	if err := ctx.AddDisk(diskCfg); err != nil {
 		return fmt.Errorf("add disk: %w", err)
 	}
 
-	// Remount the disk as root filesystem.
-	if err := ctx.SetRootDiskRemount(krun.RootDiskRemountConfig{Device: "/dev/vda1", FSType: "ext4"}); err != nil {
+	// Remount the disk's root partition as root filesystem.
+	root, err := krun.FindRootDisk([]krun.DiskConfig{diskCfg})
+	if err != nil {
+		// VMDK partitions cannot be read; assume the usual layout.
+		root = krun.RootDiskRemountConfig{Device: "/dev/vda1", FSType: "ext4"}
+	}
+	if err := ctx.SetRootDiskRemount(root); err != nil {
 		return fmt.Errorf("set root disk remount: %w", err)
 	}
 
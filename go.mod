@@ -1,3 +1,8 @@
 module github.com/mishushakov/libkrun-go
 
 go 1.25.5
+
+require (
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/sys v0.47.0
+)
@@ -0,0 +1,210 @@
+package krun
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Cmdline is a kernel command line: parameters in order, then the
+// arguments the kernel passes to init after "--". Build one with the
+// methods below, check it with [Cmdline.Validate] and pass
+// [Cmdline.String] as KernelConfig.Cmdline.
+//
+// The kernel takes most parameters from their last occurrence, so Set
+// replaces a parameter while Add appends another, for the few parameters
+// such as console= that may be given more than once.
+type Cmdline struct {
+	Params []Param
+	Init   []string
+}
+
+// Param is a kernel parameter. An empty Value is written as the bare key,
+// as for "quiet" or "ro".
+type Param struct {
+	Key   string
+	Value string
+}
+
+// ErrCmdline is returned by [Cmdline.Validate] and [ParseCmdline] for
+// command lines the kernel would not read as intended.
+var ErrCmdline = errors.New("krun: invalid kernel command line")
+
+// repeatableParams may appear more than once on a command line.
+var repeatableParams = map[string]bool{
+	"console":    true,
+	"hugepages":  true,
+	"hugepagesz": true,
+	"memmap":     true,
+}
+
+// ParseCmdline parses s the way the kernel does: parameters are separated
+// by spaces, double quotes group a value (or a whole parameter) containing
+// spaces and are removed, and everything after "--" goes to init.
+func ParseCmdline(s string) (*Cmdline, error) {
+	words, err := splitCmdline(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cmdline{}
+	for i, w := range words {
+		if w == "--" {
+			c.Init = slices.Clone(words[i+1:])
+			break
+		}
+		key, value, _ := strings.Cut(w, "=")
+		c.Params = append(c.Params, Param{Key: key, Value: value})
+	}
+	return c, nil
+}
+
+func splitCmdline(s string) ([]string, error) {
+	var words []string
+	var w strings.Builder
+	inWord, quoted := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted, inWord = !quoted, true
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if inWord {
+				words = append(words, w.String())
+				w.Reset()
+				inWord = false
+			}
+		default:
+			w.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("%w: unterminated quote", ErrCmdline)
+	}
+	if inWord {
+		words = append(words, w.String())
+	}
+	return words, nil
+}
+
+// Get returns the value of the last occurrence of key, which is the one
+// the kernel uses.
+func (c *Cmdline) Get(key string) (string, bool) {
+	for i := len(c.Params) - 1; i >= 0; i-- {
+		if c.Params[i].Key == key {
+			return c.Params[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// Set sets key to value, replacing every occurrence of key in place of
+// the first one, or appending it if key is not present.
+func (c *Cmdline) Set(key, value string) {
+	i := slices.IndexFunc(c.Params, func(p Param) bool { return p.Key == key })
+	if i < 0 {
+		c.Add(key, value)
+		return
+	}
+	c.Params[i].Value = value
+	c.Params = slices.Concat(c.Params[:i+1], slices.DeleteFunc(c.Params[i+1:], func(p Param) bool { return p.Key == key }))
+}
+
+// Add appends key=value, keeping earlier occurrences of key.
+func (c *Cmdline) Add(key, value string) {
+	c.Params = append(c.Params, Param{Key: key, Value: value})
+}
+
+// Del removes every occurrence of key.
+func (c *Cmdline) Del(key string) {
+	c.Params = slices.DeleteFunc(c.Params, func(p Param) bool { return p.Key == key })
+}
+
+// String returns the command line, quoting values and init arguments that
+// contain spaces.
+func (c *Cmdline) String() string {
+	var words []string
+	for _, p := range c.Params {
+		if p.Value == "" {
+			words = append(words, p.Key)
+		} else {
+			words = append(words, p.Key+"="+quoteCmdline(p.Value))
+		}
+	}
+	if len(c.Init) > 0 {
+		words = append(words, "--")
+		for _, a := range c.Init {
+			words = append(words, quoteCmdline(a))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func quoteCmdline(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// MaxCmdlineLen returns the longest command line the kernel accepts on
+// arch, a GOARCH value: COMMAND_LINE_SIZE less the terminating NUL.
+func MaxCmdlineLen(arch string) int {
+	if arch == "riscv64" {
+		return 1024 - 1
+	}
+	return 2048 - 1
+}
+
+// Validate checks that the kernel will read c as intended on arch, a
+// GOARCH value ("" for the host): keys are well formed, no value or init
+// argument contains a double quote (the kernel has no way to escape one),
+// parameters other than console= and a few others that may repeat appear
+// once, and the command line fits in [MaxCmdlineLen].
+func (c *Cmdline) Validate(arch string) error {
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	seen := make(map[string]bool, len(c.Params))
+	var dups []string
+	for _, p := range c.Params {
+		if p.Key == "" || p.Key == "--" || strings.ContainsAny(p.Key, "= \t\n\"") {
+			return fmt.Errorf("%w: malformed parameter name %q", ErrCmdline, p.Key)
+		}
+		if strings.Contains(p.Value, `"`) {
+			return fmt.Errorf("%w: %s value contains a double quote", ErrCmdline, p.Key)
+		}
+		if seen[p.Key] && !repeatableParams[p.Key] && !slices.Contains(dups, p.Key) {
+			dups = append(dups, p.Key)
+		}
+		seen[p.Key] = true
+	}
+	if len(dups) > 0 {
+		return fmt.Errorf("%w: duplicate parameters %s", ErrCmdline, strings.Join(dups, ", "))
+	}
+	for _, a := range c.Init {
+		if strings.Contains(a, `"`) {
+			return fmt.Errorf("%w: init argument %q contains a double quote", ErrCmdline, a)
+		}
+	}
+	if n, max := len(c.String()), MaxCmdlineLen(arch); n > max {
+		return fmt.Errorf("%w: %d bytes, %s allows %d", ErrCmdline, n, arch, max)
+	}
+	return nil
+}
+
+// cmdlineConsoles returns the console= values of the command line s.
+func cmdlineConsoles(s string) []string {
+	c, err := ParseCmdline(s)
+	if err != nil {
+		return nil
+	}
+	var consoles []string
+	for _, p := range c.Params {
+		if p.Key == "console" {
+			consoles = append(consoles, p.Value)
+		}
+	}
+	return consoles
+}
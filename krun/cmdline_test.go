@@ -0,0 +1,111 @@
+package krun
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseCmdline(t *testing.T) {
+	c, err := ParseCmdline(`console=hvc0 quiet  root=/dev/vda1 "dyndbg=file x.c +p" opt="a b" -- -c "echo hi"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Param{{"console", "hvc0"}, {"quiet", ""}, {"root", "/dev/vda1"}, {"dyndbg", "file x.c +p"}, {"opt", "a b"}}
+	if !slices.Equal(c.Params, want) {
+		t.Errorf("Params = %q", c.Params)
+	}
+	if !slices.Equal(c.Init, []string{"-c", "echo hi"}) {
+		t.Errorf("Init = %q", c.Init)
+	}
+	if got := c.String(); got != `console=hvc0 quiet root=/dev/vda1 dyndbg="file x.c +p" opt="a b" -- -c "echo hi"` {
+		t.Errorf("String = %s", got)
+	}
+	if _, err := ParseCmdline(`opt="a b`); !errors.Is(err, ErrCmdline) {
+		t.Errorf("unterminated quote: err = %v", err)
+	}
+}
+
+func TestCmdlineEdit(t *testing.T) {
+	var c Cmdline
+	c.Add("console", "ttyS0")
+	c.Set("root", "/dev/vda")
+	c.Add("console", "hvc0")
+	c.Set("init", "/bin/sh")
+	c.Add("root", "/dev/vdb")
+	c.Set("root", "/dev/vda1")
+	if got := c.String(); got != "console=ttyS0 root=/dev/vda1 console=hvc0 init=/bin/sh" {
+		t.Errorf("String = %s", got)
+	}
+	if v, ok := c.Get("console"); !ok || v != "hvc0" {
+		t.Errorf("Get(console) = %q, %v", v, ok)
+	}
+	c.Del("console")
+	if _, ok := c.Get("console"); ok {
+		t.Error("console not deleted")
+	}
+	if err := c.Validate(""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCmdlineValidate(t *testing.T) {
+	long := &Cmdline{Params: []Param{{"x", strings.Repeat("a", 1500)}}}
+	if err := long.Validate("arm64"); err != nil {
+		t.Errorf("arm64: %v", err)
+	}
+	if err := long.Validate("riscv64"); !errors.Is(err, ErrCmdline) {
+		t.Errorf("riscv64: err = %v", err)
+	}
+
+	for name, c := range map[string]*Cmdline{
+		"duplicate": {Params: []Param{{"root", "/dev/vda"}, {"root", "/dev/vdb"}}},
+		"key":       {Params: []Param{{"a b", ""}}},
+		"quote":     {Params: []Param{{"a", `x"y`}}},
+		"init":      {Init: []string{`"`}},
+	} {
+		if err := c.Validate("amd64"); !errors.Is(err, ErrCmdline) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+	ok := &Cmdline{Params: []Param{{"console", "ttyS0"}, {"console", "hvc0"}}}
+	if err := ok.Validate("amd64"); err != nil {
+		t.Errorf("repeated console: %v", err)
+	}
+}
+
+func TestKernelConsoleConflict(t *testing.T) {
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(old)
+
+	kernel := filepath.Join(t.TempDir(), "kernel")
+	writeTestFile(t, kernel, "fake kernel")
+
+	ctx := newTestContext(t)
+	if err := ctx.SetKernel(KernelConfig{Path: kernel, Cmdline: "console=hvc0,115200"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetKernelConsole("hvc0"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected warning: %s", buf.String())
+	}
+
+	ctx = newTestContext(t)
+	if err := ctx.SetKernelConsole("hvc0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetKernel(KernelConfig{Path: kernel, Cmdline: "console=ttyS0"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "conflicts with SetKernelConsole") {
+		t.Errorf("no warning logged: %q", buf.String())
+	}
+}
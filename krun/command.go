@@ -0,0 +1,240 @@
+package krun
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// CommandSpec describes the microVM a [Cmd] runs its command in. It is
+// handed to a new process, so it holds data only.
+type CommandSpec struct {
+	Root    string   // see [Context.SetRoot]
+	VM      VMConfig // zero means libkrun's defaults
+	Exec    ExecConfig
+	Workdir string
+	Rlimits []string
+	// LogLevel is libkrun's log level; the log goes to Stderr.
+	LogLevel LogLevel
+}
+
+// Cmd runs one command in a new microVM, as [os/exec.Cmd] runs one in a
+// new process. The VMM exits the process that starts the VM, so Cmd runs
+// it in a copy of the current program: the program must call
+// [CommandMain] at the start of main, or of TestMain in tests.
+//
+// The guest's standard streams are connected to Stdin, Stdout and Stderr
+// through a virtio-console device. When none of them is a terminal the
+// guest gets a port for each, so stdout and stderr stay apart.
+type Cmd struct {
+	Spec   CommandSpec
+	Stdin  io.Reader // nil reads as empty
+	Stdout io.Writer // nil discards
+	Stderr io.Writer // nil discards
+}
+
+// ExitError reports that the command in the guest exited with a non-zero
+// status.
+type ExitError struct {
+	Code int
+	// Stderr holds the guest's standard error if it was collected by
+	// [Cmd.Output] because Stderr was not set.
+	Stderr []byte
+}
+
+func (e *ExitError) Error() string {
+	return "krun: guest exited with status " + strconv.Itoa(e.Code)
+}
+
+// commandEnv passes the spec to the process that runs the VM.
+const commandEnv = "KRUN_COMMAND_SPEC"
+
+// commandErrFD is where that process reports an error setting up the VM,
+// to tell it apart from the guest's own exit status.
+const commandErrFD = 3
+
+// commandError is how a setup error crosses to the parent.
+type commandError struct {
+	Msg   string
+	Func  string        `json:",omitempty"` // of an *Error
+	Errno syscall.Errno `json:",omitempty"`
+}
+
+// Command returns a Cmd to run the command described by spec. The program
+// must call [CommandMain] at the start of main, or the copy started to run
+// the VM runs main again instead.
+func Command(spec CommandSpec) *Cmd {
+	return &Cmd{Spec: spec}
+}
+
+// Run boots the VM, runs the command and waits for the VM to exit. The
+// error is an *ExitError if the guest exited with a non-zero status.
+//
+// Run fails in a copy of the program started by Run: that copy calling
+// Run again means main did not call [CommandMain], and it would start
+// copies without end.
+func (c *Cmd) Run() error {
+	if _, ok := os.LookupEnv(commandEnv); ok {
+		return errors.New("krun: Cmd.Run in the process started to run a Cmd's VM; call krun.CommandMain at the start of main")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("krun: %w", err)
+	}
+	spec, err := json.Marshal(c.Spec)
+	if err != nil {
+		return fmt.Errorf("krun: %w", err)
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("krun: %w", err)
+	}
+	defer errR.Close()
+
+	cmd := exec.Command(self)
+	cmd.Env = append(os.Environ(), commandEnv+"="+string(spec))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = c.Stdin, c.Stdout, c.Stderr
+	cmd.ExtraFiles = []*os.File{errW} // commandErrFD
+	err = cmd.Start()
+	errW.Close()
+	if err != nil {
+		return fmt.Errorf("krun: %w", err)
+	}
+	// Ends when the process does.
+	report, _ := io.ReadAll(errR)
+	err = cmd.Wait()
+
+	if len(report) > 0 {
+		var ce commandError
+		if json.Unmarshal(report, &ce) != nil {
+			return fmt.Errorf("krun: command: %s", report)
+		}
+		if ce.Func != "" {
+			return &Error{Func: ce.Func, Errno: ce.Errno}
+		}
+		return errors.New(ce.Msg)
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.Exited() {
+		return &ExitError{Code: ee.ExitCode()}
+	}
+	if err != nil {
+		return fmt.Errorf("krun: %w", err)
+	}
+	return nil
+}
+
+// Output runs the command and returns its standard output. If Stderr is
+// nil, the standard error is collected into the *ExitError.
+func (c *Cmd) Output() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("krun: Stdout already set")
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	collect := c.Stderr == nil
+	if collect {
+		c.Stderr = &stderr
+	}
+	err := c.Run()
+	var ee *ExitError
+	if collect && errors.As(err, &ee) {
+		ee.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its standard output and
+// standard error together.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("krun: Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, errors.New("krun: Stderr already set")
+	}
+	var b bytes.Buffer
+	c.Stdout, c.Stderr = &b, &b
+	err := c.Run()
+	return b.Bytes(), err
+}
+
+// CommandMain runs the VM of a [Cmd] when the program was started by Cmd
+// to do so, and then never returns. Otherwise it returns at once.
+func CommandMain() {
+	spec, ok := os.LookupEnv(commandEnv)
+	if !ok {
+		return
+	}
+	// Not for the guest, which gets this environment by default.
+	os.Unsetenv(commandEnv)
+	// Nor for anything the VMM starts, which would hold up Cmd.Run.
+	syscall.CloseOnExec(commandErrFD)
+	err := runCommand(spec)
+	if err == nil {
+		// StartEnter returned without running the VM.
+		os.Exit(0)
+	}
+	ce := commandError{Msg: err.Error()}
+	var kerr *Error
+	if errors.As(err, &kerr) {
+		ce.Func, ce.Errno = kerr.Func, kerr.Errno
+	}
+	report, _ := json.Marshal(ce)
+	os.NewFile(commandErrFD, "krun command errors").Write(report)
+	os.Exit(1)
+}
+
+// runCommand configures the VM spec describes and enters it.
+func runCommand(spec string) error {
+	var s CommandSpec
+	if err := json.Unmarshal([]byte(spec), &s); err != nil {
+		return fmt.Errorf("krun: command spec: %w", err)
+	}
+	if s.Exec.Path == "" {
+		return errors.New("krun: command spec has no Exec.Path")
+	}
+	if err := SetLogLevel(s.LogLevel); err != nil {
+		return err
+	}
+	ctx, err := CreateContext()
+	if err != nil {
+		return err
+	}
+	if s.VM != (VMConfig{}) {
+		if err := ctx.SetVMConfig(s.VM); err != nil {
+			return err
+		}
+	}
+	if s.Root != "" {
+		if err := ctx.SetRoot(s.Root); err != nil {
+			return err
+		}
+	}
+	if s.Workdir != "" {
+		if err := ctx.SetWorkdir(s.Workdir); err != nil {
+			return err
+		}
+	}
+	if s.Rlimits != nil {
+		if err := ctx.SetRlimits(s.Rlimits); err != nil {
+			return err
+		}
+	}
+	if err := ctx.SetExec(s.Exec); err != nil {
+		return err
+	}
+	if err := ctx.DisableImplicitConsole(); err != nil {
+		return err
+	}
+	if err := ctx.AddVirtioConsoleDefault(VirtioConsoleConfig{InputFD: 0, OutputFD: 1, ErrFD: 2}); err != nil {
+		return err
+	}
+	return ctx.StartEnter()
+}
@@ -0,0 +1,46 @@
+package krun
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	// The stub libkrun returns from StartEnter, so the VM "exits" at once.
+	out, err := Command(CommandSpec{Root: "/", Exec: ExecConfig{Path: "/bin/true"}}).Output()
+	if err != nil || len(out) != 0 {
+		t.Errorf("Output() = %q, %v", out, err)
+	}
+
+	err = Command(CommandSpec{Root: "/"}).Run()
+	if err == nil || !strings.Contains(err.Error(), "no Exec.Path") {
+		t.Errorf("setup error = %v", err)
+	}
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		t.Errorf("setup error reported as the guest's exit: %v", err)
+	}
+
+	cmd := Command(CommandSpec{})
+	cmd.Stdout = &strings.Builder{}
+	if _, err := cmd.CombinedOutput(); err == nil {
+		t.Error("CombinedOutput with Stdout set succeeded")
+	}
+}
+
+func TestCommand_NoCommandMain(t *testing.T) {
+	// What a copy of a program whose main does not call CommandMain sees.
+	t.Setenv(commandEnv, `{"Exec":{"Path":"/bin/true"}}`)
+	err := Command(CommandSpec{Root: "/", Exec: ExecConfig{Path: "/bin/true"}}).Run()
+	if err == nil || !strings.Contains(err.Error(), "CommandMain") {
+		t.Errorf("Run in the VM's process = %v, want an error naming CommandMain", err)
+	}
+}
+
+func TestExitError(t *testing.T) {
+	err := error(&ExitError{Code: 42})
+	if err.Error() != "krun: guest exited with status 42" {
+		t.Errorf("Error() = %q", err)
+	}
+}
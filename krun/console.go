@@ -5,7 +5,10 @@ package krun
 #include <stdlib.h>
 */
 import "C"
-import "unsafe"
+import (
+	"fmt"
+	"unsafe"
+)
 
 // SetConsoleOutput redirects the implicit console output to a file.
 // This only applies to the implicitly created console and has no effect
@@ -22,40 +25,65 @@ func (c *Context) SetConsoleOutput(filepath string) error {
 // DisableImplicitConsole prevents libkrun from creating an implicit console device.
 // Any needed console devices must be added manually via other methods.
 func (c *Context) DisableImplicitConsole() error {
-	return checkRet(
+	if err := checkRet(
 		C.krun_disable_implicit_console(C.uint32_t(c.id)),
 		"krun_disable_implicit_console",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) { s.noImplicitConsole = true })
+	return nil
 }
 
 // SetKernelConsole sets the console= parameter in the kernel command line.
+// A warning is logged with [log/slog] if KernelConfig.Cmdline names a
+// different console.
 func (c *Context) SetKernelConsole(consoleID string) error {
 	cID := C.CString(consoleID)
 	defer C.free(unsafe.Pointer(cID))
-	return checkRet(
+	if err := checkRet(
 		C.krun_set_kernel_console(C.uint32_t(c.id), cID),
 		"krun_set_kernel_console",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) {
+		s.kernelConsole = consoleID
+		s.checkConsoles(c.id)
+	})
+	return nil
 }
 
 // AddVirtioConsoleDefault adds a virtio-console device with automatic detection.
 // If the file descriptors are TTYs, a single console port is created.
 // For non-TTY file descriptors, additional ports are created for stdin/stdout/stderr.
 func (c *Context) AddVirtioConsoleDefault(cfg VirtioConsoleConfig) error {
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_virtio_console_default(
 			C.uint32_t(c.id), C.int(cfg.InputFD), C.int(cfg.OutputFD), C.int(cfg.ErrFD),
 		),
 		"krun_add_virtio_console_default",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) {
+		s.consoles = append(s.consoles, consoleDevice{host: fmt.Sprintf("fd %d,%d,%d", cfg.InputFD, cfg.OutputFD, cfg.ErrFD)})
+	})
+	return nil
 }
 
 // AddSerialConsoleDefault adds a legacy serial device.
 func (c *Context) AddSerialConsoleDefault(cfg SerialConsoleConfig) error {
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_serial_console_default(C.uint32_t(c.id), C.int(cfg.InputFD), C.int(cfg.OutputFD)),
 		"krun_add_serial_console_default",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) {
+		s.serials = append(s.serials, fmt.Sprintf("fd %d,%d", cfg.InputFD, cfg.OutputFD))
+	})
+	return nil
 }
 
 // AddVirtioConsoleMultiport creates a multi-port virtio-console device.
@@ -66,6 +94,9 @@ func (c *Context) AddVirtioConsoleMultiport() (uint32, error) {
 	if ret < 0 {
 		return 0, retError(ret, "krun_add_virtio_console_multiport")
 	}
+	c.withState(func(s *contextState) {
+		s.consoles = append(s.consoles, consoleDevice{multiport: true, id: uint32(ret)})
+	})
 	return uint32(ret), nil
 }
 
@@ -75,12 +106,18 @@ func (c *Context) AddVirtioConsoleMultiport() (uint32, error) {
 func (c *Context) AddConsolePortTTY(cfg ConsolePortTTYConfig) error {
 	cName := C.CString(cfg.Name)
 	defer C.free(unsafe.Pointer(cName))
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_console_port_tty(
 			C.uint32_t(c.id), C.uint32_t(cfg.ConsoleID), cName, C.int(cfg.TTYFD),
 		),
 		"krun_add_console_port_tty",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) {
+		s.addConsolePort(cfg.ConsoleID, consolePort{name: cfg.Name, tty: true, host: fmt.Sprintf("fd %d", cfg.TTYFD)})
+	})
+	return nil
 }
 
 // AddConsolePortInOut adds a generic I/O port to a multi-port virtio-console device.
@@ -89,11 +126,17 @@ func (c *Context) AddConsolePortTTY(cfg ConsolePortTTYConfig) error {
 func (c *Context) AddConsolePortInOut(cfg ConsolePortInOutConfig) error {
 	cName := C.CString(cfg.Name)
 	defer C.free(unsafe.Pointer(cName))
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_console_port_inout(
 			C.uint32_t(c.id), C.uint32_t(cfg.ConsoleID), cName,
 			C.int(cfg.InputFD), C.int(cfg.OutputFD),
 		),
 		"krun_add_console_port_inout",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) {
+		s.addConsolePort(cfg.ConsoleID, consolePort{name: cfg.Name, host: fmt.Sprintf("fd %d,%d", cfg.InputFD, cfg.OutputFD)})
+	})
+	return nil
 }
@@ -0,0 +1,136 @@
+package console
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FailureKind is what went wrong in a [BootFailure].
+type FailureKind int
+
+const (
+	// FailurePanic is a kernel panic with no more specific cause seen.
+	FailurePanic FailureKind = iota
+	// FailureRootMount is the kernel failing to mount the root filesystem,
+	// usually a wrong root= or a missing driver.
+	FailureRootMount
+	// FailureInitNotFound is the kernel finding no init to run.
+	FailureInitNotFound
+	// FailureOOM is the OOM killer killing a process, or memory running out.
+	FailureOOM
+	// FailureOops is a kernel oops or BUG.
+	FailureOops
+)
+
+func (k FailureKind) String() string {
+	switch k {
+	case FailurePanic:
+		return "kernel panic"
+	case FailureRootMount:
+		return "root filesystem not mounted"
+	case FailureInitNotFound:
+		return "init not found"
+	case FailureOOM:
+		return "out of memory"
+	case FailureOops:
+		return "kernel oops"
+	}
+	return fmt.Sprintf("FailureKind(%d)", int(k))
+}
+
+// kernelLine matches the start of a kernel log line: the printk time
+// ("[    1.234567] "), followed by the caller ("[    T1] ") with
+// CONFIG_PRINTK_CALLER. Only such lines are searched, so a program in the
+// guest printing the same words is not taken for the kernel.
+const kernelLine = `^\[\s*\d+\.\d+\](?:\[\s*[TC]\d+\])? `
+
+// failurePatterns recognize the kernel messages of each failure. Causes
+// come before the panic they lead to, so the first matching line names
+// the cause. Only fatal forms count: "Failed to execute" is followed by
+// the kernel trying the next init, and most "BUG: " lines, such as soft
+// lockups, are warnings.
+var failurePatterns = []struct {
+	kind FailureKind
+	re   *regexp.Regexp
+}{
+	{FailureRootMount, kernelPattern(`VFS: (Unable to mount root fs|Cannot open root device)`)},
+	{FailureInitNotFound, kernelPattern(`No working init found|Requested init \S+ failed`)},
+	{FailureOOM, kernelPattern(`invoked oom-killer|Out of memory: Kill|Out of memory and no killable|oom-kill:`)},
+	{FailureOops, kernelPattern(`Oops: |BUG: unable to handle|BUG: kernel NULL pointer dereference|kernel BUG at|general protection fault|Unable to handle kernel`)},
+	{FailurePanic, kernelPattern(`Kernel panic - not syncing`)},
+}
+
+// kernelPattern matches re anywhere in the message of a kernel log line.
+func kernelPattern(re string) *regexp.Regexp {
+	return regexp.MustCompile(kernelLine + `.*(?:` + re + `)`)
+}
+
+// Lines of context an excerpt keeps before the first sign of failure, and
+// at most how many lines it has.
+const (
+	excerptBefore = 5
+	excerptMax    = 100
+)
+
+// BootFailure is a kernel failure recognized in console output by
+// [Analyze]. The kernel log must go to the analyzed console, which is the
+// case for the implicit console unless console= says otherwise, with
+// printk timestamps (CONFIG_PRINTK_TIME, or printk.time=1 on the command
+// line), which tell kernel messages from the guest's own output.
+type BootFailure struct {
+	Kind FailureKind
+	// Line is the first line showing the failure.
+	Line Line
+	// Excerpt is the output around it: a few lines before, through the
+	// end of the oops or panic report.
+	Excerpt []Line
+}
+
+func (f *BootFailure) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "console: %s: %s", f.Kind, strings.TrimSpace(f.Line.Text))
+	for _, l := range f.Excerpt {
+		b.WriteString("\n" + l.Text)
+	}
+	return b.String()
+}
+
+// Analyze looks for kernel panics, root filesystem mount failures, a
+// missing init, the OOM killer and oopses in lines, such as those returned
+// by [Log.Tail], and describes the first one. It returns nil if there is
+// none.
+func Analyze(lines []Line) *BootFailure {
+	first, last := -1, -1
+	var kind FailureKind
+	for i, l := range lines {
+		for _, p := range failurePatterns {
+			if !p.re.MatchString(l.Text) {
+				continue
+			}
+			if first < 0 {
+				first, kind = i, p.kind
+			}
+			last = i
+			break
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	start := max(first-excerptBefore, 0)
+	end := last + 1
+	// An oops or panic report runs on to its end marker.
+	for i := end; i < len(lines) && i < start+excerptMax; i++ {
+		if strings.Contains(lines[i].Text, "---[ end ") {
+			end = i + 1
+			break
+		}
+	}
+	end = min(end, start+excerptMax)
+	return &BootFailure{
+		Kind:    kind,
+		Line:    lines[first],
+		Excerpt: append([]Line(nil), lines[start:end]...),
+	}
+}
@@ -0,0 +1,91 @@
+package console
+
+import (
+	"strings"
+	"testing"
+)
+
+func lines(text string) []Line {
+	var ls []Line
+	for _, s := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		ls = append(ls, Line{Text: s})
+	}
+	return ls
+}
+
+func TestAnalyze(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		log     string
+		kind    FailureKind
+		line    string
+		excerpt int
+	}{
+		{"root mount", `[    0.410000] virtio_blk virtio1: [vda] 2097152 512-byte logical blocks
+[    0.420000] VFS: Cannot open root device "vdb" or unknown-block(0,0): error -6
+[    0.420100] Please append a correct "root=" boot option; here are the available partitions:
+[    0.420200] Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(0,0)
+[    0.420300] CPU: 0 PID: 1 Comm: swapper/0 Not tainted 6.12.3 #1
+[    0.420900] ---[ end Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(0,0) ]---
+`, FailureRootMount, `[    0.420000] VFS: Cannot open root device "vdb" or unknown-block(0,0): error -6`, 6},
+		{"init", `[    0.500000] Run /sbin/init as init process
+[    0.500100] Failed to execute /sbin/init (error -2)
+[    0.500200] Kernel panic - not syncing: No working init found.  Try passing init= option to kernel.
+`, FailureInitNotFound, "[    0.500200] Kernel panic - not syncing: No working init found.  Try passing init= option to kernel.", 3},
+		{"oom", `$ ./alloc
+[   12.000000] alloc invoked oom-killer: gfp_mask=0x140cca(GFP_HIGHUSER_MOVABLE|__GFP_COMP), order=0
+[   12.100000] Out of memory: Killed process 123 (alloc) total-vm:300000kB
+Killed
+`, FailureOOM, "[   12.000000] alloc invoked oom-killer: gfp_mask=0x140cca(GFP_HIGHUSER_MOVABLE|__GFP_COMP), order=0", 3},
+		{"oops", `[    3.000000] BUG: kernel NULL pointer dereference, address: 0000000000000000
+[    3.000100] Oops: 0002 [#1] PREEMPT SMP NOPTI
+[    3.000200] RIP: 0010:foo+0x10/0x20
+[    3.000300] ---[ end trace 0000000000000000 ]---
+$ echo still here
+`, FailureOops, "[    3.000000] BUG: kernel NULL pointer dereference, address: 0000000000000000", 4},
+		{"panic", `[    1.000000] Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000100
+`, FailurePanic, "[    1.000000] Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000100", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := Analyze(lines(tc.log))
+			if f == nil {
+				t.Fatal("no failure found")
+			}
+			if f.Kind != tc.kind || f.Line.Text != tc.line || len(f.Excerpt) != tc.excerpt {
+				t.Errorf("Analyze = %v %q, %d lines; want %v %q, %d lines", f.Kind, f.Line.Text, len(f.Excerpt), tc.kind, tc.line, tc.excerpt)
+			}
+			if !strings.HasPrefix(f.Error(), "console: "+tc.kind.String()+": ") {
+				t.Errorf("Error() = %q", f.Error())
+			}
+		})
+	}
+
+	if f := Analyze(lines("[    0.1] Linux version 6.12.3\nOops, typo in the config\nlogin: ")); f != nil {
+		t.Errorf("clean boot reported as %v", f)
+	}
+
+	// Non-fatal kernel messages: init found on the second try, a warning.
+	recovered := `[    0.500000] Run /sbin/init as init process
+[    0.500100] Failed to execute /sbin/init (error -2)
+[    0.500200] Run /bin/sh as init process
+[   30.000000] watchdog: BUG: soft lockup - CPU#0 stuck for 22s! [stress:120]
+`
+	if f := Analyze(lines(recovered)); f != nil {
+		t.Errorf("boot that recovered reported as %v", f)
+	}
+
+	// The same words printed by the workload are not the kernel's.
+	workload := `[    0.500000] Run /sbin/init as init process
+$ grep -c "Kernel panic - not syncing" crashes.log
+BUG: 3 tests failed
+Failed to execute /usr/bin/tool (error -2)
+[    0.500100][    T1] systemd[1]: Started Journal Service.
+`
+	if f := Analyze(lines(workload)); f != nil {
+		t.Errorf("workload output reported as %v", f)
+	}
+	f := Analyze(lines("[    2.000000][    T1] Kernel panic - not syncing: Attempted to kill init!"))
+	if f == nil || f.Kind != FailurePanic {
+		t.Errorf("panic with the printk caller = %v", f)
+	}
+}
@@ -0,0 +1,212 @@
+package console
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// RecorderOptions configures a [Recorder].
+type RecorderOptions struct {
+	// Width and Height are the terminal size in the header. Zero means
+	// 80x24.
+	Width, Height int
+	// Title and Env go into the header when set.
+	Title string
+	Env   map[string]string
+
+	// MaxSize caps the recording file, in bytes. When an event would take
+	// it over, the file is rotated and a new recording started. Zero means
+	// no cap.
+	MaxSize int64
+	// MaxFiles is how many rotated files are kept, as path.1 (the most
+	// recent) to path.N. Zero keeps none.
+	MaxFiles int
+}
+
+// Recorder writes console output to a file in asciicast v2 format: a JSON
+// header line followed by one JSON array per event. It is an io.Writer, so
+// it can be given to any console as its output. Methods are safe for
+// concurrent use.
+type Recorder struct {
+	path string
+	opts RecorderOptions
+	now  func() time.Time
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64     // bytes in f
+	start   time.Time // of the current file
+	pending []byte    // incomplete UTF-8 sequence held for the next write
+	err     error
+}
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// NewRecorder creates the recording file at path, replacing any file there.
+// The caller must call [Recorder.Close].
+func NewRecorder(path string, opts RecorderOptions) (*Recorder, error) {
+	if opts.Width == 0 {
+		opts.Width = 80
+	}
+	if opts.Height == 0 {
+		opts.Height = 24
+	}
+	r := &Recorder{path: path, opts: opts, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open starts a new recording file with a header.
+func (r *Recorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("console: %w", err)
+	}
+	r.f, r.size, r.start = f, 0, r.now()
+	hdr, _ := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     r.opts.Width,
+		Height:    r.opts.Height,
+		Timestamp: r.start.Unix(),
+		Title:     r.opts.Title,
+		Env:       r.opts.Env,
+	})
+	return r.writeLine(append(hdr, '\n'))
+}
+
+func (r *Recorder) writeLine(line []byte) error {
+	n, err := r.f.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("console: %w", err)
+	}
+	return nil
+}
+
+// rotate moves the current file to path.1, shifting older ones up and
+// dropping the oldest, and starts a new recording.
+func (r *Recorder) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return fmt.Errorf("console: %w", err)
+	}
+	if err := shiftFiles(r.path, r.opts.MaxFiles); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// shiftFiles moves path to path.1, shifting older rotated files up and
+// dropping the ones past keep. With keep 0 it does nothing, and path is
+// replaced when it is next created.
+func shiftFiles(path string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(path+"."+strconv.Itoa(i), path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		return fmt.Errorf("console: %w", err)
+	}
+	return nil
+}
+
+// event appends an event, rotating first if it would break the size cap.
+// The caller holds r.mu.
+func (r *Recorder) event(code string, data string) error {
+	if r.err != nil {
+		return r.err
+	}
+	t := r.now().Sub(r.start).Seconds()
+	line := r.format(t, code, data)
+	if r.opts.MaxSize > 0 && r.size+int64(len(line)) > r.opts.MaxSize {
+		if r.err = r.rotate(); r.err != nil {
+			return r.err
+		}
+		line = r.format(r.now().Sub(r.start).Seconds(), code, data)
+	}
+	r.err = r.writeLine(line)
+	return r.err
+}
+
+func (r *Recorder) format(t float64, code, data string) []byte {
+	// json.Marshal turns invalid UTF-8 into U+FFFD.
+	s, _ := json.Marshal(data)
+	return fmt.Appendf(nil, "[%.6f, %q, %s]\n", t, code, s)
+}
+
+// Write records p as output. A multi-byte character split between writes is
+// recorded whole with the second one.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.pending, p...)
+	r.pending = nil
+	if cut := incompleteSuffix(data); cut > 0 {
+		r.pending = append([]byte(nil), data[len(data)-cut:]...)
+		data = data[:len(data)-cut]
+	}
+	if len(data) == 0 {
+		return len(p), r.err
+	}
+	if err := r.event("o", string(data)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// incompleteSuffix returns the length of an incomplete UTF-8 sequence at
+// the end of p, or 0.
+func incompleteSuffix(p []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(p); i++ {
+		b := p[len(p)-i]
+		if utf8.RuneStart(b) {
+			if !utf8.FullRune(p[len(p)-i:]) {
+				return i
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// Resize records a terminal size change. Its signature matches
+// ConsolePortPTYConfig.OnResize. Rotated files start with the latest size.
+func (r *Recorder) Resize(rows, cols uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.opts.Width, r.opts.Height = int(cols), int(rows)
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Close flushes a held partial character and closes the file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) > 0 {
+		r.event("o", string(r.pending))
+		r.pending = nil
+	}
+	err := r.err
+	if cerr := r.f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("console: %w", cerr)
+	}
+	if r.err == nil {
+		r.err = os.ErrClosed
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package console
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCast parses a recording into its header and events.
+func readCast(t *testing.T, path string) (asciicastHeader, [][]any) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	var hdr asciicastHeader
+	if !sc.Scan() {
+		t.Fatal("empty recording")
+	}
+	if err := json.Unmarshal(sc.Bytes(), &hdr); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	var events [][]any
+	for sc.Scan() {
+		var ev []any
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("event %q: %v", sc.Text(), err)
+		}
+		events = append(events, ev)
+	}
+	return hdr, events
+}
+
+// fakeClock advances by a second on each reading.
+func fakeClock() func() time.Time {
+	now := time.Unix(1700000000, 0)
+	return func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.cast")
+	r, err := NewRecorder(path, RecorderOptions{Title: "vm", Env: map[string]string{"TERM": "xterm"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.now = fakeClock()
+	r.start = r.now()
+	r.Write([]byte("login: "))
+	r.Write([]byte("caf\xc3")) // "é" split across writes
+	r.Write([]byte("\xa9\r\n"))
+	r.Resize(50, 132)
+	r.Write([]byte("\xff"))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("late")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+
+	hdr, events := readCast(t, path)
+	if hdr.Version != 2 || hdr.Width != 80 || hdr.Height != 24 || hdr.Title != "vm" || hdr.Env["TERM"] != "xterm" {
+		t.Errorf("header = %+v", hdr)
+	}
+	want := [][]any{
+		{1.0, "o", "login: "},
+		{2.0, "o", "caf"},
+		{3.0, "o", "é\r\n"},
+		{4.0, "r", "132x50"},
+		{5.0, "o", "�"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		for j := range want[i] {
+			if events[i][j] != want[i][j] {
+				t.Errorf("event %d = %v, want %v", i, events[i], want[i])
+				break
+			}
+		}
+	}
+}
+
+func TestRecorder_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.cast")
+	r, err := NewRecorder(path, RecorderOptions{MaxSize: 200, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if i == 10 {
+			r.Resize(40, 100)
+		}
+		if _, err := r.Write([]byte(strings.Repeat("x", 20))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 200 {
+			t.Errorf("%s is %d bytes, over the cap", p, fi.Size())
+		}
+		if _, events := readCast(t, p); len(events) == 0 {
+			t.Errorf("%s has no events", p)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more rotated files than MaxFiles: %v", err)
+	}
+	if hdr, _ := readCast(t, path); hdr.Width != 100 || hdr.Height != 40 {
+		t.Errorf("rotated header size = %dx%d, want 100x40", hdr.Width, hdr.Height)
+	}
+}
@@ -0,0 +1,30 @@
+// Package console works with the byte streams of microVM consoles. It does
+// not need libkrun: its types are io.Writers and io.Readers that plug into
+// the consoles the krun package creates.
+//
+// A [Recorder] saves what a VM printed, with timing, as an asciicast v2
+// file that asciinema can replay:
+//
+//	rec, err := console.NewRecorder("vm.cast", console.RecorderOptions{MaxSize: 64 << 20, MaxFiles: 3})
+//	...
+//	err = ctx.AddVirtioConsoleIO(krun.VirtioConsoleIOConfig{Stdout: rec, Stderr: rec})
+//
+// On a TTY port, pass rec.Resize as ConsolePortPTYConfig.OnResize so window
+// size changes are recorded too.
+//
+// A [Log] splits output into lines stamped with the time the host received
+// them, keeps the latest in memory and sends them to rotated files, writers,
+// a log/slog logger or a callback.
+// [Analyze] finds kernel panics, root mount failures, a missing init, OOM
+// kills and oopses in those lines and reports them as a [BootFailure].
+//
+// A [Mux] lets several clients share one console, attaching and detaching
+// while the VM runs; krun's AddConsolePortSocket serves one on UNIX
+// sockets.
+//
+// An [Expect] logs in and runs commands on a guest that has no agent, by
+// waiting for its output and typing into its console, and keeps a
+// transcript to show when an expectation fails.
+//
+// In the guest, [OpenPort] opens a virtio-console port by name.
+package console
@@ -0,0 +1,243 @@
+package console
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExpectOptions configures an [Expect].
+type ExpectOptions struct {
+	// Timeout is how long ExpectString and ExpectRegexp wait for a match.
+	// Zero means 10 seconds.
+	Timeout time.Duration
+	// Log, if set, receives the console output as it arrives, for example
+	// os.Stderr while debugging a test.
+	Log io.Writer
+	// Window is how many bytes of the latest output not consumed by a
+	// match are kept for expectations to search; older output is dropped,
+	// so a chatty guest cannot grow memory without bound. It is also how
+	// much of the transcript is kept. Zero means 64 KiB.
+	Window int
+	// KeepTranscript keeps all the output for [Expect.Transcript] instead
+	// of the last Window bytes.
+	KeepTranscript bool
+}
+
+// expectErrorTail is how much of the transcript an [ExpectError] quotes.
+const expectErrorTail = 2 << 10
+
+// Expect drives a console the way a person at the keyboard would: it
+// waits for output to match and sends input, for guests that have no
+// agent. Output is read in the background from the moment the Expect is
+// created; each match consumes the output up to its end, so the next
+// expectation only sees what came after.
+//
+// Expect is safe for use by several goroutines, but expectations are
+// matched against one shared stream, so they are usually made from one.
+type Expect struct {
+	*expectState
+	timeout time.Duration
+}
+
+type expectState struct {
+	w   io.Writer
+	wmu sync.Mutex // serializes Send
+
+	window  int
+	keepAll bool // keep the whole transcript
+
+	mu         sync.Mutex
+	pending    []byte // output not consumed by a match yet
+	transcript []byte
+	err        error         // from r, once it fails
+	changed    chan struct{} // closed when output arrives or r fails
+}
+
+// NewExpect returns an Expect reading the console's output from r and
+// typing into w. With krun's AddSerialConsoleDefault or
+// AddVirtioConsoleDefault, r and w are the host ends of pipes whose other
+// ends are passed as OutputFD and InputFD.
+func NewExpect(r io.Reader, w io.Writer, opts ExpectOptions) *Expect {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Window == 0 {
+		opts.Window = 64 << 10
+	}
+	s := &expectState{w: w, window: opts.Window, keepAll: opts.KeepTranscript, changed: make(chan struct{})}
+	go s.read(r, opts.Log)
+	return &Expect{expectState: s, timeout: opts.Timeout}
+}
+
+func (s *expectState) read(r io.Reader, log io.Writer) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 && log != nil {
+			log.Write(buf[:n])
+		}
+		s.mu.Lock()
+		s.pending = trimFront(append(s.pending, buf[:n]...), s.window)
+		s.transcript = append(s.transcript, buf[:n]...)
+		if !s.keepAll {
+			s.transcript = trimFront(s.transcript, s.window)
+		}
+		if err != nil {
+			s.err = err
+		}
+		close(s.changed)
+		s.changed = make(chan struct{})
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// trimFront drops the start of b to keep at most n bytes. The array
+// behind b is freed once append moves the rest to a new one.
+func trimFront(b []byte, n int) []byte {
+	if len(b) <= n {
+		return b
+	}
+	return b[len(b)-n:]
+}
+
+// WithTimeout returns an Expect on the same console whose expectations
+// wait for d.
+func (e *Expect) WithTimeout(d time.Duration) *Expect {
+	return &Expect{expectState: e.expectState, timeout: d}
+}
+
+// ExpectString waits until the console prints s.
+func (e *Expect) ExpectString(s string) error {
+	_, err := e.expect(fmt.Sprintf("%q", s), func(p []byte) []int {
+		i := bytes.Index(p, []byte(s))
+		if i < 0 {
+			return nil
+		}
+		return []int{i, i + len(s)}
+	})
+	return err
+}
+
+// ExpectRegexp waits until the console prints a match for re, and returns
+// the match and its submatches as [regexp.Regexp.FindStringSubmatch] does.
+// The match is made against the output received so far, so a pattern
+// that can match more text, such as `\d+`, may match less than the guest
+// goes on to print.
+func (e *Expect) ExpectRegexp(re *regexp.Regexp) ([]string, error) {
+	var m []int
+	p, err := e.expect("/"+re.String()+"/", func(p []byte) []int {
+		m = re.FindSubmatchIndex(p)
+		return m
+	})
+	if err != nil {
+		return nil, err
+	}
+	subs := make([]string, len(m)/2)
+	for i := range subs {
+		if m[2*i] >= 0 {
+			subs[i] = string(p[m[2*i]:m[2*i+1]])
+		}
+	}
+	return subs, nil
+}
+
+// expect waits until match finds a match in the pending output, consumes
+// the output up to its end and returns the output it was found in.
+func (e *Expect) expect(pattern string, match func([]byte) []int) ([]byte, error) {
+	timer := time.NewTimer(e.timeout)
+	defer timer.Stop()
+	for {
+		e.mu.Lock()
+		p := e.pending
+		if loc := match(p); loc != nil {
+			e.pending = p[loc[1]:]
+			e.mu.Unlock()
+			return p, nil
+		}
+		if e.err != nil {
+			err := e.failed(pattern, e.err)
+			e.mu.Unlock()
+			return nil, err
+		}
+		changed := e.changed
+		e.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			e.mu.Lock()
+			err := e.failed(pattern, os.ErrDeadlineExceeded)
+			e.mu.Unlock()
+			return nil, err
+		}
+	}
+}
+
+// failed returns the error for an expectation that was not met. e.mu is
+// held.
+func (e *Expect) failed(pattern string, err error) error {
+	tail := e.transcript
+	if len(tail) > expectErrorTail {
+		tail = tail[len(tail)-expectErrorTail:]
+	}
+	return &ExpectError{Pattern: pattern, Timeout: e.timeout, Tail: string(tail), Err: err}
+}
+
+// Send types s on the console.
+func (e *Expect) Send(s string) error {
+	e.wmu.Lock()
+	defer e.wmu.Unlock()
+	if _, err := io.WriteString(e.w, s); err != nil {
+		return fmt.Errorf("console: send: %w", err)
+	}
+	return nil
+}
+
+// SendLine types s followed by a newline.
+func (e *Expect) SendLine(s string) error {
+	return e.Send(s + "\n")
+}
+
+// Transcript returns the output the console printed so far, matched or
+// not: all of it with ExpectOptions.KeepTranscript, otherwise the last
+// ExpectOptions.Window bytes.
+func (e *Expect) Transcript() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return string(e.transcript)
+}
+
+// ExpectError reports an expectation that was not met, with the end of the
+// transcript so a failing test shows what the guest printed instead.
+type ExpectError struct {
+	Pattern string // quoted string or /regexp/
+	Timeout time.Duration
+	Tail    string // the last output received
+	Err     error  // os.ErrDeadlineExceeded, or why the output ended
+}
+
+func (e *ExpectError) Error() string {
+	var b strings.Builder
+	if e.Err == os.ErrDeadlineExceeded {
+		fmt.Fprintf(&b, "console: %s not seen within %v", e.Pattern, e.Timeout)
+	} else {
+		fmt.Fprintf(&b, "console: %s not seen before output ended: %v", e.Pattern, e.Err)
+	}
+	if e.Tail == "" {
+		b.WriteString("; no output")
+	} else {
+		fmt.Fprintf(&b, "; last output:\n%s", e.Tail)
+	}
+	return b.String()
+}
+
+func (e *ExpectError) Unwrap() error { return e.Err }
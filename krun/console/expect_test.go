@@ -0,0 +1,103 @@
+package console
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGuest answers a login prompt and echoes commands, like a shell on a
+// serial console.
+func fakeGuest(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	io.WriteString(out, "Welcome\r\nlogin: ")
+	sc := bufio.NewScanner(in)
+	if !sc.Scan() || sc.Text() != "root" {
+		return
+	}
+	io.WriteString(out, "root\r\n# ")
+	for sc.Scan() {
+		io.WriteString(out, sc.Text()+"\r\n")
+		if sc.Text() == "uname -r" {
+			io.WriteString(out, "6.12.3\r\n")
+		}
+		io.WriteString(out, "# ")
+	}
+}
+
+func TestExpect(t *testing.T) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go fakeGuest(inR, outW)
+	e := NewExpect(outR, inW, ExpectOptions{})
+
+	if err := e.ExpectString("login: "); err != nil {
+		t.Fatal(err)
+	}
+	e.SendLine("root")
+	if err := e.ExpectString("# "); err != nil {
+		t.Fatal(err)
+	}
+	e.SendLine("uname -r")
+	m, err := e.ExpectRegexp(regexp.MustCompile(`(\d+)\.(\d+)\.\d+\r\n`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 3 || m[1] != "6" || m[2] != "12" {
+		t.Errorf("submatches = %q", m)
+	}
+	// The prompt before the command was consumed by the earlier match.
+	if err := e.ExpectString("# "); err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.WithTimeout(50 * time.Millisecond).ExpectString("never")
+	var ee *ExpectError
+	if !errors.As(err, &ee) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want an ExpectError timeout", err)
+	}
+	if !strings.HasSuffix(ee.Tail, "6.12.3\r\n# ") || !strings.Contains(err.Error(), `"never" not seen within 50ms`) {
+		t.Errorf("err = %v", err)
+	}
+
+	inW.Close()
+	if err := e.ExpectString("never"); !errors.Is(err, io.EOF) {
+		t.Errorf("after the guest quit: %v, want EOF", err)
+	}
+	if got := e.Transcript(); !strings.HasPrefix(got, "Welcome\r\nlogin: root\r\n") {
+		t.Errorf("transcript = %q", got)
+	}
+}
+
+func TestExpect_Window(t *testing.T) {
+	r, w := io.Pipe()
+	e := NewExpect(r, io.Discard, ExpectOptions{Window: 64})
+	go func() {
+		io.WriteString(w, "early\n"+strings.Repeat("x", 1000)+"\nlate\n")
+		w.Close()
+	}()
+	if err := e.ExpectString("late"); err != nil {
+		t.Fatal(err)
+	}
+	// Output that fell out of the window can no longer be matched.
+	if err := e.WithTimeout(time.Second).ExpectString("early"); !errors.Is(err, io.EOF) {
+		t.Errorf("err = %v, want EOF", err)
+	}
+	if got := e.Transcript(); len(got) > 64 || !strings.HasSuffix(got, "late\n") {
+		t.Errorf("transcript = %q, want the last 64 bytes", got)
+	}
+
+	r, w = io.Pipe()
+	e = NewExpect(r, io.Discard, ExpectOptions{Window: 64, KeepTranscript: true})
+	io.WriteString(w, "early\n"+strings.Repeat("x", 1000))
+	w.Close()
+	e.ExpectString("never")
+	if got := e.Transcript(); !strings.HasPrefix(got, "early\n") || len(got) != 1006 {
+		t.Errorf("kept transcript has %d bytes, want 1006", len(got))
+	}
+}
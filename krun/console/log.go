@@ -0,0 +1,233 @@
+package console
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Line is a line of console output, with the time the host received its
+// first byte.
+type Line struct {
+	Time time.Time
+	Text string // without the line ending
+}
+
+// lineTimeFormat is how Line.String formats times: RFC 3339 with
+// microseconds, so boot stages can be timed from a log file.
+const lineTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// String returns the line as a [Log] writes it to files and writers: the
+// time, a space and the text.
+func (l Line) String() string {
+	return l.Time.Format(lineTimeFormat) + " " + l.Text
+}
+
+// maxLineLen is where a line that does not end is cut, so output without
+// newlines, such as a progress bar, still reaches the log.
+const maxLineLen = 4 << 10
+
+// LogOptions configures a [Log].
+type LogOptions struct {
+	// Buffer is how many bytes of the most recent lines are kept in memory
+	// for [Log.Tail]. Zero means 64 KiB.
+	Buffer int
+
+	// Path, if set, is a file the lines are appended to, as [Line.String]
+	// formats them. MaxSize caps it in bytes: when a line would take it
+	// over, the file is rotated to path.1 (the most recent) to
+	// path.MaxFiles. Zero means no cap.
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+
+	// Writers receive each line as written to Path.
+	Writers []io.Writer
+	// Logger, if set, logs each line at level Info with the line's time.
+	Logger *slog.Logger
+	// OnLine, if set, is called with each line.
+	OnLine func(Line)
+}
+
+// Log turns console output into timestamped lines and sends them to files,
+// writers, a logger and a callback, keeping the latest in memory. It is an
+// io.Writer to give to a console as its output.
+//
+// Write never fails, so a broken destination cannot stall the VM writing
+// to the console; the first error is kept and returned by [Log.Close].
+// Output written after Close, such as the last of a console drained late,
+// is dropped.
+type Log struct {
+	opts LogOptions
+	now  func() time.Time
+
+	wmu     sync.Mutex // serializes Write and Close
+	partial []byte     // start of a line not ended yet
+	start   time.Time  // when partial began
+	f       *os.File
+	size    int64 // bytes in f
+	err     error
+	closed  bool
+
+	mu    sync.Mutex // guards lines and bytes, for Tail
+	lines []Line
+	bytes int
+}
+
+// NewLog returns a Log, opening opts.Path if set. The caller must call
+// [Log.Close].
+func NewLog(opts LogOptions) (*Log, error) {
+	if opts.Buffer == 0 {
+		opts.Buffer = 64 << 10
+	}
+	l := &Log{opts: opts, now: time.Now}
+	if opts.Path != "" {
+		if err := l.open(os.O_APPEND); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *Log) open(flag int) error {
+	f, err := os.OpenFile(l.opts.Path, os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return fmt.Errorf("console: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("console: %w", err)
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// Write splits p into lines. A line is passed on once its newline arrives,
+// or once it grows to 4 KiB.
+func (l *Log) Write(p []byte) (int, error) {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	if l.closed {
+		return len(p), nil
+	}
+	now := l.now()
+	for rest := p; len(rest) > 0; {
+		if len(l.partial) == 0 {
+			l.start = now
+		}
+		i := strings.IndexByte(string(rest), '\n')
+		if i < 0 {
+			l.partial = append(l.partial, rest...)
+			for len(l.partial) >= maxLineLen {
+				l.emit(l.partial[:maxLineLen])
+				l.partial = append(l.partial[:0], l.partial[maxLineLen:]...)
+			}
+			break
+		}
+		l.partial = append(l.partial, rest[:i]...)
+		l.emit(l.partial)
+		l.partial = l.partial[:0]
+		rest = rest[i+1:]
+	}
+	return len(p), nil
+}
+
+// emit passes on a complete line. l.wmu is held.
+func (l *Log) emit(text []byte) {
+	line := Line{Time: l.start, Text: strings.TrimSuffix(string(text), "\r")}
+
+	l.mu.Lock()
+	l.lines = append(l.lines, line)
+	l.bytes += len(line.Text)
+	for l.bytes > l.opts.Buffer && len(l.lines) > 1 {
+		l.bytes -= len(l.lines[0].Text)
+		l.lines = l.lines[1:]
+	}
+	l.mu.Unlock()
+
+	out := line.String() + "\n"
+	if l.f != nil {
+		l.keep(l.writeFile(out))
+	}
+	for _, w := range l.opts.Writers {
+		_, err := io.WriteString(w, out)
+		l.keep(err)
+	}
+	if lg := l.opts.Logger; lg != nil && lg.Enabled(context.Background(), slog.LevelInfo) {
+		r := slog.NewRecord(line.Time, slog.LevelInfo, line.Text, 0)
+		l.keep(lg.Handler().Handle(context.Background(), r))
+	}
+	if l.opts.OnLine != nil {
+		l.opts.OnLine(line)
+	}
+}
+
+// keep records the first error.
+func (l *Log) keep(err error) {
+	if l.err == nil && err != nil {
+		l.err = err
+	}
+}
+
+// writeFile appends to the file, rotating first if the line would break
+// the size cap.
+func (l *Log) writeFile(s string) error {
+	if l.opts.MaxSize > 0 && l.size > 0 && l.size+int64(len(s)) > l.opts.MaxSize {
+		if err := l.f.Close(); err != nil {
+			return fmt.Errorf("console: %w", err)
+		}
+		l.f = nil
+		if err := shiftFiles(l.opts.Path, l.opts.MaxFiles); err != nil {
+			return err
+		}
+		if err := l.open(os.O_TRUNC); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.WriteString(s)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("console: %w", err)
+	}
+	return nil
+}
+
+// Tail returns up to the last n lines kept in memory, oldest first; n <= 0
+// returns them all. It can be called after Close, for example from an
+// OnExit function writing a crash report.
+func (l *Log) Tail(n int) []Line {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines := l.lines
+	if n > 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	return append([]Line(nil), lines...)
+}
+
+// Close passes on a line not ended yet, closes the file and returns the
+// first error any destination reported.
+func (l *Log) Close() error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	if l.closed {
+		return l.err
+	}
+	l.closed = true
+	if len(l.partial) > 0 {
+		l.emit(l.partial)
+		l.partial = nil
+	}
+	if l.f != nil {
+		if err := l.f.Close(); err != nil {
+			l.keep(fmt.Errorf("console: %w", err))
+		}
+	}
+	return l.err
+}
@@ -0,0 +1,118 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordHandler keeps the records it handles.
+type recordHandler struct{ records []slog.Record }
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler      { return h }
+
+func TestLog(t *testing.T) {
+	var out bytes.Buffer
+	var h recordHandler
+	var called []string
+	l, err := NewLog(LogOptions{
+		Buffer:  16,
+		Writers: []io.Writer{&out},
+		Logger:  slog.New(&h),
+		OnLine:  func(line Line) { called = append(called, line.Text) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = fakeClock()
+	l.Write([]byte("[    0.000000] Linux version 6.12\r\n[    0.1"))
+	l.Write([]byte("00000] Command line\r\n"))
+	l.Write([]byte("login: "))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"[    0.000000] Linux version 6.12", "[    0.100000] Command line", "login: "}
+	if strings.Join(called, "|") != strings.Join(want, "|") {
+		t.Errorf("lines = %q, want %q", called, want)
+	}
+	// The second line started arriving with the first write.
+	t0 := time.Unix(1700000001, 0)
+	wantOut := Line{t0, want[0]}.String() + "\n" + Line{t0, want[1]}.String() + "\n" + Line{t0.Add(2 * time.Second), want[2]}.String() + "\n"
+	if out.String() != wantOut {
+		t.Errorf("writer got %q, want %q", out.String(), wantOut)
+	}
+	if len(h.records) != 3 || h.records[2].Message != "login: " || !h.records[2].Time.Equal(t0.Add(2*time.Second)) {
+		t.Errorf("slog records = %v", h.records)
+	}
+	// Buffer holds 16 bytes of text, but always the latest line.
+	if tail := l.Tail(0); len(tail) != 1 || tail[0].Text != "login: " {
+		t.Errorf("Tail(0) = %v", tail)
+	}
+	// Writes after Close are dropped without an error.
+	if n, err := l.Write([]byte("x\n")); n != 2 || err != nil {
+		t.Errorf("Write after Close = %d, %v; want 2, nil", n, err)
+	}
+	if tail := l.Tail(0); len(tail) != 1 || tail[0].Text != "login: " {
+		t.Errorf("Tail(0) after a Write after Close = %v", tail)
+	}
+}
+
+func TestLog_LongLine(t *testing.T) {
+	l, _ := NewLog(LogOptions{})
+	l.Write(bytes.Repeat([]byte("="), maxLineLen+10))
+	if tail := l.Tail(5); len(tail) != 1 || len(tail[0].Text) != maxLineLen {
+		t.Errorf("a line without newline was not cut: %d lines", len(tail))
+	}
+	l.Close()
+	if tail := l.Tail(5); len(tail) != 2 || len(tail[1].Text) != 10 {
+		t.Errorf("the rest was not passed on at Close: %d lines", len(tail))
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+	l, err := NewLog(LogOptions{Path: path, MaxSize: 100, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		l.Write([]byte("0123456789\n"))
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) == 0 || len(b) > 100 || !strings.HasSuffix(string(b), " 0123456789\n") {
+			t.Errorf("%s = %q", p, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more rotated files than MaxFiles: %v", err)
+	}
+
+	// Reopening appends.
+	l, _ = NewLog(LogOptions{Path: path})
+	before, _ := os.Stat(path)
+	l.Write([]byte("more\n"))
+	l.Close()
+	if after, _ := os.Stat(path); after.Size() <= before.Size() {
+		t.Errorf("file not appended to: %d -> %d bytes", before.Size(), after.Size())
+	}
+}
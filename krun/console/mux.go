@@ -0,0 +1,268 @@
+package console
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// MuxOptions configures a [Mux].
+type MuxOptions struct {
+	// Scrollback is how many bytes of recent output a client is sent when
+	// it attaches. Zero means 64 KiB; negative means none.
+	Scrollback int
+	// DetachKeys is the key sequence a client types to detach. Nil means
+	// Ctrl-P Ctrl-Q, as in docker attach.
+	DetachKeys []byte
+}
+
+// DefaultDetachKeys is Ctrl-P Ctrl-Q.
+var DefaultDetachKeys = []byte{0x10, 0x11}
+
+// muxQueue is how many output chunks a client may fall behind before it is
+// disconnected. A slow client never holds up the VM.
+const muxQueue = 256
+
+// Mux shares one console among several clients, like screen or docker
+// attach. The VM's output is written to the Mux, which keeps a scrollback
+// buffer and sends the output to every attached client; input from
+// read-write clients is read from the Mux and fed to the VM.
+//
+// Clients are plain byte streams, so any tool that connects to a UNIX
+// socket and puts the terminal into raw mode works as a client:
+//
+//	socat -,raw,echo=0 UNIX-CONNECT:/run/vm1/console.sock
+type Mux struct {
+	detachKeys []byte
+
+	mu        sync.Mutex
+	scroll    *ring
+	clients   map[*muxClient]bool
+	listeners []net.Listener
+
+	input     chan []byte
+	pending   []byte // input received but not read yet
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type muxClient struct {
+	conn io.ReadWriteCloser
+	out  chan []byte
+	once sync.Once
+}
+
+func (c *muxClient) close() {
+	c.once.Do(func() {
+		close(c.out)
+		c.conn.Close()
+	})
+}
+
+// NewMux returns a Mux with no clients. The caller must call [Mux.Close].
+func NewMux(opts MuxOptions) *Mux {
+	if opts.Scrollback == 0 {
+		opts.Scrollback = 64 << 10
+	}
+	if opts.DetachKeys == nil {
+		opts.DetachKeys = DefaultDetachKeys
+	}
+	return &Mux{
+		detachKeys: opts.DetachKeys,
+		scroll:     newRing(opts.Scrollback),
+		clients:    make(map[*muxClient]bool),
+		input:      make(chan []byte),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Write sends console output to the scrollback buffer and the attached
+// clients. It never blocks on a client: one too far behind is
+// disconnected.
+func (m *Mux) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scroll.Write(p)
+	for c := range m.clients {
+		select {
+		case c.out <- append([]byte(nil), p...):
+		default:
+			delete(m.clients, c)
+			c.close()
+		}
+	}
+	return len(p), nil
+}
+
+// Read returns input typed by read-write clients. It returns io.EOF once
+// the Mux is closed.
+func (m *Mux) Read(p []byte) (int, error) {
+	if len(m.pending) == 0 {
+		select {
+		case m.pending = <-m.input:
+		case <-m.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, m.pending)
+	m.pending = m.pending[n:]
+	return n, nil
+}
+
+// Attach serves a client on conn until it detaches, disconnects or the
+// Mux is closed. The client first receives the scrollback buffer. Input
+// from a read-only client is discarded, except for the detach keys.
+func (m *Mux) Attach(conn io.ReadWriteCloser, readOnly bool) {
+	c := &muxClient{conn: conn, out: make(chan []byte, muxQueue)}
+	m.mu.Lock()
+	select {
+	case <-m.closed:
+		m.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	if back := m.scroll.Bytes(); len(back) > 0 {
+		c.out <- back
+	}
+	m.clients[c] = true
+	m.mu.Unlock()
+
+	go func() {
+		for p := range c.out {
+			if _, err := conn.Write(p); err != nil {
+				m.detach(c)
+				return
+			}
+		}
+	}()
+
+	d := &detacher{keys: m.detachKeys}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		in, detached := d.scan(buf[:n])
+		if len(in) > 0 && !readOnly {
+			select {
+			case m.input <- in:
+			case <-m.closed:
+				detached = true
+			}
+		}
+		if detached || err != nil {
+			break
+		}
+	}
+	m.detach(c)
+}
+
+func (m *Mux) detach(c *muxClient) {
+	m.mu.Lock()
+	delete(m.clients, c)
+	m.mu.Unlock()
+	c.close()
+}
+
+// Serve accepts clients on l until l or the Mux is closed, attaching them
+// read-only or read-write.
+func (m *Mux) Serve(l net.Listener, readOnly bool) error {
+	if !m.addListener(l) {
+		return nil
+	}
+	return m.serve(l, readOnly)
+}
+
+// Listen is Serve in a new goroutine. l is registered before Listen
+// returns, so a Close from then on closes it.
+func (m *Mux) Listen(l net.Listener, readOnly bool) {
+	if m.addListener(l) {
+		go m.serve(l, readOnly)
+	}
+}
+
+// addListener registers l to be closed by Close. If the Mux is already
+// closed, it closes l and returns false.
+func (m *Mux) addListener(l net.Listener) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.closed:
+		l.Close()
+		return false
+	default:
+	}
+	m.listeners = append(m.listeners, l)
+	return true
+}
+
+func (m *Mux) serve(l net.Listener, readOnly bool) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-m.closed:
+				return nil
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go m.Attach(conn, readOnly)
+	}
+}
+
+// Close disconnects the clients, closes the listeners passed to
+// [Mux.Serve] and makes Read return io.EOF.
+func (m *Mux) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, l := range m.listeners {
+			l.Close()
+		}
+		for c := range m.clients {
+			delete(m.clients, c)
+			c.close()
+		}
+	})
+	return nil
+}
+
+// detacher finds the detach keys in a client's input, which may be split
+// across reads.
+type detacher struct {
+	keys    []byte
+	matched int // bytes of keys seen at the end of the input so far
+}
+
+// scan returns the input to pass on, holding back a partial match of the
+// keys, and whether the keys were typed.
+func (d *detacher) scan(p []byte) ([]byte, bool) {
+	if len(d.keys) == 0 {
+		return p, false
+	}
+	var out bytes.Buffer
+	for _, b := range p {
+		if b == d.keys[d.matched] {
+			d.matched++
+			if d.matched == len(d.keys) {
+				return out.Bytes(), true
+			}
+			continue
+		}
+		// Not the keys after all: pass on what was held back.
+		out.Write(d.keys[:d.matched])
+		d.matched = 0
+		if b == d.keys[0] {
+			d.matched = 1
+			continue
+		}
+		out.WriteByte(b)
+	}
+	return out.Bytes(), false
+}
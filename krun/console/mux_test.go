@@ -0,0 +1,127 @@
+package console
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readUntil reads from conn until the data read ends with want.
+func readUntil(t *testing.T, conn net.Conn, want string) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []byte
+	buf := make([]byte, 256)
+	for !bytes.HasSuffix(got, []byte(want)) {
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			t.Fatalf("read %q, want suffix %q: %v", got, want, err)
+		}
+	}
+	return string(got)
+}
+
+func TestMux(t *testing.T) {
+	m := NewMux(MuxOptions{Scrollback: 8})
+	defer m.Close()
+	m.Write([]byte("boot messages\r\nlogin: "))
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "console.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.Serve(l, false)
+	rw, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	if got := readUntil(t, rw, "login: "); got != "\nlogin: " {
+		t.Errorf("scrollback = %q, want the last 8 bytes", got)
+	}
+
+	roServer, ro := net.Pipe()
+	go m.Attach(roServer, true)
+	ro.Write([]byte("ignored"))
+	rw.Write([]byte("root\r"))
+	buf := make([]byte, 16)
+	n, err := m.Read(buf)
+	if err != nil || string(buf[:n]) != "root\r" {
+		t.Errorf("input = %q, %v", buf[:n], err)
+	}
+
+	m.Write([]byte("# "))
+	readUntil(t, rw, "# ")
+	readUntil(t, ro, "# ")
+
+	// Detach keys split across writes; the byte before them still goes
+	// through.
+	rw.Write([]byte{'x', 0x10})
+	rw.Write([]byte{0x11})
+	n, _ = m.Read(buf)
+	if string(buf[:n]) != "x" {
+		t.Errorf("input before detach = %q", buf[:n])
+	}
+	rw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(rw); err != nil {
+		t.Errorf("client not disconnected on detach: %v", err)
+	}
+
+	m.Close()
+	if _, err := m.Read(buf); err != io.EOF {
+		t.Errorf("Read after Close = %v, want EOF", err)
+	}
+	ro.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(ro); err != nil {
+		t.Errorf("client not disconnected on Close: %v", err)
+	}
+}
+
+func TestMux_Listen(t *testing.T) {
+	dir := t.TempDir()
+	m := NewMux(MuxOptions{})
+	l, err := net.Listen("unix", filepath.Join(dir, "a.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing right after Listen closes the listener, however the
+	// goroutines are scheduled.
+	m.Listen(l, false)
+	m.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+	}
+
+	l, err = net.Listen("unix", filepath.Join(dir, "b.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Listen(l, false)
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Listen on a closed Mux = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestDetacher(t *testing.T) {
+	d := &detacher{keys: []byte("^q")}
+	for _, tc := range []struct {
+		in, out  string
+		detached bool
+	}{
+		{"ab", "ab", false},
+		{"a^", "a", false},
+		{"x", "^x", false},
+		{"^^", "^", false},
+		{"q", "", true},
+	} {
+		out, detached := d.scan([]byte(tc.in))
+		if string(out) != tc.out || detached != tc.detached {
+			t.Errorf("scan(%q) = %q, %v; want %q, %v", tc.in, out, detached, tc.out, tc.detached)
+		}
+	}
+}
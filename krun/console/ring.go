@@ -0,0 +1,30 @@
+package console
+
+// ring keeps the last bytes written to it.
+type ring struct {
+	buf  []byte
+	size int // capacity
+}
+
+func newRing(size int) *ring {
+	return &ring{size: size}
+}
+
+func (r *ring) Write(p []byte) {
+	if r.size <= 0 {
+		return
+	}
+	if len(p) >= r.size {
+		r.buf = append(r.buf[:0], p[len(p)-r.size:]...)
+		return
+	}
+	if over := len(r.buf) + len(p) - r.size; over > 0 {
+		r.buf = append(r.buf[:0], r.buf[over:]...)
+	}
+	r.buf = append(r.buf, p...)
+}
+
+// Bytes returns a copy of what the ring holds, oldest first.
+func (r *ring) Bytes() []byte {
+	return append([]byte(nil), r.buf...)
+}
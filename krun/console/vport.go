@@ -0,0 +1,38 @@
+package console
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where the guest kernel lists virtio-console ports and their device
+// nodes; variables for tests.
+var (
+	virtioPortsDir = "/sys/class/virtio-ports"
+	devDir         = "/dev"
+)
+
+// OpenPort opens the virtio-console port called name, for use in the
+// guest with ports added by krun's AddConsoleChannel or
+// AddConsolePortInOut. It finds the port through sysfs, so it works
+// without udev and the /dev/virtio-ports links it creates.
+func OpenPort(name string) (*os.File, error) {
+	entries, err := os.ReadDir(virtioPortsDir)
+	if err != nil {
+		return nil, fmt.Errorf("console: %w", err)
+	}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(virtioPortsDir, e.Name(), "name"))
+		if err != nil || strings.TrimSuffix(string(b), "\n") != name {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(devDir, e.Name()), os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("console: %w", err)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("console: no virtio-console port named %q: %w", name, os.ErrNotExist)
+}
@@ -0,0 +1,35 @@
+package console
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenPort(t *testing.T) {
+	dir := t.TempDir()
+	virtioPortsDir, devDir = filepath.Join(dir, "sys"), filepath.Join(dir, "dev")
+	t.Cleanup(func() { virtioPortsDir, devDir = "/sys/class/virtio-ports", "/dev" })
+	for port, name := range map[string]string{"vport1p0": "", "vport1p1": "rpc", "vport1p2": "logs"} {
+		os.MkdirAll(filepath.Join(virtioPortsDir, port), 0o755)
+		if err := os.WriteFile(filepath.Join(virtioPortsDir, port, "name"), []byte(name+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.MkdirAll(devDir, 0o755)
+		os.WriteFile(filepath.Join(devDir, port), []byte(port), 0o644)
+	}
+
+	f, err := OpenPort("rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if b, _ := io.ReadAll(f); string(b) != "vport1p1" {
+		t.Errorf("opened %q, want vport1p1", b)
+	}
+	if _, err := OpenPort("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("OpenPort(missing) = %v, want ErrNotExist", err)
+	}
+}
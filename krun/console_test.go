@@ -1,8 +1,19 @@
 package krun
 
 import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/mishushakov/libkrun-go/krun/console"
 )
 
 func TestSetConsoleOutput(t *testing.T) {
@@ -35,3 +46,205 @@ func TestAddVirtioConsoleMultiport(t *testing.T) {
 	}
 	t.Logf("console ID: %d", id)
 }
+
+func TestConsoleStreams(t *testing.T) {
+	ctx := newTestContext(t)
+	var out bytes.Buffer
+	s := newConsoleStreams()
+	in, err := s.input(strings.NewReader("input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outFD, err := s.output(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nullFD, err := s.output(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.start(ctx)
+
+	buf := make([]byte, 16)
+	n, err := syscall.Read(in, buf)
+	if err != nil || string(buf[:n]) != "input" {
+		t.Errorf("VM read %q, %v", buf[:n], err)
+	}
+	if _, err := syscall.Write(outFD, []byte("output")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syscall.Write(nullFD, []byte("dropped")); err != nil {
+		t.Fatal(err)
+	}
+	runExitHooks(ctx.id)
+	if out.String() != "output" {
+		t.Errorf("output = %q", out.String())
+	}
+}
+
+// slowWriter takes its time over the first write.
+type slowWriter struct {
+	started chan struct{}
+	once    sync.Once
+	buf     bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+		time.Sleep(300 * time.Millisecond)
+	})
+	return w.buf.Write(p)
+}
+
+func TestConsoleStreams_SlowWriter(t *testing.T) {
+	ctx := newTestContext(t)
+	w := &slowWriter{started: make(chan struct{})}
+	s := newConsoleStreams()
+	outFD, err := s.output(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The VMM's duplicate, open until the process exits.
+	vmm, err := syscall.Dup(outFD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(vmm)
+	s.start(ctx)
+
+	syscall.Write(vmm, []byte("first "))
+	<-w.started
+	syscall.Write(vmm, []byte("last"))
+	// The exit comes while the writer is still busy with the first write.
+	runExitHooks(ctx.id)
+	if got := w.buf.String(); got != "first last" {
+		t.Errorf("output = %q, want all of it", got)
+	}
+}
+
+func TestSetConsoleOutputWriter(t *testing.T) {
+	ctx := newTestContext(t)
+	var out bytes.Buffer
+	if err := ctx.SetConsoleOutputWriter(&out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddVirtioConsoleIO(t *testing.T) {
+	ctx := newTestContext(t)
+	var combined, serial bytes.Buffer
+	if err := ctx.AddVirtioConsoleIO(VirtioConsoleIOConfig{Stdout: &combined, Stderr: &combined}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.AddSerialConsoleIO(SerialConsoleIOConfig{Input: os.Stdin, Output: &serial}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := ctx.AddVirtioConsoleMultiport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.AddConsolePortIO(ConsolePortIOConfig{ConsoleID: id, Name: "data", Input: strings.NewReader("x")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddConsolePortSocket(t *testing.T) {
+	ctx := newTestContext(t)
+	id, err := ctx.AddVirtioConsoleMultiport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg := ConsolePortSocketConfig{
+		ConsoleID:    id,
+		Name:         "console",
+		Path:         filepath.Join(dir, "rw.sock"),
+		ReadOnlyPath: filepath.Join(dir, "ro.sock"),
+	}
+	mux, err := ctx.AddConsolePortSocket(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Write([]byte("login: "))
+	conn, err := net.Dial("unix", cfg.ReadOnlyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "login: " {
+		t.Errorf("scrollback = %q, %v", buf[:n], err)
+	}
+
+	runExitHooks(ctx.id)
+	for _, p := range []string{cfg.Path, cfg.ReadOnlyPath} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", p, err)
+		}
+	}
+}
+
+func TestAddConsoleChannel(t *testing.T) {
+	ctx := newTestContext(t)
+	ctx.DisableImplicitConsole()
+	rpc, err := ctx.AddConsoleChannel("rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Close()
+	logs, err := ctx.AddConsoleChannel("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logs.Close()
+	if _, err := ctx.AddConsoleChannel("rpc"); !errors.Is(err, ErrDeviceConflict) {
+		t.Errorf("duplicate name: %v, want ErrDeviceConflict", err)
+	}
+
+	devs, err := ctx.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var guest []string
+	for _, d := range devs {
+		guest = append(guest, d.Guest)
+	}
+	if want := []string{"/dev/virtio-ports/rpc", "/dev/virtio-ports/logs"}; !slices.Equal(guest, want) {
+		t.Errorf("devices = %v, want both ports on one device: %v", guest, want)
+	}
+	if _, ok := rpc.(*net.UnixConn); !ok {
+		t.Errorf("channel is a %T, want *net.UnixConn", rpc)
+	}
+}
+
+func TestSetConsoleLog(t *testing.T) {
+	ctx := newTestContext(t)
+	if tail := ctx.ConsoleTail(10); tail != nil {
+		t.Errorf("ConsoleTail without a log = %v", tail)
+	}
+	var report []console.Line
+	ctx.OnExit(func() { report = ctx.ConsoleTail(2) })
+	l, err := console.NewLog(console.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetConsoleLog(l); err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("one\ntwo\n[    1.000000] Kernel panic - not syncing"))
+
+	runExitHooks(ctx.id)
+	if len(report) != 2 || report[0].Text != "two" || report[1].Text != "[    1.000000] Kernel panic - not syncing" {
+		t.Errorf("ConsoleTail from OnExit = %v", report)
+	}
+	l.Write([]byte("x\n"))
+	if tail := ctx.ConsoleTail(1); len(tail) != 1 || tail[0].Text != "[    1.000000] Kernel panic - not syncing" {
+		t.Errorf("log not closed on exit: tail = %v", tail)
+	}
+	var bf *console.BootFailure
+	if err := ctx.BootFailure(); !errors.As(err, &bf) || bf.Kind != console.FailurePanic {
+		t.Errorf("BootFailure() = %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package krun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// AddConsoleChannel adds a generic I/O port called name to a multi-port
+// virtio-console device and returns the host end of a socket pair
+// connected to it, a byte stream between host and guest that needs no
+// network or vsock setup. The first call creates the device; later calls
+// add ports to it. The stream is a *net.UnixConn, so it supports
+// deadlines and CloseWrite.
+//
+// In the guest, the port is /dev/virtio-ports/name where udev runs, and
+// can always be found by name with the krun/console package's OpenPort.
+func (c *Context) AddConsoleChannel(name string) (io.ReadWriteCloser, error) {
+	if name == "" {
+		return nil, errors.New("krun: console channel needs a name")
+	}
+	var id *uint32
+	dup := false
+	c.withState(func(s *contextState) {
+		id = s.channelConsole
+		for _, con := range s.consoles {
+			for _, port := range con.ports {
+				dup = dup || port.name == name
+			}
+		}
+	})
+	if dup {
+		return nil, fmt.Errorf("%w: console port name %q used twice", ErrDeviceConflict, name)
+	}
+	if id == nil {
+		n, err := c.AddVirtioConsoleMultiport()
+		if err != nil {
+			return nil, err
+		}
+		id = &n
+		c.withState(func(s *contextState) { s.channelConsole = id })
+	}
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("krun: socketpair: %w", err)
+	}
+	vmEnd := os.NewFile(uintptr(fds[0]), "console channel "+name)
+	hostEnd := os.NewFile(uintptr(fds[1]), "console channel "+name)
+	defer hostEnd.Close()
+	conn, err := net.FileConn(hostEnd)
+	if err != nil {
+		vmEnd.Close()
+		return nil, fmt.Errorf("krun: %w", err)
+	}
+	fd := int(vmEnd.Fd())
+	if err := c.AddConsolePortInOut(ConsolePortInOutConfig{ConsoleID: *id, Name: name, InputFD: fd, OutputFD: fd}); err != nil {
+		vmEnd.Close()
+		conn.Close()
+		return nil, err
+	}
+	// The guest sees end of file once the VM is gone.
+	c.OnExit(func() { vmEnd.Close() })
+	return conn, nil
+}
@@ -0,0 +1,315 @@
+package krun
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// VirtioConsoleIOConfig configures a virtio-console device like
+// [VirtioConsoleConfig], with Go streams instead of file descriptors.
+// A nil Stdin reads as empty; nil Stdout or Stderr discard the output. As
+// with [os/exec.Cmd], if Stdout and Stderr are the same writer, at most one
+// goroutine at a time writes to it.
+type VirtioConsoleIOConfig struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// SerialConsoleIOConfig configures a legacy serial device like
+// [SerialConsoleConfig], with Go streams instead of file descriptors.
+type SerialConsoleIOConfig struct {
+	Input  io.Reader
+	Output io.Writer
+}
+
+// ConsolePortIOConfig configures a generic I/O port like
+// [ConsolePortInOutConfig], with Go streams instead of file descriptors.
+type ConsolePortIOConfig struct {
+	ConsoleID uint32
+	Name      string
+	Input     io.Reader
+	Output    io.Writer
+}
+
+// SetConsoleOutputWriter sends the implicit console's output to w, like
+// [Context.SetConsoleOutput] does to a file. Output still buffered when the
+// VM exits is copied before the [Context.OnExit] functions registered
+// earlier run.
+func (c *Context) SetConsoleOutputWriter(w io.Writer) error {
+	s := newConsoleStreams()
+	fd, err := s.output(w)
+	if err != nil {
+		return err
+	}
+	// The VMM opens the path when it starts; /dev/fd reopens the pipe.
+	if err := c.SetConsoleOutput(fmt.Sprintf("/dev/fd/%d", fd)); err != nil {
+		s.close()
+		return err
+	}
+	s.start(c)
+	return nil
+}
+
+// AddVirtioConsoleIO adds a virtio-console device fed from and draining to
+// Go streams. Like [os/exec.Cmd], *os.File values are passed to the VM
+// directly; other streams are connected through pipes, which are not TTYs,
+// so the guest gets separate ports for stdin, stdout and stderr.
+//
+// Output still buffered when the VM exits is copied before the
+// [Context.OnExit] functions registered earlier run.
+func (c *Context) AddVirtioConsoleIO(cfg VirtioConsoleIOConfig) error {
+	s := newConsoleStreams()
+	in, err := s.input(cfg.Stdin)
+	if err != nil {
+		return err
+	}
+	out, err := s.output(cfg.Stdout)
+	if err != nil {
+		s.close()
+		return err
+	}
+	errFD, err := s.output(cfg.Stderr)
+	if err != nil {
+		s.close()
+		return err
+	}
+	if err := c.AddVirtioConsoleDefault(VirtioConsoleConfig{InputFD: in, OutputFD: out, ErrFD: errFD}); err != nil {
+		s.close()
+		return err
+	}
+	s.start(c)
+	return nil
+}
+
+// AddSerialConsoleIO adds a legacy serial device fed from and draining to
+// Go streams, connected as for [Context.AddVirtioConsoleIO].
+func (c *Context) AddSerialConsoleIO(cfg SerialConsoleIOConfig) error {
+	s := newConsoleStreams()
+	in, err := s.input(cfg.Input)
+	if err != nil {
+		return err
+	}
+	out, err := s.output(cfg.Output)
+	if err != nil {
+		s.close()
+		return err
+	}
+	if err := c.AddSerialConsoleDefault(SerialConsoleConfig{InputFD: in, OutputFD: out}); err != nil {
+		s.close()
+		return err
+	}
+	s.start(c)
+	return nil
+}
+
+// AddConsolePortIO adds a generic I/O port to a multi-port virtio-console
+// device, fed from and draining to Go streams, connected as for
+// [Context.AddVirtioConsoleIO].
+func (c *Context) AddConsolePortIO(cfg ConsolePortIOConfig) error {
+	s := newConsoleStreams()
+	in, err := s.input(cfg.Input)
+	if err != nil {
+		return err
+	}
+	out, err := s.output(cfg.Output)
+	if err != nil {
+		s.close()
+		return err
+	}
+	if err := c.AddConsolePortInOut(ConsolePortInOutConfig{
+		ConsoleID: cfg.ConsoleID, Name: cfg.Name, InputFD: in, OutputFD: out,
+	}); err != nil {
+		s.close()
+		return err
+	}
+	s.start(c)
+	return nil
+}
+
+// copyOutput copies the VM's output from r to w until stopOutput is
+// called, then copies what is still buffered in r. The VMM keeps its
+// duplicates of the pipe ends open until the process is gone, so the
+// copier never sees EOF: it reads on until the pipe would block, which
+// once the VM has exited means all its output was read, however long
+// writing to w takes. r must be non-blocking.
+func copyOutput(w io.Writer, r *os.File) {
+	io.Copy(w, r) // ends at the deadline stopOutput sets
+	r.SetReadDeadline(time.Time{})
+	rc, err := r.SyscallConn()
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		var n int
+		var rerr error
+		err := rc.Read(func(fd uintptr) bool {
+			for {
+				n, rerr = unix.Read(int(fd), buf)
+				if rerr != unix.EINTR {
+					return true // never wait for more
+				}
+			}
+		})
+		if err != nil || rerr != nil || n <= 0 {
+			return // EAGAIN: drained
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// stopOutput makes copyOutput move on from copying to draining r.
+func stopOutput(r *os.File) {
+	r.SetReadDeadline(time.Now())
+}
+
+// consoleStreams connects Go streams to the file descriptors handed to a
+// console device, and stops copying when the VM exits.
+type consoleStreams struct {
+	vmEnds  []*os.File // passed to libkrun
+	inputs  []inputPipe
+	outputs []outputPipe
+	wg      sync.WaitGroup
+	shared  map[io.Writer]*lockedWriter
+}
+
+// lockedWriter serializes the copiers writing to one Writer.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+type inputPipe struct {
+	w *os.File // host end
+	r io.Reader
+}
+
+type outputPipe struct {
+	r *os.File // host end
+	w io.Writer
+}
+
+func newConsoleStreams() *consoleStreams {
+	return &consoleStreams{shared: make(map[io.Writer]*lockedWriter)}
+}
+
+// input returns the descriptor the VM reads r from.
+func (s *consoleStreams) input(r io.Reader) (int, error) {
+	if f, ok := r.(*os.File); ok {
+		return int(f.Fd()), nil
+	}
+	if r == nil {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			return -1, fmt.Errorf("krun: %w", err)
+		}
+		s.vmEnds = append(s.vmEnds, f)
+		return int(f.Fd()), nil
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return -1, fmt.Errorf("krun: %w", err)
+	}
+	s.vmEnds = append(s.vmEnds, pr)
+	s.inputs = append(s.inputs, inputPipe{pw, r})
+	return int(pr.Fd()), nil
+}
+
+// output returns the descriptor the VM writes w's data to.
+func (s *consoleStreams) output(w io.Writer) (int, error) {
+	if f, ok := w.(*os.File); ok {
+		return int(f.Fd()), nil
+	}
+	if w == nil {
+		f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return -1, fmt.Errorf("krun: %w", err)
+		}
+		s.vmEnds = append(s.vmEnds, f)
+		return int(f.Fd()), nil
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return -1, fmt.Errorf("krun: %w", err)
+	}
+	s.vmEnds = append(s.vmEnds, pw)
+	s.outputs = append(s.outputs, outputPipe{pr, s.lockShared(w)})
+	return int(pw.Fd()), nil
+}
+
+// lockShared returns w, wrapped so that the copiers of every output
+// passed w write to it one at a time.
+func (s *consoleStreams) lockShared(w io.Writer) io.Writer {
+	if !reflect.TypeOf(w).Comparable() {
+		return w
+	}
+	lw := s.shared[w]
+	if lw == nil {
+		lw = &lockedWriter{w: w}
+		s.shared[w] = lw
+	}
+	return lw
+}
+
+// start runs the copiers and stops them when c's VM exits.
+func (s *consoleStreams) start(c *Context) {
+	for _, p := range s.inputs {
+		// Ends when the Reader does, or at the first write after the VM
+		// is gone.
+		go func(p inputPipe) {
+			io.Copy(p.w, p.r)
+			p.w.Close()
+		}(p)
+	}
+	for _, p := range s.outputs {
+		s.wg.Add(1)
+		go func(p outputPipe) {
+			defer s.wg.Done()
+			copyOutput(p.w, p.r)
+		}(p)
+	}
+	c.OnExit(s.stop)
+}
+
+// stop closes the VM's ends, drains what the VM wrote and waits for the
+// output copiers.
+func (s *consoleStreams) stop() {
+	for _, f := range s.vmEnds {
+		f.Close()
+	}
+	for _, p := range s.outputs {
+		stopOutput(p.r)
+	}
+	s.wg.Wait()
+	for _, p := range s.outputs {
+		p.r.Close()
+	}
+}
+
+// close releases everything when the device could not be added.
+func (s *consoleStreams) close() {
+	for _, f := range s.vmEnds {
+		f.Close()
+	}
+	for _, p := range s.inputs {
+		p.w.Close()
+	}
+	for _, p := range s.outputs {
+		p.r.Close()
+	}
+}
@@ -0,0 +1,68 @@
+package krun
+
+import (
+	"sync"
+
+	"github.com/mishushakov/libkrun-go/krun/console"
+)
+
+// consoleLogs holds the logs set with SetConsoleLog. Unlike the rest of a
+// context's state they outlive StartEnter, for OnExit functions to read.
+var (
+	consoleLogMu sync.Mutex
+	consoleLogs  = make(map[uint32]*console.Log)
+)
+
+// SetConsoleLog sends the implicit console's output, which carries the
+// kernel log and the workload's output, to l, as
+// [Context.SetConsoleOutputWriter] does, and closes l once the output is
+// drained after the VM exits. The recent lines are then available from
+// [Context.ConsoleTail].
+func (c *Context) SetConsoleLog(l *console.Log) error {
+	// Registered first so it runs after the output is drained.
+	c.OnExit(func() { l.Close() })
+	if err := c.SetConsoleOutputWriter(l); err != nil {
+		return err
+	}
+	consoleLogMu.Lock()
+	consoleLogs[c.id] = l
+	consoleLogMu.Unlock()
+	return nil
+}
+
+// ConsoleTail returns up to the last n lines of the log set with
+// [Context.SetConsoleLog], or nil if there is none; n <= 0 returns all the
+// lines the log keeps. It is meant for crash reports from
+// [Context.OnExit] functions: those registered before SetConsoleLog run
+// once the output is drained, and see it up to the exit.
+func (c *Context) ConsoleTail(n int) []console.Line {
+	consoleLogMu.Lock()
+	l := consoleLogs[c.id]
+	consoleLogMu.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.Tail(n)
+}
+
+// forgetConsoleLog drops the log of context id once its exit functions
+// have run.
+func forgetConsoleLog(id uint32) {
+	consoleLogMu.Lock()
+	defer consoleLogMu.Unlock()
+	delete(consoleLogs, id)
+}
+
+// BootFailure looks for a kernel panic, a root filesystem mount failure, a
+// missing init, the OOM killer or an oops in the lines of the log set with
+// [Context.SetConsoleLog], and returns the first as a
+// *[console.BootFailure] with an excerpt of the log. Only kernel log lines
+// are searched, which needs printk timestamps (see [console.BootFailure]).
+// It returns nil if there is none or no log. Like [Context.ConsoleTail],
+// it is meant for [Context.OnExit] functions.
+func (c *Context) BootFailure() error {
+	if f := console.Analyze(c.ConsoleTail(0)); f != nil {
+		return f
+	}
+	return nil
+}
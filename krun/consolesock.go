@@ -0,0 +1,80 @@
+package krun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/mishushakov/libkrun-go/krun/console"
+)
+
+// ConsolePortSocketConfig configures a TTY port on a multi-port
+// virtio-console device that clients attach to over UNIX sockets.
+type ConsolePortSocketConfig struct {
+	ConsoleID uint32
+	Name      string
+	// Path is the socket clients attach to read-write. ReadOnlyPath, if
+	// set, is a second socket for read-only clients. Both are removed when
+	// the VM exits.
+	Path         string
+	ReadOnlyPath string
+	// Rows and Cols are the terminal size the guest sees. Zero means
+	// 24x80.
+	Rows, Cols uint16
+	Mux        console.MuxOptions
+}
+
+// AddConsolePortSocket adds a TTY port backed by a pseudo-terminal, as
+// [Context.AddConsolePortPTY] does, and serves it through a [console.Mux]
+// on UNIX sockets, so the console outlives any one client: clients attach
+// and detach while the VM runs, and see recent output when they attach.
+// The returned Mux can also be written to and read from directly.
+func (c *Context) AddConsolePortSocket(cfg ConsolePortSocketConfig) (*console.Mux, error) {
+	if cfg.Rows == 0 || cfg.Cols == 0 {
+		cfg.Rows, cfg.Cols = 24, 80
+	}
+	if cfg.Path == "" {
+		return nil, errors.New("krun: console socket path is empty")
+	}
+	paths := []string{cfg.Path}
+	if cfg.ReadOnlyPath != "" {
+		paths = append(paths, cfg.ReadOnlyPath)
+	}
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close() // removes the socket file
+		}
+	}
+	for _, path := range paths {
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("krun: %w", err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	mux := console.NewMux(cfg.Mux)
+	// Registered first so it runs after the port's output is drained.
+	c.OnExit(func() { mux.Close() })
+	p, err := c.AddConsolePortPTY(ConsolePortPTYConfig{ConsoleID: cfg.ConsoleID, Name: cfg.Name, Stdout: mux})
+	if err == nil {
+		if err = p.Resize(cfg.Rows, cfg.Cols); err != nil {
+			// libkrun holds the slave's fd number, so the slave stays open
+			// until the VM exits, or another file could take the number.
+			p.Master.Close()
+		}
+	}
+	if err != nil {
+		closeAll()
+		mux.Close()
+		return nil, err
+	}
+	go io.Copy(p.Master, mux)
+	for i, l := range listeners {
+		mux.Listen(l, i == 1)
+	}
+	return mux, nil
+}
@@ -35,6 +35,11 @@ const (
 	DiskFormatQcow2 DiskFormat = 1
 	// DiskFormatVmdk only supports FLAT/ZERO formats without delta links.
 	DiskFormatVmdk DiskFormat = 2
+	// DiskFormatAuto makes AddDisk detect the format with [DetectDiskFormat]
+	// and refuse images that fail DiskConfig.Policy. It is only accepted
+	// for read-only disks (see [ErrWritableAutoDisk]) and is never passed
+	// to libkrun.
+	DiskFormatAuto DiskFormat = 0xffffffff
 )
 
 // SyncMode controls VIRTIO_BLK_F_FLUSH behavior.
@@ -60,6 +65,10 @@ const (
 	KernelFormatImageBz2  KernelFormat = 3
 	KernelFormatImageGz   KernelFormat = 4
 	KernelFormatImageZstd KernelFormat = 5
+	// KernelFormatAuto makes SetKernel detect the format with
+	// [DetectKernelFormat] and refuse kernels built for another
+	// architecture. It is never passed to libkrun.
+	KernelFormatAuto KernelFormat = 0xffffffff
 )
 
 // Feature represents a compile-time feature flag for [HasFeature].
@@ -131,14 +140,20 @@ const MaxDisplays = 16
 // DiskConfig configures a disk image to attach to the microVM.
 //
 // Security note: Non-raw images can reference other files. Only use non-raw formats
-// with fully trusted images. See the libkrun documentation for details.
+// with fully trusted images, or use DiskFormatAuto so that the files an image
+// references are checked against Policy. Give writable disks an explicit
+// format: a guest can rewrite the header of a disk it writes, so detecting
+// their format would let it pick the format, and backing file, the host
+// opens next time. See the libkrun documentation for details.
 type DiskConfig struct {
 	BlockID  string
 	Path     string
 	Format   DiskFormat // 0 = DiskFormatRaw
 	ReadOnly bool
 	DirectIO bool
-	SyncMode SyncMode // 0 = SyncNone
+	SyncMode SyncMode   // 0 = SyncNone
+	Policy   DiskPolicy // checked with DiskFormatAuto only
+	NoLock   bool       // do not lock the image; see AddDisk
 }
 
 // VMConfig configures the basic VM parameters.
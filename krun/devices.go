@@ -0,0 +1,206 @@
+package krun
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// DeviceKind is the type of a device listed by [Context.Devices].
+type DeviceKind int
+
+const (
+	DeviceDisk DeviceKind = iota + 1
+	DeviceFS
+	DeviceConsole
+	DeviceConsolePort
+	DeviceSerial
+	DeviceNet
+	DeviceVsockPort
+	DeviceDisplay
+)
+
+func (k DeviceKind) String() string {
+	switch k {
+	case DeviceDisk:
+		return "disk"
+	case DeviceFS:
+		return "virtio-fs"
+	case DeviceConsole:
+		return "console"
+	case DeviceConsolePort:
+		return "console-port"
+	case DeviceSerial:
+		return "serial"
+	case DeviceNet:
+		return "net"
+	case DeviceVsockPort:
+		return "vsock-port"
+	case DeviceDisplay:
+		return "display"
+	}
+	return fmt.Sprintf("DeviceKind(%d)", int(k))
+}
+
+// Device is a device configured on a [Context], with the name the guest is
+// expected to see it under.
+type Device struct {
+	Kind DeviceKind
+	// ID identifies the device on the host side: the disk BlockID, the
+	// virtio-fs tag, the console port name, the vsock port or the display
+	// ID.
+	ID string
+	// Guest is the predicted guest-side name: "/dev/vda" (by position, not
+	// by BlockID), the virtio-fs tag
+	// to mount, "/dev/hvc0", "/dev/virtio-ports/<name>", "/dev/ttyS0",
+	// "eth0", "vsock port 1024" or the DRM connector "Virtual-1". It is
+	// empty for an unnamed console port that is not a terminal: its
+	// /dev/vportNpM node is numbered by the guest's index of the whole
+	// virtio device, which depends on devices libkrun adds on its own.
+	Guest string
+	// Aliases are other guest names of the device, such as the
+	// /dev/virtio-ports/<name> link of a named terminal port.
+	Aliases []string
+	// Host is the host-side resource: the disk image, shared directory,
+	// UNIX socket or TAP interface.
+	Host string
+}
+
+// ErrDeviceConflict is returned by [Context.Devices] when devices collide.
+var ErrDeviceConflict = errors.New("krun: conflicting devices")
+
+// consoleDevice is a virtio-console device as configured.
+type consoleDevice struct {
+	multiport bool
+	id        uint32 // multiport console ID
+	host      string
+	ports     []consolePort
+}
+
+type consolePort struct {
+	name string
+	tty  bool
+	host string
+}
+
+// Devices lists the devices configured on c in the order the guest is
+// expected to enumerate them, with their predicted guest-side names, and
+// reports collisions, such as duplicate BlockIDs, virtio-fs tags, console
+// port names or vsock ports, as an error wrapping [ErrDeviceConflict].
+// The devices are returned in either case.
+//
+// Names are predicted from the order of the calls that configured c:
+// disks become /dev/vda, /dev/vdb, ... in the order they were added,
+// which assumes libkrun creates its virtio-blk devices in the order of the
+// AddDisk calls; the BlockID does not pick the name. SetRootDiskRemount
+// adds no disk, so its Device names one by that position. Virtio-console
+// devices, starting with the implicit console unless it is
+// disabled, are numbered in order, each console port taking the next
+// /dev/hvcN. Devices libkrun adds on its own, such as the extra ports of a
+// default console whose file descriptors are not terminals, are not listed.
+func (c *Context) Devices() ([]Device, error) {
+	var devs []Device
+	var errs []error
+	c.withState(func(s *contextState) { devs, errs = s.devices() })
+	return devs, errors.Join(errs...)
+}
+
+func (s *contextState) devices() ([]Device, []error) {
+	var devs []Device
+	var errs []error
+	conflict := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{ErrDeviceConflict}, args...)...))
+	}
+
+	blockIDs := make(map[string]string)
+	writers := make(map[string]bool) // image path -> opened read-write
+	for i, d := range s.disks {
+		devs = append(devs, Device{Kind: DeviceDisk, ID: d.BlockID, Guest: "/dev/" + virtioBlkName(i), Host: d.Path})
+		if prev, ok := blockIDs[d.BlockID]; ok {
+			conflict("BlockID %q used by %s and %s", d.BlockID, prev, d.Path)
+		}
+		blockIDs[d.BlockID] = d.Path
+		if rw, ok := writers[d.Path]; ok && (rw || !d.ReadOnly) {
+			conflict("disk image %s attached twice, not read-only", d.Path)
+		}
+		writers[d.Path] = writers[d.Path] || !d.ReadOnly
+	}
+
+	tags := make(map[string]string)
+	fs := s.fs
+	if s.root != "" {
+		// SetRoot shares the root directory as virtio-fs tag "/dev/root".
+		fs = append([]VirtioFSConfig{{Tag: "/dev/root", Path: s.root}}, fs...)
+	}
+	for _, f := range fs {
+		devs = append(devs, Device{Kind: DeviceFS, ID: f.Tag, Guest: f.Tag, Host: f.Path})
+		if prev, ok := tags[f.Tag]; ok {
+			conflict("virtio-fs tag %q used by %s and %s", f.Tag, prev, f.Path)
+		}
+		tags[f.Tag] = f.Path
+	}
+
+	consoles := s.consoles
+	if !s.noImplicitConsole {
+		consoles = append([]consoleDevice{{host: "stdio"}}, consoles...)
+	}
+	hvc := 0
+	portNames := make(map[string]bool)
+	for _, con := range consoles {
+		if !con.multiport {
+			devs = append(devs, Device{Kind: DeviceConsole, Guest: fmt.Sprintf("/dev/hvc%d", hvc), Host: con.host})
+			hvc++
+			continue
+		}
+		for _, port := range con.ports {
+			dev := Device{Kind: DeviceConsolePort, ID: port.name, Host: port.host}
+			if port.name != "" {
+				dev.Guest = "/dev/virtio-ports/" + port.name
+				if portNames[port.name] {
+					conflict("console port name %q used twice", port.name)
+				}
+				portNames[port.name] = true
+			}
+			if port.tty {
+				if dev.Guest != "" {
+					dev.Aliases = []string{dev.Guest}
+				}
+				dev.Guest = fmt.Sprintf("/dev/hvc%d", hvc)
+				hvc++
+			}
+			devs = append(devs, dev)
+		}
+	}
+	for i, host := range s.serials {
+		devs = append(devs, Device{Kind: DeviceSerial, Guest: fmt.Sprintf("/dev/ttyS%d", i), Host: host})
+	}
+
+	for i, host := range s.nets {
+		devs = append(devs, Device{Kind: DeviceNet, Guest: fmt.Sprintf("eth%d", i), Host: host})
+	}
+
+	ports := make(map[uint32]bool)
+	for _, p := range s.vsockPorts {
+		id := strconv.FormatUint(uint64(p.Port), 10)
+		devs = append(devs, Device{Kind: DeviceVsockPort, ID: id, Guest: "vsock port " + id, Host: p.Path})
+		if ports[p.Port] {
+			conflict("vsock port %d mapped twice", p.Port)
+		}
+		ports[p.Port] = true
+	}
+
+	for _, id := range s.displays {
+		devs = append(devs, Device{Kind: DeviceDisplay, ID: strconv.FormatUint(uint64(id), 10), Guest: fmt.Sprintf("Virtual-%d", id+1)})
+	}
+	return devs, errs
+}
+
+// addConsolePort records a port added to the multiport console id.
+func (s *contextState) addConsolePort(id uint32, port consolePort) {
+	for i := len(s.consoles) - 1; i >= 0; i-- {
+		if con := &s.consoles[i]; con.multiport && con.id == id {
+			con.ports = append(con.ports, port)
+			return
+		}
+	}
+}
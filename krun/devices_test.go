@@ -0,0 +1,141 @@
+package krun
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDevices(t *testing.T) {
+	ctx := newTestContext(t)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(ctx.SetRoot("/srv/root"))
+	must(ctx.AddVirtioFS(VirtioFSConfig{Tag: "shared", Path: "/srv/shared"}))
+	must(ctx.AddVirtioConsoleDefault(VirtioConsoleConfig{InputFD: 0, OutputFD: 1, ErrFD: 2}))
+	id, err := ctx.AddVirtioConsoleMultiport()
+	must(err)
+	must(ctx.AddConsolePortTTY(ConsolePortTTYConfig{ConsoleID: id, Name: "tty", TTYFD: 5}))
+	must(ctx.AddConsolePortInOut(ConsolePortInOutConfig{ConsoleID: id, Name: "log", InputFD: -1, OutputFD: 6}))
+	must(ctx.AddConsolePortInOut(ConsolePortInOutConfig{ConsoleID: id, InputFD: 7, OutputFD: 7}))
+	must(ctx.AddVsockPort(VsockPortConfig{Port: 1024, Path: "/tmp/agent.sock"}))
+	_, err = ctx.AddDisplay(DisplayConfig{Width: 800, Height: 600})
+	must(err)
+
+	devs, err := ctx.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Device{
+		{Kind: DeviceFS, ID: "/dev/root", Guest: "/dev/root", Host: "/srv/root"},
+		{Kind: DeviceFS, ID: "shared", Guest: "shared", Host: "/srv/shared"},
+		{Kind: DeviceConsole, Guest: "/dev/hvc0", Host: "stdio"},
+		{Kind: DeviceConsole, Guest: "/dev/hvc1", Host: "fd 0,1,2"},
+		{Kind: DeviceConsolePort, ID: "tty", Guest: "/dev/hvc2", Aliases: []string{"/dev/virtio-ports/tty"}, Host: "fd 5"},
+		{Kind: DeviceConsolePort, ID: "log", Guest: "/dev/virtio-ports/log", Host: "fd -1,6"},
+		{Kind: DeviceConsolePort, Host: "fd 7,7"},
+		{Kind: DeviceVsockPort, ID: "1024", Guest: "vsock port 1024", Host: "/tmp/agent.sock"},
+		{Kind: DeviceDisplay, ID: "0", Guest: "Virtual-1"},
+	}
+	if !slices.EqualFunc(devs, want, deviceEqual) {
+		t.Errorf("Devices =\n%+v\nwant\n%+v", devs, want)
+	}
+
+	// Collisions are reported with the devices.
+	must(ctx.AddVirtioFS(VirtioFSConfig{Tag: "shared", Path: "/srv/other"}))
+	must(ctx.AddVsockPort(VsockPortConfig{Port: 1024, Path: "/tmp/other.sock"}))
+	devs, err = ctx.Devices()
+	if !errors.Is(err, ErrDeviceConflict) || !strings.Contains(err.Error(), `tag "shared"`) || !strings.Contains(err.Error(), "vsock port 1024") {
+		t.Errorf("err = %v", err)
+	}
+	if len(devs) != len(want)+2 {
+		t.Errorf("got %d devices, want %d", len(devs), len(want)+2)
+	}
+}
+
+func TestDevicesDisks(t *testing.T) {
+	s := &contextState{
+		noImplicitConsole: true,
+		disks: []DiskConfig{
+			{BlockID: "root", Path: "/img/root.qcow2"},
+			{BlockID: "data", Path: "/img/data.raw", ReadOnly: true},
+			{BlockID: "data2", Path: "/img/data.raw", ReadOnly: true},
+		},
+		serials: []string{"fd 0,1"},
+		nets:    []string{"/tmp/passt.sock"},
+	}
+	devs, errs := s.devices()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	want := []Device{
+		{Kind: DeviceDisk, ID: "root", Guest: "/dev/vda", Host: "/img/root.qcow2"},
+		{Kind: DeviceDisk, ID: "data", Guest: "/dev/vdb", Host: "/img/data.raw"},
+		{Kind: DeviceDisk, ID: "data2", Guest: "/dev/vdc", Host: "/img/data.raw"},
+		{Kind: DeviceSerial, Guest: "/dev/ttyS0", Host: "fd 0,1"},
+		{Kind: DeviceNet, Guest: "eth0", Host: "/tmp/passt.sock"},
+	}
+	if !slices.EqualFunc(devs, want, deviceEqual) {
+		t.Errorf("devices =\n%+v\nwant\n%+v", devs, want)
+	}
+
+	s.disks = append(s.disks, DiskConfig{BlockID: "root", Path: "/img/data.raw"})
+	_, errs = s.devices()
+	if len(errs) != 2 {
+		t.Errorf("errs = %v, want duplicate BlockID and shared writable image", errs)
+	}
+}
+
+func TestDevicesRootDiskRemount(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+	for _, name := range []string{"data", "root"} {
+		path := filepath.Join(dir, name+".raw")
+		if err := os.WriteFile(path, make([]byte, 1<<20), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err := ctx.AddDisk(DiskConfig{BlockID: name, Path: path, Format: DiskFormatRaw})
+		if errors.Is(err, syscall.ENOSYS) {
+			t.Skip("built without krun_blk")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "data" {
+			// The root is set up between the disks and named by the
+			// position its disk will have, not by BlockID.
+			if err := ctx.SetRootDiskRemount(RootDiskRemountConfig{Device: "/dev/vdb", FSType: "ext4"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	devs, err := ctx.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var disks []Device
+	for _, d := range devs {
+		if d.Kind == DeviceDisk {
+			disks = append(disks, d)
+		}
+	}
+	want := []Device{
+		{Kind: DeviceDisk, ID: "data", Guest: "/dev/vda", Host: filepath.Join(dir, "data.raw")},
+		{Kind: DeviceDisk, ID: "root", Guest: "/dev/vdb", Host: filepath.Join(dir, "root.raw")},
+	}
+	if !slices.EqualFunc(disks, want, deviceEqual) {
+		t.Errorf("disks =\n%+v\nwant\n%+v", disks, want)
+	}
+}
+
+func deviceEqual(a, b Device) bool {
+	return a.Kind == b.Kind && a.ID == b.ID && a.Guest == b.Guest && a.Host == b.Host && slices.Equal(a.Aliases, b.Aliases)
+}
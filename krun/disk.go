@@ -10,18 +10,42 @@ import "C"
 import "unsafe"
 
 // AddDisk adds a disk image as a partition for the microVM.
+// With DiskFormatAuto the format is detected first, and the image is refused
+// if it is unsupported or references files outside cfg.Policy.AllowedDirs.
+// DiskFormatAuto requires cfg.ReadOnly; see [ErrWritableAutoDisk].
+//
+// Unless cfg.NoLock is set, the image is locked until the VM exits: a
+// writable image exclusively, a read-only image and qcow2 backing files
+// shared, so two VMs cannot write to the same image. A conflicting lock
+// is reported as a [*DiskLockError].
 func (c *Context) AddDisk(cfg DiskConfig) error {
+	if err := cfg.resolveFormat(); err != nil {
+		return err
+	}
+	release := func() {}
+	if !cfg.NoLock {
+		var err error
+		if release, err = lockDisk(&cfg); err != nil {
+			return err
+		}
+	}
 	cBlockID := C.CString(cfg.BlockID)
 	defer C.free(unsafe.Pointer(cBlockID))
 	cDiskPath := C.CString(cfg.Path)
 	defer C.free(unsafe.Pointer(cDiskPath))
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_disk3(
 			C.uint32_t(c.id), cBlockID, cDiskPath,
 			C.uint32_t(cfg.Format), C.bool(cfg.ReadOnly), C.bool(cfg.DirectIO), C.uint32_t(cfg.SyncMode),
 		),
 		"krun_add_disk3",
-	)
+	); err != nil {
+		release()
+		return err
+	}
+	c.OnExit(release)
+	c.withState(func(s *contextState) { s.disks = append(s.disks, cfg) })
+	return nil
 }
 
 // SetRootDiskRemount configures a block device as the root filesystem.
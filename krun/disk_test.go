@@ -2,6 +2,7 @@ package krun
 
 import (
 	"errors"
+	"os"
 	"syscall"
 	"testing"
 )
@@ -52,3 +53,26 @@ func TestSetRootDiskRemount_Stub(t *testing.T) {
 		t.Fatalf("expected ENOSYS or EINVAL, got %v", err)
 	}
 }
+
+func TestAddScratchDisk(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+	path, err := ctx.AddScratchDisk(ScratchDiskConfig{BlockID: "scratch", Size: 1 << 30, Dir: dir, Partitioned: true})
+	if err != nil {
+		if !errors.Is(err, syscall.ENOSYS) {
+			t.Fatalf("expected ENOSYS, got %v", err)
+		}
+		// Without krun_blk the image is removed again.
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("scratch disk left behind: %v", entries)
+		}
+		return
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 1<<30 {
+		t.Fatalf("scratch disk: %v", err)
+	}
+	runExitHooks(ctx.id)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("scratch disk not deleted on exit")
+	}
+}
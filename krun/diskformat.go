@@ -0,0 +1,291 @@
+package krun
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mishushakov/libkrun-go/krun/qcow2"
+)
+
+// ErrUnsupportedDisk is returned by [DetectDiskFormat] for images libkrun
+// cannot open, such as sparse or delta VMDK images.
+var ErrUnsupportedDisk = errors.New("krun: unsupported disk image")
+
+// ErrWritableAutoDisk is returned when DiskFormatAuto is used for a disk
+// the guest can write. The guest could write an image header of another
+// format into a raw disk, and have the host open it in that format, with
+// a backing file of its choosing, the next time the VM boots.
+var ErrWritableAutoDisk = errors.New("krun: DiskFormatAuto needs a read-only disk")
+
+// ErrDiskPolicy is returned when an image references a file outside the
+// directories allowed by its [DiskPolicy].
+var ErrDiskPolicy = errors.New("krun: disk image violates policy")
+
+const (
+	maxDiskChain      = 16 // qemu's limit is similar
+	vmdkSparseMagic   = "KDMV"
+	vmdkDescriptor    = "# Disk DescriptorFile"
+	vmdkDescriptorMax = 64 << 10
+)
+
+// DiskImage describes a disk image inspected by [DetectDiskFormat].
+type DiskImage struct {
+	Path   string
+	Format DiskFormat
+	Size   int64 // virtual disk size in bytes
+
+	// Files lists every other file the image reads from, resolved against
+	// the directory of the file naming it: the qcow2 backing chain from
+	// the top down, or the extent files of a VMDK descriptor.
+	Files []string
+}
+
+// DiskPolicy restricts the files a disk image may reference.
+type DiskPolicy struct {
+	// AllowedDirs lists the directories, including their subdirectories,
+	// that backing files and VMDK extents may live in. Symlinks are
+	// resolved before checking. Empty means the image must not reference
+	// any other file.
+	AllowedDirs []string
+}
+
+// Check reports whether every file img references is allowed by p.
+func (p DiskPolicy) Check(img *DiskImage) error {
+	for _, file := range img.Files {
+		if !p.allows(file) {
+			return fmt.Errorf("%w: %s references %s outside the allowed directories", ErrDiskPolicy, img.Path, file)
+		}
+	}
+	return nil
+}
+
+func (p DiskPolicy) allows(file string) bool {
+	real, err := realPath(file)
+	if err != nil {
+		return false
+	}
+	for _, dir := range p.AllowedDirs {
+		d, err := realPath(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(d, real)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func realPath(path string) (string, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
+
+// DetectDiskFormat identifies the disk image at path as raw, qcow2 or VMDK
+// and follows the files it references: the qcow2 backing chain and the
+// extents of a VMDK descriptor. It fails with [ErrUnsupportedDisk] for
+// VMDK images other than FLAT/ZERO extents without delta links, which is
+// all libkrun supports, and for qcow2 images with external data files.
+//
+// Anything that is neither qcow2 nor VMDK is reported as raw.
+func DetectDiskFormat(path string) (*DiskImage, error) {
+	img := &DiskImage{Path: path}
+	format, size, err := inspectDisk(path, "", img, 0)
+	if err != nil {
+		return nil, err
+	}
+	img.Format, img.Size = format, size
+	return img, nil
+}
+
+// inspectDisk identifies the image at path, using format if the referring
+// image recorded one, and appends the files it references to img.Files.
+func inspectDisk(path, format string, img *DiskImage, depth int) (DiskFormat, int64, error) {
+	if depth > maxDiskChain {
+		return 0, 0, fmt.Errorf("%w: %s: backing chain too deep", ErrUnsupportedDisk, img.Path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("krun: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("krun: %w", err)
+	}
+	if format == "" {
+		if format, err = sniffDisk(f); err != nil {
+			return 0, 0, fmt.Errorf("krun: %s: %w", path, err)
+		}
+	}
+
+	switch format {
+	case "raw":
+		return DiskFormatRaw, fi.Size(), nil
+	case "qcow2":
+		h, err := qcow2.ReadHeader(f)
+		if err != nil {
+			return 0, 0, fmt.Errorf("krun: %s: %w", path, err)
+		}
+		if h.IncompatibleFeatures&qcow2.FeatureExternalData != 0 {
+			return 0, 0, fmt.Errorf("%w: %s: qcow2 external data file", ErrUnsupportedDisk, path)
+		}
+		if h.BackingFile != "" {
+			backing := qcow2.BackingPath(path, h.BackingFile)
+			img.Files = append(img.Files, backing)
+			if _, _, err := inspectDisk(backing, h.BackingFormat, img, depth+1); err != nil {
+				return 0, 0, err
+			}
+		}
+		return DiskFormatQcow2, h.Size, nil
+	case "vmdk":
+		size, err := inspectVMDK(f, path, fi.Size(), img)
+		return DiskFormatVmdk, size, err
+	default:
+		return 0, 0, fmt.Errorf("%w: %s: %s format", ErrUnsupportedDisk, path, format)
+	}
+}
+
+// sniffDisk returns "qcow2", "vmdk" or "raw" depending on the magic at the
+// start of f.
+func sniffDisk(f io.ReaderAt) (string, error) {
+	buf := make([]byte, len(vmdkDescriptor))
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	buf = buf[:n]
+	switch {
+	case bytes.HasPrefix(buf, qcow2.Magic):
+		return "qcow2", nil
+	case bytes.HasPrefix(buf, []byte(vmdkSparseMagic)), bytes.Equal(buf, []byte(vmdkDescriptor)):
+		return "vmdk", nil
+	}
+	return "raw", nil
+}
+
+// vmdkExtent matches an extent line: access, size in sectors, type, and
+// for file-backed extents the quoted file name and an optional offset.
+var vmdkExtent = regexp.MustCompile(`^(RW|RDONLY|NOACCESS)\s+(\d+)\s+(\w+)(?:\s+"([^"]*)"(?:\s+(\d+))?)?$`)
+
+// inspectVMDK parses the VMDK descriptor in f and returns the disk size.
+func inspectVMDK(f io.ReaderAt, path string, fileSize int64, img *DiskImage) (int64, error) {
+	magic := make([]byte, len(vmdkSparseMagic))
+	if _, err := f.ReadAt(magic, 0); err == nil && string(magic) == vmdkSparseMagic {
+		return 0, fmt.Errorf("%w: %s: sparse VMDK", ErrUnsupportedDisk, path)
+	}
+	if fileSize > vmdkDescriptorMax {
+		return 0, fmt.Errorf("%w: %s: VMDK descriptor too large", ErrUnsupportedDisk, path)
+	}
+	data := make([]byte, fileSize)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return 0, fmt.Errorf("krun: %s: %w", path, err)
+	}
+
+	var size int64
+	extents := 0
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			key = strings.TrimSpace(key)
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			switch strings.ToLower(key) {
+			case "parentcid":
+				if !strings.EqualFold(value, "ffffffff") {
+					return 0, fmt.Errorf("%w: %s: VMDK delta link", ErrUnsupportedDisk, path)
+				}
+			case "parentfilenamehint":
+				return 0, fmt.Errorf("%w: %s: VMDK delta link", ErrUnsupportedDisk, path)
+			}
+			continue
+		}
+
+		m := vmdkExtent.FindStringSubmatch(line)
+		if m == nil {
+			return 0, fmt.Errorf("%w: %s: malformed VMDK descriptor line %q", ErrUnsupportedDisk, path, line)
+		}
+		sectors, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s: extent size %q", ErrUnsupportedDisk, path, m[2])
+		}
+		switch m[3] {
+		case "FLAT":
+			if m[4] == "" {
+				return 0, fmt.Errorf("%w: %s: FLAT extent without a file", ErrUnsupportedDisk, path)
+			}
+			img.Files = append(img.Files, qcow2.BackingPath(path, m[4]))
+		case "ZERO":
+		default:
+			return 0, fmt.Errorf("%w: %s: VMDK %s extent", ErrUnsupportedDisk, path, m[3])
+		}
+		size += sectors * 512
+		extents++
+	}
+	if extents == 0 {
+		return 0, fmt.Errorf("%w: %s: VMDK descriptor has no extents", ErrUnsupportedDisk, path)
+	}
+	return size, nil
+}
+
+// resolveFormat replaces DiskFormatAuto in cfg with the detected format,
+// after checking the image against cfg.Policy. Only read-only disks are
+// detected; see [ErrWritableAutoDisk].
+func (cfg *DiskConfig) resolveFormat() error {
+	if cfg.Format != DiskFormatAuto {
+		return nil
+	}
+	if !cfg.ReadOnly {
+		return fmt.Errorf("%w: %s", ErrWritableAutoDisk, cfg.Path)
+	}
+	img, err := DetectDiskFormat(cfg.Path)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Policy.Check(img); err != nil {
+		return err
+	}
+	cfg.Format = img.Format
+	return nil
+}
+
+// image inspects the image cfg attaches. An explicit format is trusted
+// rather than detected, so a raw disk is read as raw whatever the guest
+// wrote at its start.
+func (cfg *DiskConfig) image() (*DiskImage, error) {
+	var format string
+	switch cfg.Format {
+	case DiskFormatAuto:
+		return DetectDiskFormat(cfg.Path)
+	case DiskFormatRaw:
+		format = "raw"
+	case DiskFormatQcow2:
+		format = "qcow2"
+	case DiskFormatVmdk:
+		format = "vmdk"
+	default:
+		return nil, fmt.Errorf("%w: %s: format %d", ErrUnsupportedDisk, cfg.Path, cfg.Format)
+	}
+	img := &DiskImage{Path: cfg.Path}
+	f, size, err := inspectDisk(cfg.Path, format, img, 0)
+	if err != nil {
+		return nil, err
+	}
+	img.Format, img.Size = f, size
+	return img, nil
+}
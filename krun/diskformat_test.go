@@ -0,0 +1,181 @@
+package krun
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+
+	"github.com/mishushakov/libkrun-go/krun/qcow2"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectDiskFormat_Raw(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	writeTestFile(t, path, string(make([]byte, 8192)))
+	img, err := DetectDiskFormat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Format != DiskFormatRaw || img.Size != 8192 || len(img.Files) != 0 {
+		t.Errorf("DetectDiskFormat = %+v", img)
+	}
+}
+
+func TestDetectDiskFormat_Qcow2Chain(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "images", "base.raw")
+	writeTestFile(t, base, string(make([]byte, 1<<20)))
+	mid := filepath.Join(dir, "images", "mid.qcow2")
+	if err := qcow2.CreateOverlay(mid, "base.raw"); err != nil {
+		t.Fatal(err)
+	}
+	top := filepath.Join(dir, "vms", "top.qcow2")
+	os.MkdirAll(filepath.Dir(top), 0755)
+	if err := qcow2.CreateOverlay(top, mid); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := DetectDiskFormat(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Format != DiskFormatQcow2 || img.Size != 1<<20 {
+		t.Errorf("format = %d, size = %d", img.Format, img.Size)
+	}
+	if want := []string{mid, base}; !slices.Equal(img.Files, want) {
+		t.Errorf("Files = %q, want %q", img.Files, want)
+	}
+
+	if err := (DiskPolicy{}).Check(img); !errors.Is(err, ErrDiskPolicy) {
+		t.Errorf("empty policy: Check = %v, want ErrDiskPolicy", err)
+	}
+	if err := (DiskPolicy{AllowedDirs: []string{filepath.Join(dir, "vms")}}).Check(img); !errors.Is(err, ErrDiskPolicy) {
+		t.Errorf("vms only: Check = %v, want ErrDiskPolicy", err)
+	}
+	if err := (DiskPolicy{AllowedDirs: []string{filepath.Join(dir, "images")}}).Check(img); err != nil {
+		t.Errorf("images allowed: Check = %v", err)
+	}
+}
+
+func TestDiskPolicy_Symlink(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret", "disk.raw")
+	writeTestFile(t, secret, "data")
+	link := filepath.Join(dir, "images", "base.raw")
+	os.MkdirAll(filepath.Dir(link), 0755)
+	if err := os.Symlink(secret, link); err != nil {
+		t.Fatal(err)
+	}
+	img := &DiskImage{Path: "top.qcow2", Files: []string{link}}
+	if err := (DiskPolicy{AllowedDirs: []string{filepath.Join(dir, "images")}}).Check(img); !errors.Is(err, ErrDiskPolicy) {
+		t.Errorf("Check = %v, want ErrDiskPolicy for a symlink leaving the allowed directory", err)
+	}
+}
+
+func TestDetectDiskFormat_VMDK(t *testing.T) {
+	const header = "# Disk DescriptorFile\nversion=1\nCID=12345678\nparentCID=ffffffff\ncreateType=\"monolithicFlat\"\n\n"
+	tests := []struct {
+		name    string
+		extents string
+		extra   string
+		size    int64
+		wantErr bool
+	}{
+		{name: "flat", extents: `RW 2048 FLAT "disk-flat.vmdk" 0` + "\n" + "RW 2048 ZERO\n", size: 4096 * 512},
+		{name: "sparse", extents: `RW 2048 SPARSE "disk-s001.vmdk"` + "\n", wantErr: true},
+		{name: "delta", extents: `RW 2048 FLAT "disk-flat.vmdk" 0` + "\n", extra: "parentFileNameHint=\"base.vmdk\"\n", wantErr: true},
+		{name: "no extents", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "disk.vmdk")
+			writeTestFile(t, path, header+tt.extra+"# Extent description\n"+tt.extents+"\nddb.adapterType = \"lsilogic\"\n")
+			img, err := DetectDiskFormat(path)
+			if tt.wantErr {
+				if !errors.Is(err, ErrUnsupportedDisk) {
+					t.Fatalf("DetectDiskFormat = %v, want ErrUnsupportedDisk", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Format != DiskFormatVmdk || img.Size != tt.size {
+				t.Errorf("format = %d, size = %d", img.Format, img.Size)
+			}
+			if want := []string{filepath.Join(dir, "disk-flat.vmdk")}; !slices.Equal(img.Files, want) {
+				t.Errorf("Files = %q, want %q", img.Files, want)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "sparse.vmdk")
+	writeTestFile(t, path, "KDMV\x01\x00\x00\x00")
+	if _, err := DetectDiskFormat(path); !errors.Is(err, ErrUnsupportedDisk) {
+		t.Errorf("hosted sparse: DetectDiskFormat = %v, want ErrUnsupportedDisk", err)
+	}
+}
+
+func TestAddDisk_AutoPolicy(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.raw")
+	writeTestFile(t, base, string(make([]byte, 1<<20)))
+	overlay := filepath.Join(dir, "vm.qcow2")
+	if err := qcow2.CreateOverlay(overlay, base); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestContext(t)
+	err := ctx.AddDisk(DiskConfig{BlockID: "vda", Path: overlay, Format: DiskFormatAuto, ReadOnly: true})
+	if !errors.Is(err, ErrDiskPolicy) && !errors.Is(err, syscall.ENOSYS) {
+		t.Errorf("AddDisk = %v, want ErrDiskPolicy", err)
+	}
+
+	cfg := DiskConfig{Path: overlay, Format: DiskFormatAuto, ReadOnly: true, Policy: DiskPolicy{AllowedDirs: []string{dir}}}
+	if err := cfg.resolveFormat(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Format != DiskFormatQcow2 {
+		t.Errorf("resolved format = %d, want DiskFormatQcow2", cfg.Format)
+	}
+}
+
+func TestDiskFormatAuto_Writable(t *testing.T) {
+	// A raw disk the guest has written a qcow2 header into.
+	dir := t.TempDir()
+	disk := filepath.Join(dir, "disk.raw")
+	if err := qcow2.CreateOverlay(disk, "/etc/shadow"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DiskConfig{Path: disk, Format: DiskFormatAuto, Policy: DiskPolicy{AllowedDirs: []string{"/"}}}
+	if err := cfg.resolveFormat(); !errors.Is(err, ErrWritableAutoDisk) {
+		t.Errorf("resolveFormat = %v, want ErrWritableAutoDisk", err)
+	}
+	if _, err := FindRootDisk([]DiskConfig{cfg}); !errors.Is(err, ErrWritableAutoDisk) {
+		t.Errorf("FindRootDisk = %v, want ErrWritableAutoDisk", err)
+	}
+
+	// Given as raw, it is read as raw, without looking at the header.
+	cfg.Format = DiskFormatRaw
+	img, err := cfg.image()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Format != DiskFormatRaw || len(img.Files) != 0 {
+		t.Errorf("image = %+v, want a raw image referencing nothing", img)
+	}
+}
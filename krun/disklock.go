@@ -0,0 +1,86 @@
+package krun
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrDiskLocked is wrapped by [DiskLockError].
+var ErrDiskLocked = errors.New("krun: disk image is locked")
+
+// DiskLockError is returned by AddDisk when another VM, in this or another
+// process, holds a conflicting lock on the image or one of its backing
+// files.
+type DiskLockError struct {
+	Path string
+	// PID is the process holding the lock, or 0 if it cannot be told
+	// (on macOS, or when the holder has exited since).
+	PID int
+	// Write is set when the lock was wanted for writing.
+	Write bool
+}
+
+func (e *DiskLockError) Error() string {
+	mode := "read"
+	if e.Write {
+		mode = "write"
+	}
+	if e.PID != 0 {
+		return fmt.Sprintf("krun: disk image %s is locked by process %d; cannot open it for %s", e.Path, e.PID, mode)
+	}
+	return fmt.Sprintf("krun: disk image %s is locked by another process; cannot open it for %s", e.Path, mode)
+}
+
+func (e *DiskLockError) Unwrap() error { return ErrDiskLocked }
+
+// lockDisk takes the locks cfg needs for the VM's lifetime, the way qemu
+// locks images: an exclusive lock on a writable image and on the extents
+// of a writable VMDK, shared locks on a read-only image and on qcow2
+// backing files. The locks are flock(2) locks on file descriptions of
+// their own, so two contexts in the same process conflict just like two
+// processes. The returned function releases them.
+func lockDisk(cfg *DiskConfig) (func(), error) {
+	files := []string{cfg.Path}
+	if cfg.Format != DiskFormatRaw {
+		// Images libkrun will refuse anyway are locked on their own.
+		if img, err := cfg.image(); err == nil {
+			files = append(files, img.Files...)
+		}
+	}
+
+	var held []*os.File
+	release := func() {
+		for _, f := range held {
+			f.Close() // closing the last descriptor drops the lock
+		}
+	}
+	for i, path := range files {
+		write := !cfg.ReadOnly && (i == 0 || cfg.Format == DiskFormatVmdk)
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // nothing to share; libkrun reports it
+		}
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("krun: %w", err)
+		}
+		how := unix.LOCK_SH
+		if write {
+			how = unix.LOCK_EX
+		}
+		if err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+			f.Close()
+			release()
+			if errors.Is(err, unix.EWOULDBLOCK) {
+				return nil, &DiskLockError{Path: path, PID: lockHolder(path), Write: write}
+			}
+			return nil, fmt.Errorf("krun: lock %s: %w", path, err)
+		}
+		held = append(held, f)
+	}
+	return release, nil
+}
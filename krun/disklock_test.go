@@ -0,0 +1,55 @@
+package krun
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/mishushakov/libkrun-go/krun/qcow2"
+)
+
+func TestLockDisk(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.raw")
+	writeTestFile(t, base, string(make([]byte, 1<<20)))
+
+	rw, err := lockDisk(&DiskConfig{Path: base, Format: DiskFormatRaw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lockDisk(&DiskConfig{Path: base, Format: DiskFormatRaw, ReadOnly: true})
+	var lockErr *DiskLockError
+	if !errors.As(err, &lockErr) || !errors.Is(err, ErrDiskLocked) || lockErr.Path != base || lockErr.Write {
+		t.Fatalf("err = %v, want DiskLockError", err)
+	}
+	if runtime.GOOS == "linux" && lockErr.PID != os.Getpid() {
+		t.Errorf("PID = %d, want %d", lockErr.PID, os.Getpid())
+	}
+	rw()
+
+	// Readers share the image, and so do overlays over it.
+	ro1, err := lockDisk(&DiskConfig{Path: base, Format: DiskFormatRaw, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro1()
+	overlay := filepath.Join(dir, "vm.qcow2")
+	if err := qcow2.CreateOverlay(overlay, base); err != nil {
+		t.Fatal(err)
+	}
+	top, err := lockDisk(&DiskConfig{Path: overlay, Format: DiskFormatQcow2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer top()
+
+	// Writing the base while an overlay reads it is refused.
+	if _, err := lockDisk(&DiskConfig{Path: base, Format: DiskFormatRaw}); !errors.As(err, &lockErr) || !lockErr.Write {
+		t.Errorf("err = %v, want DiskLockError", err)
+	}
+	if _, err := lockDisk(&DiskConfig{Path: overlay, Format: DiskFormatQcow2, ReadOnly: true}); !errors.Is(err, ErrDiskLocked) {
+		t.Errorf("err = %v, want ErrDiskLocked", err)
+	}
+}
@@ -3,6 +3,7 @@
 package krun
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -157,3 +158,36 @@ int main(void) {
 		t.Errorf("exit code = %d, want 42\noutput: %s", exitCode, stdout)
 	}
 }
+
+// TestE2ECommand runs a guest that writes to stdout and stderr and exits
+// 3 through Cmd, and verifies the streams stay apart.
+func TestE2ECommand(t *testing.T) {
+	skipIfNoKVM(t)
+
+	rootfs := t.TempDir()
+	buildStaticGuest(t, rootfs, "guest", `
+#include <unistd.h>
+int main(void) {
+    write(1, "to stdout\n", 10);
+    write(2, "to stderr\n", 10);
+    return 3;
+}
+`)
+
+	cmd := Command(CommandSpec{
+		Root: rootfs,
+		VM:   VMConfig{NumVCPUs: 1, RAMMiB: 256},
+		Exec: ExecConfig{Path: "/guest", Args: []string{"/guest"}, Env: []string{}},
+	})
+	out, err := cmd.Output()
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.Code != 3 {
+		t.Fatalf("err = %v, want exit status 3\nstdout: %s", err, out)
+	}
+	if !strings.Contains(string(out), "to stdout") || strings.Contains(string(out), "to stderr") {
+		t.Errorf("stdout = %q", out)
+	}
+	if !strings.Contains(string(ee.Stderr), "to stderr") || strings.Contains(string(ee.Stderr), "to stdout") {
+		t.Errorf("stderr = %q", ee.Stderr)
+	}
+}
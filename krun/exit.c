@@ -0,0 +1,10 @@
+#include <stdlib.h>
+#include "_cgo_export.h"
+
+static void krun_go_exit_hooks(void) {
+	krunRunExitHooks();
+}
+
+int krun_go_atexit(void) {
+	return atexit(krun_go_exit_hooks);
+}
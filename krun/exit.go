@@ -0,0 +1,56 @@
+package krun
+
+/*
+int krun_go_atexit(void);
+*/
+import "C"
+import "sync"
+
+var (
+	exitMu     sync.Mutex
+	exitHooks  = make(map[uint32][]func())
+	atexitOnce sync.Once
+)
+
+// OnExit registers fn to run once the microVM configured by c is done with
+// its resources: when the VMM exits the process after the VM shuts down,
+// when [Context.StartEnter] fails, or when the context is freed without
+// being started. Functions run in reverse order of registration.
+//
+// The VMM exits through the C library, so fn runs from an atexit handler
+// with the rest of the process still in place. A Go program that calls
+// os.Exit itself skips the handlers.
+func (c *Context) OnExit(fn func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	exitHooks[c.id] = append(exitHooks[c.id], fn)
+}
+
+// runExitHooks runs and forgets the hooks registered for context id.
+func runExitHooks(id uint32) {
+	exitMu.Lock()
+	hooks := exitHooks[id]
+	delete(exitHooks, id)
+	exitMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// registerAtexit makes the C library's exit run the pending hooks.
+func registerAtexit() {
+	atexitOnce.Do(func() { C.krun_go_atexit() })
+}
+
+//export krunRunExitHooks
+func krunRunExitHooks() {
+	exitMu.Lock()
+	ids := make([]uint32, 0, len(exitHooks))
+	for id := range exitHooks {
+		ids = append(ids, id)
+	}
+	exitMu.Unlock()
+	for _, id := range ids {
+		runExitHooks(id)
+	}
+}
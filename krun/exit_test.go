@@ -0,0 +1,37 @@
+package krun
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOnExit_Free(t *testing.T) {
+	ctx, err := CreateContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []int
+	ctx.OnExit(func() { order = append(order, 1) })
+	ctx.OnExit(func() { order = append(order, 2) })
+	ctx.Free()
+	if want := []int{2, 1}; !slices.Equal(order, want) {
+		t.Errorf("hooks ran in order %v, want %v", order, want)
+	}
+	ctx.Free()
+	if len(order) != 2 {
+		t.Errorf("hooks ran %d times, want once", len(order)/2)
+	}
+}
+
+func TestOnExit_AtExit(t *testing.T) {
+	ctx, err := CreateContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := false
+	ctx.OnExit(func() { ran = true })
+	krunRunExitHooks()
+	if !ran {
+		t.Error("exit handler did not run the hook")
+	}
+}
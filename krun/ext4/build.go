@@ -0,0 +1,340 @@
+package ext4
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mishushakov/libkrun-go/krun/partition"
+)
+
+// layout fixes the geometry for a filesystem of the given number of blocks
+// and allocates blocks for the journal and every inode.
+func (b *builder) layout(blocks uint64) error {
+	g, err := newGeometry(blocks, b.minInodes())
+	if err != nil {
+		return err
+	}
+	b.geo = g
+	b.alloc.init(g)
+	rand.Read(b.hashSeed[:])
+
+	if jb := journalBlocks(g.blocks, b.opts.NoJournal); jb > 0 {
+		j := &node{ino: journalIno, mode: modeRegular | 0600, links: 1, size: int64(jb * blockSize)}
+		if err := b.allocData(j, jb); err != nil {
+			return err
+		}
+		b.journal = j
+		b.setNode(j)
+	}
+
+	xblocks := make(map[string]*xattrBlock)
+	for _, n := range b.nodes {
+		if n == nil || n == b.journal {
+			continue
+		}
+		switch n.mode & modeTypeMask {
+		case modeDir:
+			n.dirData = b.encodeDir(n)
+			if err := b.allocData(n, uint64(len(n.dirData)/blockSize)); err != nil {
+				return err
+			}
+			n.size = int64(len(n.dirData))
+		case modeRegular:
+			if err := b.allocData(n, uint64((n.size+blockSize-1)/blockSize)); err != nil {
+				return err
+			}
+		case modeSymlink:
+			if len(n.target) >= fastSymlinkSz {
+				if err := b.allocData(n, 1); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(n.xattrs) > 0 {
+			key := xattrKey(n.xattrs)
+			xb := xblocks[key]
+			if xb == nil {
+				data, err := encodeXattrBlock(n.xattrs)
+				if err != nil {
+					return fmt.Errorf("ext4: inode %d: %w", n.ino, err)
+				}
+				blk, err := b.alloc.allocOne()
+				if err != nil {
+					return err
+				}
+				xb = &xattrBlock{data: data, block: blk}
+				xblocks[key] = xb
+				b.xblocks = append(b.xblocks, xb)
+			}
+			xb.refs++
+			n.xblock = xb
+		}
+	}
+	return nil
+}
+
+// allocData allocates count data blocks for n, plus extent leaf blocks if
+// the extents do not fit in the inode.
+func (b *builder) allocData(n *node, count uint64) error {
+	if count == 0 {
+		return nil
+	}
+	extents, err := b.alloc.alloc(count)
+	if err != nil {
+		return err
+	}
+	n.extents = extents
+	if len(extents) <= inodeExtents {
+		return nil
+	}
+	leaves := (len(extents) + leafExtents - 1) / leafExtents
+	if leaves > inodeExtents {
+		return fmt.Errorf("ext4: inode %d is too fragmented", n.ino)
+	}
+	for range leaves {
+		blk, err := b.alloc.allocOne()
+		if err != nil {
+			return err
+		}
+		n.leaves = append(n.leaves, blk)
+	}
+	return nil
+}
+
+func (b *builder) freeBlocksInGroup(i uint32) uint32 {
+	g := b.geo
+	return g.groupBlocks(i) - g.overhead(i) - b.alloc.usedInGroup(i)
+}
+
+// inodeUsed reports whether inode number ino is in use. The reserved
+// inodes 1-10 are always considered used.
+func (b *builder) inodeUsed(ino uint32) bool {
+	return ino < lostFoundIno || (ino <= uint32(len(b.nodes)) && b.nodes[ino-1] != nil)
+}
+
+func (b *builder) freeInodesInGroup(i uint32) uint32 {
+	var used uint32
+	first := i*b.geo.inodesPerGroup + 1
+	for ino := first; ino < first+b.geo.inodesPerGroup; ino++ {
+		if b.inodeUsed(ino) {
+			used++
+		}
+	}
+	return b.geo.inodesPerGroup - used
+}
+
+func (b *builder) dirsInGroup(i uint32) uint32 {
+	var dirs uint32
+	first := i*b.geo.inodesPerGroup + 1
+	for ino := first; ino < first+b.geo.inodesPerGroup && ino <= uint32(len(b.nodes)); ino++ {
+		if n := b.nodes[ino-1]; n != nil && n.mode&modeTypeMask == modeDir {
+			dirs++
+		}
+	}
+	return dirs
+}
+
+// write writes the image to f: the partition table if requested, then the
+// filesystem metadata and contents at fsOffset.
+func (b *builder) write(f *os.File, imageSize, fsOffset, fsSize int64) error {
+	if err := f.Truncate(imageSize); err != nil {
+		return fmt.Errorf("ext4: %w", err)
+	}
+	if b.opts.Partitioned {
+		err := partition.WriteGPT(f, imageSize, partition.Table{
+			Partitions: []partition.Partition{{
+				Type:  partition.TypeLinuxFilesystem,
+				Name:  b.opts.Label,
+				Start: fsOffset,
+				Size:  fsSize,
+			}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w := &blockWriter{f: f, off: fsOffset}
+	if err := b.writeMetadata(w); err != nil {
+		return err
+	}
+	if err := b.writeContents(w); err != nil {
+		return err
+	}
+	return w.err
+}
+
+// blockWriter writes filesystem blocks at an offset within the image and
+// remembers the first error.
+type blockWriter struct {
+	f   *os.File
+	off int64
+	err error
+}
+
+func (w *blockWriter) writeAt(p []byte, block uint32, within int64) {
+	if w.err != nil {
+		return
+	}
+	if _, err := w.f.WriteAt(p, w.off+int64(block)*blockSize+within); err != nil {
+		w.err = fmt.Errorf("ext4: %w", err)
+	}
+}
+
+func (b *builder) writeMetadata(w *blockWriter) error {
+	g := b.geo
+
+	var freeBlocks uint64
+	var freeInodes uint32
+	for i := range g.groups {
+		freeBlocks += uint64(b.freeBlocksInGroup(i))
+		freeInodes += b.freeInodesInGroup(i)
+	}
+	gdt := b.encodeGroupDescriptors()
+
+	for i := range g.groups {
+		if hasSuper(i) {
+			sb := b.encodeSuperblock(i, freeBlocks, freeInodes)
+			if i == 0 {
+				w.writeAt(sb, 0, 1024)
+			} else {
+				w.writeAt(sb, g.groupStart(i), 0)
+			}
+			w.writeAt(gdt, g.groupStart(i)+1, 0)
+		}
+
+		// Block bitmap: metadata and allocated data are contiguous from the
+		// start of the group; bits past the end of the filesystem are set.
+		bitmap := make([]byte, blockSize)
+		used := g.overhead(i) + b.alloc.usedInGroup(i)
+		setBits(bitmap, 0, used)
+		setBits(bitmap, g.groupBlocks(i), blocksPerGroup)
+		w.writeAt(bitmap, g.blockBitmap(i), 0)
+
+		// Inode bitmap and table.
+		bitmap = make([]byte, blockSize)
+		table := make([]byte, g.itableBlocks*blockSize)
+		first := i*g.inodesPerGroup + 1
+		for j := range g.inodesPerGroup {
+			ino := first + j
+			if !b.inodeUsed(ino) {
+				continue
+			}
+			setBits(bitmap, j, j+1)
+			if ino <= uint32(len(b.nodes)) && b.nodes[ino-1] != nil {
+				b.encodeInode(b.nodes[ino-1], table[j*inodeSize:(j+1)*inodeSize])
+			}
+		}
+		setBits(bitmap, g.inodesPerGroup, 8*blockSize)
+		w.writeAt(bitmap, g.inodeBitmap(i), 0)
+		// Mostly empty: the zero blocks are left as holes.
+		writeNonZero(w, table, g.inodeTable(i))
+	}
+	return w.err
+}
+
+func setBits(bitmap []byte, from, to uint32) {
+	for i := from; i < to; i++ {
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+}
+
+func (b *builder) writeContents(w *blockWriter) error {
+	if b.journal != nil {
+		w.writeAt(b.encodeJournalSuperblock(), b.journal.extents[0].start, 0)
+	}
+	for _, xb := range b.xblocks {
+		le.PutUint32(xb.data[4:], xb.refs)
+		w.writeAt(xb.data, xb.block, 0)
+	}
+	for _, n := range b.nodes {
+		if n == nil {
+			continue
+		}
+		for i, leaf := range n.leaves {
+			end := min((i+1)*leafExtents, len(n.extents))
+			w.writeAt(encodeExtentLeaf(n.extents[i*leafExtents:end]), leaf, 0)
+		}
+		switch n.mode & modeTypeMask {
+		case modeDir:
+			b.writeExtents(w, n, n.dirData)
+		case modeSymlink:
+			if len(n.extents) > 0 {
+				w.writeAt([]byte(n.target), n.extents[0].start, 0)
+			}
+		case modeRegular:
+			if n.src != "" {
+				if err := b.copyFile(w, n); err != nil {
+					return err
+				}
+			}
+		}
+		if w.err != nil {
+			return w.err
+		}
+	}
+	return nil
+}
+
+// writeExtents writes data (a whole number of blocks) to the extents of n.
+func (b *builder) writeExtents(w *blockWriter, n *node, data []byte) {
+	for _, e := range n.extents {
+		start := int(e.logical) * blockSize
+		w.writeAt(data[start:start+int(e.length)*blockSize], e.start, 0)
+	}
+}
+
+// copyFile copies the contents of a regular file into its extents. Blocks
+// that are entirely zero are skipped so the image stays sparse on the host.
+func (b *builder) copyFile(w *blockWriter, n *node) error {
+	src, err := os.Open(n.src)
+	if err != nil {
+		return fmt.Errorf("ext4: %w", err)
+	}
+	defer src.Close()
+
+	const chunk = 256 // blocks
+	buf := make([]byte, chunk*blockSize)
+	for _, e := range n.extents {
+		for done := uint32(0); done < e.length; {
+			count := min(e.length-done, chunk)
+			p := buf[:count*blockSize]
+			off := int64(e.logical+done) * blockSize
+			nr, err := src.ReadAt(p, off)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("ext4: %w", err)
+			}
+			clear(p[nr:])
+			writeNonZero(w, p, e.start+done)
+			done += count
+		}
+	}
+	return w.err
+}
+
+// writeNonZero writes the non-zero blocks of p starting at block.
+func writeNonZero(w *blockWriter, p []byte, block uint32) {
+	start := -1
+	for i := 0; i <= len(p)/blockSize; i++ {
+		zero := i == len(p)/blockSize || isZero(p[i*blockSize:(i+1)*blockSize])
+		switch {
+		case !zero && start < 0:
+			start = i
+		case zero && start >= 0:
+			w.writeAt(p[start*blockSize:i*blockSize], block+uint32(start), 0)
+			start = -1
+		}
+	}
+}
+
+func isZero(p []byte) bool {
+	for _, c := range p {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
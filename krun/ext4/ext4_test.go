@@ -0,0 +1,245 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func newTestTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"etc/hostname":    "vm\n",
+		"bin/tool":        strings.Repeat("x", 3*blockSize+17),
+		"empty":           "",
+		"usr/share/a.txt": "a",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "bin/tool"), os.ModeSetuid|0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../etc/hostname", filepath.Join(dir, "bin/short")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/"+strings.Repeat("long/", 20), filepath.Join(dir, "bin/long")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "bin/tool"), filepath.Join(dir, "bin/tool2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readSuperblock(t *testing.T, img string, off int64) []byte {
+	t.Helper()
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sb := make([]byte, 1024)
+	if _, err := f.ReadAt(sb, off+1024); err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.LittleEndian.Uint16(sb[56:]); magic != 0xef53 {
+		t.Fatalf("superblock magic = %#x, want 0xef53", magic)
+	}
+	return sb
+}
+
+// fsck runs e2fsck on the image if it is installed.
+func fsck(t *testing.T, img string) {
+	t.Helper()
+	path, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Log("e2fsck not found, skipping consistency check")
+		return
+	}
+	out, err := exec.Command(path, "-fn", img).CombinedOutput()
+	if err != nil {
+		t.Fatalf("e2fsck: %v\n%s", err, out)
+	}
+}
+
+// debugfs runs a debugfs request against the image, skipping the test if
+// debugfs is not installed.
+func debugfs(t *testing.T, img, request string) string {
+	t.Helper()
+	path, err := exec.LookPath("debugfs")
+	if err != nil {
+		t.Skip("debugfs not found")
+	}
+	out, err := exec.Command(path, "-R", request, img).Output()
+	if err != nil {
+		t.Fatalf("debugfs %q: %v", request, err)
+	}
+	return string(out)
+}
+
+func TestBuild(t *testing.T) {
+	src := newTestTree(t)
+	if err := unix.Lsetxattr(filepath.Join(src, "etc/hostname"), "user.krun", []byte("test"), 0); err != nil {
+		t.Logf("user xattrs unsupported on this filesystem: %v", err)
+	}
+	img := filepath.Join(t.TempDir(), "root.img")
+	err := Build(img, src, Options{
+		Label: "root",
+		Owner: func(path string, uid, gid uint32) (uint32, uint32) {
+			if path == "/etc/hostname" {
+				return 1000, 1001
+			}
+			return 0, 0
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb := readSuperblock(t, img, 0)
+	if label := strings.TrimRight(string(sb[120:136]), "\x00"); label != "root" {
+		t.Errorf("label = %q, want %q", label, "root")
+	}
+	if binary.LittleEndian.Uint32(sb[92:])&compatHasJournal == 0 {
+		t.Error("journal missing")
+	}
+	fsck(t, img)
+
+	stat := debugfs(t, img, "stat /etc/hostname")
+	if !strings.Contains(stat, "User:  1000") || !strings.Contains(stat, "Group:  1001") {
+		t.Errorf("owner not mapped:\n%s", stat)
+	}
+	if _, err := unix.Lgetxattr(filepath.Join(src, "etc/hostname"), "user.krun", nil); err == nil &&
+		!strings.Contains(stat, `user.krun (4) = "test"`) {
+		t.Errorf("xattr missing:\n%s", stat)
+	}
+	if stat := debugfs(t, img, "stat /bin/tool"); !strings.Contains(stat, "Mode:  04755") ||
+		!strings.Contains(stat, "Links: 2") {
+		t.Errorf("unexpected mode or link count:\n%s", stat)
+	}
+	if out := debugfs(t, img, "cat /bin/tool"); out != strings.Repeat("x", 3*blockSize+17) {
+		t.Errorf("file contents differ (%d bytes)", len(out))
+	}
+	if stat := debugfs(t, img, "stat /bin/short"); !strings.Contains(stat, `Fast link dest: "../etc/hostname"`) {
+		t.Errorf("fast symlink target missing:\n%s", stat)
+	}
+	if out := debugfs(t, img, "cat /bin/long"); out != "/"+strings.Repeat("long/", 20) {
+		t.Errorf("slow symlink target = %q", out)
+	}
+	if stat := debugfs(t, img, "stat /fifo"); !strings.Contains(stat, "Type: FIFO") {
+		t.Errorf("fifo type lost:\n%s", stat)
+	}
+}
+
+func TestBuildDeviceNodes(t *testing.T) {
+	src := t.TempDir()
+	if err := unix.Mknod(filepath.Join(src, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+		t.Skipf("cannot create device nodes: %v", err)
+	}
+	if err := unix.Mknod(filepath.Join(src, "big"), unix.S_IFBLK|0600, int(unix.Mkdev(300, 70000))); err != nil {
+		t.Fatal(err)
+	}
+	img := filepath.Join(t.TempDir(), "dev.img")
+	if err := Build(img, src, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, img)
+	if stat := debugfs(t, img, "stat /null"); !strings.Contains(stat, "Device major/minor number: 01:03") {
+		t.Errorf("char device lost:\n%s", stat)
+	}
+	if stat := debugfs(t, img, "stat /big"); !strings.Contains(stat, "Device major/minor number: 300:70000") {
+		t.Errorf("block device lost:\n%s", stat)
+	}
+}
+
+func TestBuildPartitioned(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "disk.img")
+	if err := Build(img, newTestTree(t), Options{Partitioned: true, Size: 64 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 64<<20 {
+		t.Errorf("image size = %d, want %d", fi.Size(), 64<<20)
+	}
+
+	hdr := make([]byte, 8)
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(hdr, 512); err != nil {
+		t.Fatal(err)
+	}
+	if string(hdr) != "EFI PART" {
+		t.Errorf("GPT header signature = %q", hdr)
+	}
+	readSuperblock(t, img, 1<<20)
+}
+
+func TestBuildEmpty(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "empty.img")
+	if err := Build(img, "", Options{Size: 16 << 20, NoJournal: true}); err != nil {
+		t.Fatal(err)
+	}
+	sb := readSuperblock(t, img, 0)
+	if binary.LittleEndian.Uint32(sb[92:])&compatHasJournal != 0 {
+		t.Error("journal present with NoJournal")
+	}
+	fsck(t, img)
+	if ls := debugfs(t, img, "ls /"); !strings.Contains(ls, "lost+found") {
+		t.Errorf("lost+found missing:\n%s", ls)
+	}
+}
+
+func TestBuildSparse(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "big.img")
+	if err := Build(img, "", Options{Size: 8 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(img, &st); err != nil {
+		t.Fatal(err)
+	}
+	// Bitmaps and a few inodes, not 512 MiB of empty inode tables.
+	if n := st.Blocks * 512; n > 8<<20 {
+		t.Errorf("8 GiB image allocates %d bytes", n)
+	}
+	fsck(t, img)
+}
+
+func TestBuildNoSpace(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "big"), make([]byte, 4<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img := filepath.Join(t.TempDir(), "small.img")
+	err := Build(img, src, Options{Size: 2 << 20})
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("Build = %v, want ErrNoSpace", err)
+	}
+	if _, err := os.Stat(img); !os.IsNotExist(err) {
+		t.Error("partial image not removed")
+	}
+}
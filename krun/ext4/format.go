@@ -0,0 +1,325 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var le = binary.LittleEndian
+
+// Feature flags written to the superblock.
+const (
+	compatHasJournal = 0x0004
+	compatExtAttr    = 0x0008
+
+	incompatFiletype = 0x0002
+	incompatExtents  = 0x0040
+
+	roCompatSparseSuper = 0x0001
+	roCompatLargeFile   = 0x0002
+	roCompatDirNlink    = 0x0020
+	roCompatExtraIsize  = 0x0040
+
+	defMountUserXattr = 0x0004
+	defMountACL       = 0x0008
+
+	flagSignedHash = 0x0001
+
+	inodeFlagExtents = 0x00080000
+
+	extentMagic  = 0xf30a
+	xattrMagic   = 0xea020000
+	journalMagic = 0xc03b3998
+)
+
+// extraIsize is the size of the inode fields beyond the original 128 bytes
+// that this package fills in (up to and including i_projid).
+const extraIsize = 32
+
+func (b *builder) encodeSuperblock(group uint32, freeBlocks uint64, freeInodes uint32) []byte {
+	g := b.geo
+	now := uint32(time.Now().Unix())
+	sb := make([]byte, 1024)
+	le.PutUint32(sb[0:], g.inodes())
+	le.PutUint32(sb[4:], g.blocks)
+	le.PutUint32(sb[12:], uint32(freeBlocks))
+	le.PutUint32(sb[16:], freeInodes)
+	le.PutUint32(sb[20:], 0) // s_first_data_block
+	le.PutUint32(sb[24:], logBlockSize)
+	le.PutUint32(sb[28:], logBlockSize)
+	le.PutUint32(sb[32:], blocksPerGroup)
+	le.PutUint32(sb[36:], blocksPerGroup)
+	le.PutUint32(sb[40:], g.inodesPerGroup)
+	le.PutUint32(sb[48:], now)    // s_wtime
+	le.PutUint16(sb[54:], 0xffff) // s_max_mnt_count = -1
+	le.PutUint16(sb[56:], 0xef53)
+	le.PutUint16(sb[58:], 1) // s_state = clean
+	le.PutUint16(sb[60:], 1) // s_errors = continue
+	le.PutUint32(sb[64:], now)
+	le.PutUint32(sb[76:], 1) // s_rev_level = dynamic
+	le.PutUint32(sb[84:], lostFoundIno)
+	le.PutUint16(sb[88:], inodeSize)
+	le.PutUint16(sb[90:], uint16(group))
+
+	compat := uint32(compatExtAttr)
+	if b.journal != nil {
+		compat |= compatHasJournal
+	}
+	le.PutUint32(sb[92:], compat)
+	le.PutUint32(sb[96:], incompatFiletype|incompatExtents)
+	le.PutUint32(sb[100:], roCompatSparseSuper|roCompatLargeFile|roCompatDirNlink|roCompatExtraIsize)
+	copy(sb[104:120], b.opts.UUID[:])
+	copy(sb[120:136], b.opts.Label)
+
+	if j := b.journal; j != nil {
+		le.PutUint32(sb[224:], journalIno)
+		// s_jnl_blocks: backup of the journal inode's i_block and size.
+		copy(sb[268:], encodeExtentRoot(j.extents, j.leaves))
+		le.PutUint32(sb[268+15*4:], uint32(uint64(j.size)>>32))
+		le.PutUint32(sb[268+16*4:], uint32(j.size))
+		sb[253] = 1 // s_jnl_backup_type = EXT3_JNL_BACKUP_BLOCKS
+	}
+	copy(sb[236:252], b.hashSeed[:])
+	sb[252] = 1 // s_def_hash_version = half_md4
+	le.PutUint32(sb[256:], defMountUserXattr|defMountACL)
+	le.PutUint32(sb[264:], now) // s_mkfs_time
+	le.PutUint16(sb[348:], extraIsize)
+	le.PutUint16(sb[350:], extraIsize)
+	le.PutUint32(sb[352:], flagSignedHash)
+	return sb
+}
+
+func (b *builder) encodeGroupDescriptors() []byte {
+	g := b.geo
+	gdt := make([]byte, g.gdtBlocks*blockSize)
+	for i := range g.groups {
+		d := gdt[i*descSize:]
+		le.PutUint32(d[0:], g.blockBitmap(i))
+		le.PutUint32(d[4:], g.inodeBitmap(i))
+		le.PutUint32(d[8:], g.inodeTable(i))
+		le.PutUint16(d[12:], uint16(b.freeBlocksInGroup(i)))
+		le.PutUint16(d[14:], uint16(b.freeInodesInGroup(i)))
+		le.PutUint16(d[16:], uint16(b.dirsInGroup(i)))
+	}
+	return gdt
+}
+
+// encodeTime returns the 32-bit seconds and the extra field (epoch bits
+// and nanoseconds) of an inode timestamp.
+func encodeTime(t timespec) (uint32, uint32) {
+	epoch := uint32((t.sec-int64(int32(t.sec)))>>32) & 3
+	return uint32(t.sec), epoch | uint32(t.nsec)<<2
+}
+
+func (b *builder) encodeInode(n *node, buf []byte) {
+	le.PutUint16(buf[0:], n.mode)
+	le.PutUint16(buf[2:], uint16(n.uid))
+	le.PutUint32(buf[4:], uint32(n.size))
+	le.PutUint32(buf[108:], uint32(uint64(n.size)>>32))
+	le.PutUint16(buf[24:], uint16(n.gid))
+	le.PutUint16(buf[26:], uint16(n.links))
+	le.PutUint16(buf[120:], uint16(n.uid>>16))
+	le.PutUint16(buf[122:], uint16(n.gid>>16))
+
+	sec, extra := encodeTime(n.atime)
+	le.PutUint32(buf[8:], sec)
+	le.PutUint32(buf[140:], extra)
+	sec, extra = encodeTime(n.ctime)
+	le.PutUint32(buf[12:], sec)
+	le.PutUint32(buf[132:], extra)
+	le.PutUint32(buf[144:], sec) // i_crtime
+	le.PutUint32(buf[148:], extra)
+	sec, extra = encodeTime(n.mtime)
+	le.PutUint32(buf[16:], sec)
+	le.PutUint32(buf[136:], extra)
+	le.PutUint16(buf[128:], extraIsize)
+
+	var blocks uint64
+	for _, e := range n.extents {
+		blocks += uint64(e.length)
+	}
+	blocks += uint64(len(n.leaves))
+	if n.xblock != nil {
+		blocks++
+		le.PutUint32(buf[104:], n.xblock.block)
+	}
+	le.PutUint32(buf[28:], uint32(blocks*blockSize/512))
+
+	iblock := buf[40:100]
+	switch {
+	case n.mode&modeTypeMask == modeSymlink && len(n.target) < fastSymlinkSz:
+		copy(iblock, n.target)
+	case n.mode&modeTypeMask == modeChar || n.mode&modeTypeMask == modeBlock:
+		major, minor := unix.Major(n.rdev), unix.Minor(n.rdev)
+		if major < 256 && minor < 256 {
+			le.PutUint32(iblock[0:], major<<8|minor)
+		} else {
+			le.PutUint32(iblock[4:], minor&0xff|major<<8|(minor&^0xff)<<12)
+		}
+	case n.mode&modeTypeMask == modeFIFO || n.mode&modeTypeMask == modeSocket:
+	default:
+		le.PutUint32(buf[32:], inodeFlagExtents)
+		copy(iblock, encodeExtentRoot(n.extents, n.leaves))
+	}
+}
+
+// encodeExtentRoot returns the 60-byte extent tree root stored in i_block.
+// With no leaves the extents are stored inline (depth 0); otherwise the
+// root indexes the leaf blocks (depth 1).
+func encodeExtentRoot(extents []extent, leaves []uint32) []byte {
+	root := make([]byte, 60)
+	if len(leaves) == 0 {
+		putExtentHeader(root, len(extents), inodeExtents, 0)
+		for i, e := range extents {
+			putExtent(root[12+12*i:], e)
+		}
+		return root
+	}
+	putExtentHeader(root, len(leaves), inodeExtents, 1)
+	for i, leaf := range leaves {
+		idx := root[12+12*i:]
+		le.PutUint32(idx[0:], extents[i*leafExtents].logical)
+		le.PutUint32(idx[4:], leaf)
+	}
+	return root
+}
+
+// encodeExtentLeaf returns the leaf block holding extents.
+func encodeExtentLeaf(extents []extent) []byte {
+	blk := make([]byte, blockSize)
+	putExtentHeader(blk, len(extents), leafExtents, 0)
+	for i, e := range extents {
+		putExtent(blk[12+12*i:], e)
+	}
+	return blk
+}
+
+func putExtentHeader(buf []byte, entries, maxEntries, depth int) {
+	le.PutUint16(buf[0:], extentMagic)
+	le.PutUint16(buf[2:], uint16(entries))
+	le.PutUint16(buf[4:], uint16(maxEntries))
+	le.PutUint16(buf[6:], uint16(depth))
+}
+
+func putExtent(buf []byte, e extent) {
+	le.PutUint32(buf[0:], e.logical)
+	le.PutUint16(buf[4:], uint16(e.length))
+	le.PutUint32(buf[8:], e.start)
+}
+
+// Directory entry file types.
+func direntType(mode uint16) byte {
+	switch mode & modeTypeMask {
+	case modeRegular:
+		return 1
+	case modeDir:
+		return 2
+	case modeChar:
+		return 3
+	case modeBlock:
+		return 4
+	case modeFIFO:
+		return 5
+	case modeSocket:
+		return 6
+	case modeSymlink:
+		return 7
+	}
+	return 0
+}
+
+func recLen(nameLen int) int {
+	return (8 + nameLen + 3) &^ 3
+}
+
+// encodeDir returns the linear directory blocks for n, including "." and "..".
+// lost+found gets at least four blocks so that e2fsck can reconnect files
+// without allocating.
+func (b *builder) encodeDir(n *node) []byte {
+	parent := n.ino
+	if n.ino != rootIno {
+		parent = b.parentOf(n)
+	}
+	type ent struct {
+		name string
+		ino  uint32
+		typ  byte
+	}
+	ents := make([]ent, 0, len(n.entries)+2)
+	ents = append(ents, ent{".", n.ino, 2}, ent{"..", parent, 2})
+	for _, e := range n.entries {
+		ents = append(ents, ent{e.name, e.node.ino, direntType(e.node.mode)})
+	}
+
+	var data []byte
+	var blk []byte
+	lastOff := 0
+	flush := func() {
+		le.PutUint16(blk[lastOff+4:], uint16(blockSize-lastOff))
+		data = append(data, blk...)
+		blk = nil
+	}
+	off := 0
+	for _, e := range ents {
+		rl := recLen(len(e.name))
+		if blk != nil && off+rl > blockSize {
+			flush()
+		}
+		if blk == nil {
+			blk = make([]byte, blockSize)
+			off = 0
+		}
+		le.PutUint32(blk[off:], e.ino)
+		le.PutUint16(blk[off+4:], uint16(rl))
+		blk[off+6] = byte(len(e.name))
+		blk[off+7] = e.typ
+		copy(blk[off+8:], e.name)
+		lastOff = off
+		off += rl
+	}
+	flush()
+
+	if n.ino == lostFoundIno {
+		for len(data) < 4*blockSize {
+			empty := make([]byte, blockSize)
+			le.PutUint16(empty[4:], blockSize)
+			data = append(data, empty...)
+		}
+	}
+	return data
+}
+
+func (b *builder) parentOf(n *node) uint32 {
+	if b.parents == nil {
+		b.parents = make(map[uint32]uint32)
+		for _, p := range b.nodes {
+			if p == nil || p.mode&modeTypeMask != modeDir {
+				continue
+			}
+			for _, e := range p.entries {
+				if e.node.mode&modeTypeMask == modeDir {
+					b.parents[e.node.ino] = p.ino
+				}
+			}
+		}
+	}
+	return b.parents[n.ino]
+}
+
+// encodeJournalSuperblock returns the JBD2 superblock of an empty journal.
+func (b *builder) encodeJournalSuperblock() []byte {
+	be := binary.BigEndian
+	jsb := make([]byte, blockSize)
+	be.PutUint32(jsb[0x00:], journalMagic)
+	be.PutUint32(jsb[0x04:], 4) // JBD2_SUPERBLOCK_V2
+	be.PutUint32(jsb[0x0c:], blockSize)
+	be.PutUint32(jsb[0x10:], uint32(b.journal.size/blockSize))
+	be.PutUint32(jsb[0x14:], 1) // s_first
+	be.PutUint32(jsb[0x18:], 1) // s_sequence
+	copy(jsb[0x30:0x40], b.opts.UUID[:])
+	be.PutUint32(jsb[0x40:], 1) // s_nr_users
+	copy(jsb[0x100:0x110], b.opts.UUID[:])
+	return jsb
+}
@@ -0,0 +1,220 @@
+package ext4
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	blockSize      = 4096
+	logBlockSize   = 2 // log2(blockSize) - 10
+	blocksPerGroup = 8 * blockSize
+	inodeSize      = 256
+	inodesPerBlock = blockSize / inodeSize
+	descSize       = 32
+	maxExtentLen   = 32768
+	inodeExtents   = 4
+	leafExtents    = (blockSize - 12) / 12
+	maxLinks       = 65000
+	maxNameLen     = 255
+)
+
+// geometry describes the static layout of the filesystem: block groups,
+// their metadata and the inode tables.
+type geometry struct {
+	blocks         uint32
+	groups         uint32
+	inodesPerGroup uint32
+	itableBlocks   uint32 // inode table blocks per group
+	gdtBlocks      uint32
+}
+
+func newGeometry(blocks uint64, minInodes uint32) (*geometry, error) {
+	if blocks > math.MaxUint32 {
+		return nil, fmt.Errorf("ext4: filesystem too large (%d blocks)", blocks)
+	}
+	if blocks < 64 {
+		return nil, ErrNoSpace
+	}
+	g := &geometry{blocks: uint32(blocks)}
+	for {
+		g.groups = uint32((uint64(g.blocks) + blocksPerGroup - 1) / blocksPerGroup)
+		g.gdtBlocks = (g.groups*descSize + blockSize - 1) / blockSize
+
+		// One inode per 16 KiB, like mke2fs, but never fewer than needed.
+		inodes := max(g.blocks/4, minInodes+16)
+		ipg := (inodes + g.groups - 1) / g.groups
+		ipg = (ipg + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+		if ipg > 8*blockSize {
+			return nil, fmt.Errorf("ext4: too many inodes (%d) for the filesystem size", minInodes)
+		}
+		g.inodesPerGroup = ipg
+		g.itableBlocks = ipg / inodesPerBlock
+
+		// Drop a trailing group that is too small to hold its own metadata.
+		last := g.groups - 1
+		if g.groupBlocks(last) < g.overhead(last)+64 {
+			if g.groups == 1 {
+				return nil, ErrNoSpace
+			}
+			g.blocks = last * blocksPerGroup
+			continue
+		}
+		return g, nil
+	}
+}
+
+// hasSuper reports whether group i carries a superblock backup
+// (sparse_super: groups 0, 1 and powers of 3, 5 and 7).
+func hasSuper(i uint32) bool {
+	if i <= 1 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < i {
+			n *= base
+		}
+		if n == i {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *geometry) groupStart(i uint32) uint32 {
+	return i * blocksPerGroup
+}
+
+func (g *geometry) groupBlocks(i uint32) uint32 {
+	return min(blocksPerGroup, g.blocks-g.groupStart(i))
+}
+
+// overhead returns the number of metadata blocks at the start of group i.
+func (g *geometry) overhead(i uint32) uint32 {
+	n := 2 + g.itableBlocks
+	if hasSuper(i) {
+		n += 1 + g.gdtBlocks
+	}
+	return n
+}
+
+func (g *geometry) blockBitmap(i uint32) uint32 {
+	b := g.groupStart(i)
+	if hasSuper(i) {
+		b += 1 + g.gdtBlocks
+	}
+	return b
+}
+
+func (g *geometry) inodeBitmap(i uint32) uint32 { return g.blockBitmap(i) + 1 }
+func (g *geometry) inodeTable(i uint32) uint32  { return g.blockBitmap(i) + 2 }
+func (g *geometry) dataStart(i uint32) uint32   { return g.groupStart(i) + g.overhead(i) }
+func (g *geometry) inodes() uint32              { return g.groups * g.inodesPerGroup }
+
+// dataCapacity returns the number of blocks available for data.
+func (g *geometry) dataCapacity() uint64 {
+	var n uint64
+	for i := range g.groups {
+		n += uint64(g.groupBlocks(i) - g.overhead(i))
+	}
+	return n
+}
+
+// journalBlocks returns the journal size mke2fs would pick for a
+// filesystem of the given number of blocks.
+func journalBlocks(blocks uint32, disabled bool) uint64 {
+	switch {
+	case disabled || blocks < 2048:
+		return 0
+	case blocks < 32768:
+		return 1024
+	case blocks < 256*1024:
+		return 4096
+	case blocks < 512*1024:
+		return 8192
+	case blocks < 4096*1024:
+		return 16384
+	case blocks < 8192*1024:
+		return 32768
+	case blocks < 16384*1024:
+		return 65536
+	case blocks < 32768*1024:
+		return 131072
+	default:
+		return 262144
+	}
+}
+
+// extent maps a run of logical file blocks to physical blocks.
+type extent struct {
+	logical uint32
+	start   uint32
+	length  uint32
+}
+
+// allocator hands out data blocks sequentially. Nothing is ever freed, so
+// the blocks in use in each group are exactly those between the start of
+// its data area and the cursor.
+type allocator struct {
+	geo    *geometry
+	cursor uint32
+	used   uint64
+}
+
+func (a *allocator) init(g *geometry) {
+	a.geo = g
+	a.cursor = g.dataStart(0)
+}
+
+// alloc allocates n blocks and returns them as extents starting at logical
+// block 0.
+func (a *allocator) alloc(n uint64) ([]extent, error) {
+	var out []extent
+	var logical uint32
+	for n > 0 {
+		if a.cursor >= a.geo.blocks {
+			return nil, ErrNoSpace
+		}
+		group := a.cursor / blocksPerGroup
+		if ds := a.geo.dataStart(group); a.cursor < ds {
+			a.cursor = ds
+			continue
+		}
+		end := a.geo.groupStart(group) + a.geo.groupBlocks(group)
+		run := uint32(min(n, uint64(end-a.cursor), maxExtentLen))
+		if len(out) > 0 && out[len(out)-1].start+out[len(out)-1].length == a.cursor &&
+			out[len(out)-1].length+run <= maxExtentLen {
+			out[len(out)-1].length += run
+		} else {
+			out = append(out, extent{logical: logical, start: a.cursor, length: run})
+		}
+		logical += run
+		a.cursor += run
+		a.used += uint64(run)
+		n -= uint64(run)
+	}
+	return out, nil
+}
+
+func (a *allocator) allocOne() (uint32, error) {
+	e, err := a.alloc(1)
+	if err != nil {
+		return 0, err
+	}
+	return e[0].start, nil
+}
+
+// usedInGroup returns the number of data blocks allocated in group i.
+func (a *allocator) usedInGroup(i uint32) uint32 {
+	ds := a.geo.dataStart(i)
+	end := a.geo.groupStart(i) + a.geo.groupBlocks(i)
+	switch {
+	case a.cursor <= ds:
+		return 0
+	case a.cursor >= end:
+		return end - ds
+	default:
+		return a.cursor - ds
+	}
+}
@@ -0,0 +1,291 @@
+package ext4
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// File type bits of i_mode.
+const (
+	modeTypeMask = 0xf000
+	modeFIFO     = 0x1000
+	modeChar     = 0x2000
+	modeDir      = 0x4000
+	modeBlock    = 0x6000
+	modeRegular  = 0x8000
+	modeSymlink  = 0xa000
+	modeSocket   = 0xc000
+)
+
+const (
+	rootIno       = 2
+	journalIno    = 8
+	lostFoundIno  = 11
+	firstFreeIno  = 12
+	fastSymlinkSz = 60
+)
+
+type timespec struct {
+	sec  int64
+	nsec int64
+}
+
+func toTimespec(ts unix.Timespec) timespec {
+	return timespec{sec: int64(ts.Sec), nsec: int64(ts.Nsec)}
+}
+
+// node is a single inode of the image.
+type node struct {
+	ino                 uint32
+	mode                uint16
+	uid, gid            uint32
+	atime, mtime, ctime timespec
+	size                int64
+	links               uint32
+	rdev                uint64
+	src                 string // host path of a regular file
+	target              string // symlink target
+	xattrs              []xattr
+	entries             []dirent // directory children, sorted by name
+	subdirs             uint32
+
+	// Filled in by the builder.
+	dirData []byte
+	extents []extent
+	leaves  []uint32
+	xblock  *xattrBlock
+}
+
+type dirent struct {
+	name string
+	node *node
+}
+
+type inodeKey struct {
+	dev, ino uint64
+}
+
+// builder holds the state of a single image build.
+type builder struct {
+	opts    Options
+	nodes   []*node // indexed by inode number - 1 for allocated inodes
+	byHost  map[inodeKey]*node
+	xblocks []*xattrBlock
+	nextIno uint32
+
+	geo      *geometry
+	alloc    allocator
+	journal  *node
+	parents  map[uint32]uint32
+	hashSeed [16]byte
+}
+
+// scan walks srcDir and builds the in-memory inode tree.
+func (b *builder) scan(srcDir string) error {
+	b.byHost = make(map[inodeKey]*node)
+	b.nextIno = firstFreeIno
+
+	now := timespec{sec: time.Now().Unix()}
+	var root *node
+	if srcDir == "" {
+		root = &node{mode: modeDir | 0755, atime: now, mtime: now, ctime: now}
+		if b.opts.Owner != nil {
+			root.uid, root.gid = b.opts.Owner("/", 0, 0)
+		}
+	} else {
+		var st unix.Stat_t
+		if err := unix.Lstat(srcDir, &st); err != nil {
+			return fmt.Errorf("ext4: %s: %w", srcDir, err)
+		}
+		if uint16(st.Mode)&modeTypeMask != modeDir {
+			return fmt.Errorf("ext4: %s is not a directory", srcDir)
+		}
+		var err error
+		if root, err = b.newNode(srcDir, "/", &st); err != nil {
+			return err
+		}
+	}
+	root.ino = rootIno
+	root.links = 2
+	b.setNode(root)
+
+	if srcDir != "" {
+		if err := b.scanDir(root, srcDir, "/"); err != nil {
+			return err
+		}
+	}
+
+	if len(b.nodes) < lostFoundIno || b.nodes[lostFoundIno-1] == nil {
+		for _, e := range root.entries {
+			if e.name == "lost+found" {
+				return fmt.Errorf("ext4: %s: lost+found is not a directory", srcDir)
+			}
+		}
+		lf := &node{ino: lostFoundIno, mode: modeDir | 0700, links: 2, atime: now, mtime: now, ctime: now}
+		if b.opts.Owner != nil {
+			lf.uid, lf.gid = b.opts.Owner("/lost+found", 0, 0)
+		}
+		b.setNode(lf)
+		root.entries = append(root.entries, dirent{name: "lost+found", node: lf})
+		root.subdirs++
+	}
+
+	for _, n := range b.nodes {
+		if n != nil && n.mode&modeTypeMask == modeDir {
+			n.links = 2 + n.subdirs
+			if n.links >= maxLinks {
+				n.links = 1 // dir_nlink: link count not tracked
+			}
+		}
+	}
+	return nil
+}
+
+func (b *builder) scanDir(dir *node, hostDir, imgDir string) error {
+	entries, err := os.ReadDir(hostDir)
+	if err != nil {
+		return fmt.Errorf("ext4: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if len(name) > maxNameLen {
+			return fmt.Errorf("ext4: %s: name too long", filepath.Join(hostDir, name))
+		}
+		hostPath := filepath.Join(hostDir, name)
+		imgPath := path.Join(imgDir, name)
+
+		var st unix.Stat_t
+		if err := unix.Lstat(hostPath, &st); err != nil {
+			return fmt.Errorf("ext4: %s: %w", hostPath, err)
+		}
+		isDir := uint16(st.Mode)&modeTypeMask == modeDir
+
+		key := inodeKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		if !isDir && st.Nlink > 1 {
+			if n, ok := b.byHost[key]; ok {
+				n.links++
+				dir.entries = append(dir.entries, dirent{name: name, node: n})
+				continue
+			}
+		}
+
+		n, err := b.newNode(hostPath, imgPath, &st)
+		if err != nil {
+			return err
+		}
+		if isDir && dir.ino == rootIno && name == "lost+found" {
+			n.ino = lostFoundIno
+		} else {
+			n.ino = b.nextIno
+			b.nextIno++
+		}
+		b.setNode(n)
+		if !isDir && st.Nlink > 1 {
+			b.byHost[key] = n
+		}
+		dir.entries = append(dir.entries, dirent{name: name, node: n})
+
+		if isDir {
+			dir.subdirs++
+			if err := b.scanDir(n, hostPath, imgPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newNode creates a node from the host file at hostPath.
+func (b *builder) newNode(hostPath, imgPath string, st *unix.Stat_t) (*node, error) {
+	n := &node{
+		mode:  uint16(st.Mode),
+		uid:   st.Uid,
+		gid:   st.Gid,
+		atime: toTimespec(st.Atim),
+		mtime: toTimespec(st.Mtim),
+		ctime: toTimespec(st.Ctim),
+		links: 1,
+	}
+	if b.opts.Owner != nil {
+		n.uid, n.gid = b.opts.Owner(imgPath, n.uid, n.gid)
+	}
+
+	switch n.mode & modeTypeMask {
+	case modeRegular:
+		n.src = hostPath
+		n.size = st.Size
+	case modeSymlink:
+		target, err := os.Readlink(hostPath)
+		if err != nil {
+			return nil, fmt.Errorf("ext4: %w", err)
+		}
+		if len(target) >= blockSize {
+			return nil, fmt.Errorf("ext4: %s: symlink target too long", hostPath)
+		}
+		n.target = target
+		n.size = int64(len(target))
+	case modeChar, modeBlock:
+		n.rdev = uint64(st.Rdev)
+	case modeDir, modeFIFO, modeSocket:
+	default:
+		return nil, fmt.Errorf("ext4: %s: unsupported file type %#o", hostPath, n.mode&modeTypeMask)
+	}
+
+	xattrs, err := readXattrs(hostPath)
+	if err != nil {
+		return nil, fmt.Errorf("ext4: %s: %w", hostPath, err)
+	}
+	n.xattrs = xattrs
+	return n, nil
+}
+
+func (b *builder) setNode(n *node) {
+	for uint32(len(b.nodes)) < n.ino {
+		b.nodes = append(b.nodes, nil)
+	}
+	b.nodes[n.ino-1] = n
+}
+
+// minInodes returns the number of inodes the filesystem needs at minimum.
+func (b *builder) minInodes() uint32 {
+	return uint32(len(b.nodes))
+}
+
+// neededBlocks estimates the number of data blocks the tree occupies,
+// excluding the journal.
+func (b *builder) neededBlocks() uint64 {
+	var need uint64
+	seenX := make(map[string]bool)
+	for _, n := range b.nodes {
+		if n == nil {
+			continue
+		}
+		switch n.mode & modeTypeMask {
+		case modeDir:
+			need += uint64(len(b.encodeDir(n))) / blockSize
+		case modeRegular:
+			blocks := uint64((n.size + blockSize - 1) / blockSize)
+			need += blocks
+			if runs := blocks/(blocksPerGroup/2) + 2; runs > inodeExtents {
+				need += (runs + leafExtents - 1) / leafExtents
+			}
+		case modeSymlink:
+			if len(n.target) >= fastSymlinkSz {
+				need++
+			}
+		}
+		if len(n.xattrs) > 0 {
+			key := xattrKey(n.xattrs)
+			if !seenX[key] {
+				seenX[key] = true
+				need++
+			}
+		}
+	}
+	return need
+}
@@ -0,0 +1,224 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattr is an extended attribute in on-disk form: the namespace is encoded
+// as an index and stripped from the name.
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+// xattrPrefixes maps name prefixes to ext4 name indexes. Full names (the
+// ACLs) must come before the plain "system." prefix.
+var xattrPrefixes = []struct {
+	prefix string
+	index  uint8
+}{
+	{"user.", 1},
+	{"system.posix_acl_access", 2},
+	{"system.posix_acl_default", 3},
+	{"trusted.", 4},
+	{"security.", 6},
+	{"system.", 7},
+}
+
+// readXattrs returns the extended attributes of the file at path without
+// following symlinks. Attributes in namespaces ext4 cannot store (such as
+// macOS "com.apple.*" attributes) are skipped.
+func readXattrs(path string) ([]xattr, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []xattr
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("xattr %s: %w", name, err)
+		}
+		x, ok := encodeXattrName(name)
+		if !ok {
+			continue
+		}
+		if x.index == 2 || x.index == 3 {
+			if value, err = aclToDisk(value); err != nil {
+				return nil, fmt.Errorf("xattr %s: %w", name, err)
+			}
+		}
+		x.value = value
+		out = append(out, x)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+	return out, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue // value grew between the two calls
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func encodeXattrName(name string) (xattr, bool) {
+	for _, p := range xattrPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			return xattr{index: p.index, name: name[len(p.prefix):]}, true
+		}
+	}
+	return xattr{}, false
+}
+
+// POSIX ACL tags.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+// aclToDisk converts a POSIX ACL from the xattr representation returned by
+// getxattr (version 2, fixed 8-byte entries) to the compact ext4 on-disk
+// representation (version 1, ids only for named users and groups).
+func aclToDisk(v []byte) ([]byte, error) {
+	if len(v) < 4 || (len(v)-4)%8 != 0 || binary.LittleEndian.Uint32(v) != 2 {
+		return nil, errors.New("malformed POSIX ACL")
+	}
+	var out bytes.Buffer
+	binary.Write(&out, le, uint32(1))
+	for e := v[4:]; len(e) > 0; e = e[8:] {
+		tag, perm := le.Uint16(e[0:]), le.Uint16(e[2:])
+		binary.Write(&out, le, tag)
+		binary.Write(&out, le, perm)
+		switch tag {
+		case aclUser, aclGroup:
+			binary.Write(&out, le, le.Uint32(e[4:]))
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+		default:
+			return nil, fmt.Errorf("unknown POSIX ACL tag %#x", tag)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// xattrBlock is an external extended attribute block, shared between all
+// inodes with identical attributes.
+type xattrBlock struct {
+	data  []byte
+	refs  uint32
+	block uint32
+}
+
+// xattrKey returns a string identifying a set of attributes, used to share
+// xattr blocks.
+func xattrKey(attrs []xattr) string {
+	var sb strings.Builder
+	for _, x := range attrs {
+		fmt.Fprintf(&sb, "%d:%q=%q;", x.index, x.name, x.value)
+	}
+	return sb.String()
+}
+
+const (
+	xattrHeaderSize = 32
+	xattrEntrySize  = 16
+)
+
+// encodeXattrBlock lays out attrs in an xattr block: entries grow from the
+// header downwards, values from the end of the block upwards. The reference
+// count is filled in when the block is written.
+func encodeXattrBlock(attrs []xattr) ([]byte, error) {
+	blk := make([]byte, blockSize)
+	le.PutUint32(blk[0:], xattrMagic)
+	le.PutUint32(blk[8:], 1) // h_blocks
+
+	entryOff := xattrHeaderSize
+	valueEnd := blockSize
+	var blockHash uint32
+	for _, x := range attrs {
+		entryLen := (xattrEntrySize + len(x.name) + 3) &^ 3
+		valueLen := (len(x.value) + 3) &^ 3
+		if entryOff+entryLen+4 > valueEnd-valueLen {
+			return nil, errors.New("extended attributes do not fit in one block")
+		}
+		valueEnd -= valueLen
+		copy(blk[valueEnd:], x.value)
+
+		e := blk[entryOff:]
+		e[0] = byte(len(x.name))
+		e[1] = x.index
+		le.PutUint16(e[2:], uint16(valueEnd))
+		le.PutUint32(e[8:], uint32(len(x.value)))
+		hash := xattrEntryHash(x.name, blk[valueEnd:valueEnd+valueLen])
+		le.PutUint32(e[12:], hash)
+		copy(e[xattrEntrySize:], x.name)
+		entryOff += entryLen
+
+		blockHash = blockHash<<16 ^ blockHash>>16 ^ hash
+	}
+	le.PutUint32(blk[12:], blockHash)
+	return blk, nil
+}
+
+// xattrEntryHash implements ext4_xattr_hash_entry. value must be padded to
+// a multiple of four bytes.
+func xattrEntryHash(name string, value []byte) uint32 {
+	var hash uint32
+	for i := 0; i < len(name); i++ {
+		hash = hash<<5 ^ hash>>27 ^ uint32(int32(int8(name[i])))
+	}
+	for i := 0; i+4 <= len(value); i += 4 {
+		hash = hash<<16 ^ hash>>16 ^ le.Uint32(value[i:])
+	}
+	return hash
+}
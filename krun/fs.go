@@ -20,8 +20,12 @@ func (c *Context) AddVirtioFS(cfg VirtioFSConfig) error {
 	defer C.free(unsafe.Pointer(cTag))
 	cPath := C.CString(cfg.Path)
 	defer C.free(unsafe.Pointer(cPath))
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_virtiofs2(C.uint32_t(c.id), cTag, cPath, C.uint64_t(cfg.ShmSize)),
 		"krun_add_virtiofs2",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) { s.fs = append(s.fs, cfg) })
+	return nil
 }
@@ -29,6 +29,7 @@ func (c *Context) AddDisplay(cfg DisplayConfig) (uint32, error) {
 	if ret < 0 {
 		return 0, retError(ret, "krun_add_display")
 	}
+	c.withState(func(s *contextState) { s.displays = append(s.displays, uint32(ret)) })
 	return uint32(ret), nil
 }
 
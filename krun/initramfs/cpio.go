@@ -0,0 +1,175 @@
+package initramfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// newc header: the magic followed by 13 eight-digit hexadecimal fields.
+const (
+	newcMagic   = "070701"
+	headerSize  = 110
+	trailerName = "TRAILER!!!"
+)
+
+// File type bits of the cpio mode field, as in <sys/stat.h>.
+const (
+	modeFIFO = 0010000
+	modeChr  = 0020000
+	modeDir  = 0040000
+	modeBlk  = 0060000
+	modeReg  = 0100000
+	modeLnk  = 0120000
+)
+
+var errSize = errors.New("file changed size while being archived")
+
+type archiveWriter struct {
+	w     io.Writer
+	mtime uint32
+	off   int64
+}
+
+func (aw *archiveWriter) writeEntry(ino uint32, e *Entry) error {
+	mode, err := cpioMode(e.Mode)
+	if err != nil {
+		return err
+	}
+	nlink := uint32(1)
+	var data io.Reader
+	var size int64
+	switch mode &^ 07777 {
+	case modeDir:
+		nlink = 2
+	case modeLnk:
+		data, size = strings.NewReader(e.Linkname), int64(len(e.Linkname))
+	case modeReg:
+		rc, n, err := e.open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		data, size = rc, n
+	}
+	if size > 0xffffffff {
+		return errors.New("file larger than 4 GiB")
+	}
+	var devMajor, devMinor uint32
+	if mode&^07777 == modeChr || mode&^07777 == modeBlk {
+		devMajor, devMinor = e.DevMajor, e.DevMinor
+	}
+	if err := aw.writeHeader(e.Path, [13]uint32{
+		ino, mode, e.UID, e.GID, nlink, aw.mtime, uint32(size),
+		0, 0, devMajor, devMinor, uint32(len(e.Path) + 1), 0,
+	}); err != nil {
+		return err
+	}
+	if data != nil {
+		n, err := io.CopyN(aw.w, data, size)
+		aw.off += n
+		if err == io.EOF {
+			return errSize
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return aw.pad()
+}
+
+func (aw *archiveWriter) writeTrailer() error {
+	if err := aw.writeHeader(trailerName, [13]uint32{4: 1, 11: uint32(len(trailerName) + 1)}); err != nil {
+		return err
+	}
+	// Pad the archive to a whole 512-byte block, as cpio(1) does.
+	n, err := aw.w.Write(make([]byte, (512-aw.off%512)%512))
+	aw.off += int64(n)
+	return err
+}
+
+// writeHeader writes the header, the NUL-terminated name and the padding
+// that aligns the data to four bytes.
+func (aw *archiveWriter) writeHeader(name string, fields [13]uint32) error {
+	buf := make([]byte, 0, headerSize+len(name)+4)
+	buf = append(buf, newcMagic...)
+	for _, f := range fields {
+		buf = fmt.Appendf(buf, "%08x", f)
+	}
+	buf = append(buf, name...)
+	buf = append(buf, 0)
+	n, err := aw.w.Write(buf)
+	aw.off += int64(n)
+	if err != nil {
+		return err
+	}
+	return aw.pad()
+}
+
+func (aw *archiveWriter) pad() error {
+	n, err := aw.w.Write(make([]byte, (4-aw.off%4)%4))
+	aw.off += int64(n)
+	return err
+}
+
+// open returns the content of a regular file and its size.
+func (e *Entry) open() (io.ReadCloser, int64, error) {
+	var f fs.File
+	var err error
+	switch {
+	case e.Source == "":
+		return io.NopCloser(bytes.NewReader(e.Data)), int64(len(e.Data)), nil
+	case e.fsys != nil:
+		f, err = e.fsys.Open(e.Source)
+	default:
+		f, err = os.Open(e.Source)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s is not a regular file", e.Source)
+	}
+	return f, fi.Size(), nil
+}
+
+// cpioMode converts m to the mode field of a cpio header.
+func cpioMode(m fs.FileMode) (uint32, error) {
+	mode := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= 01000
+	}
+	switch t := m.Type(); t {
+	case 0:
+		mode |= modeReg
+	case fs.ModeDir:
+		mode |= modeDir
+	case fs.ModeSymlink:
+		mode |= modeLnk
+	case fs.ModeNamedPipe:
+		mode |= modeFIFO
+	case fs.ModeDevice:
+		mode |= modeBlk
+	case fs.ModeDevice | fs.ModeCharDevice:
+		mode |= modeChr
+	default:
+		return 0, fmt.Errorf("unsupported file type %v", t)
+	}
+	return mode, nil
+}
@@ -0,0 +1,281 @@
+// Package initramfs builds initramfs images: cpio archives in the "newc"
+// format the Linux kernel unpacks into its initial root filesystem,
+// optionally compressed.
+//
+// Archives are reproducible: entries are sorted by path, numbered in that
+// order and stamped with a fixed modification time, so the same inputs give
+// the same bytes and the image can be cached by content. The result is
+// passed to the kernel with KernelConfig.Initramfs:
+//
+//	entries, err := initramfs.Dir("/path/to/initramfs-root")
+//	...
+//	err = initramfs.Build("initrd.img", entries, initramfs.Options{Compression: initramfs.Gzip})
+//	...
+//	ctx.SetKernel(krun.KernelConfig{Path: "vmlinux", Format: krun.KernelFormatELF, Initramfs: "initrd.img"})
+package initramfs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+// Compression selects how the archive is compressed.
+type Compression int
+
+const (
+	// None writes a plain cpio archive.
+	None Compression = iota
+	// Gzip compresses with gzip, which every kernel can unpack.
+	Gzip
+	// Zstd compresses with zstd; the kernel needs CONFIG_RD_ZSTD.
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case None:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// Options configures how an archive is written.
+type Options struct {
+	// Compression compresses the archive. The zero value is None.
+	Compression Compression
+	// ModTime is the modification time of every entry. The zero value
+	// means the Unix epoch.
+	ModTime time.Time
+	// Owner, if set, is called for every entry to map its owner. Path is
+	// slash-separated and absolute within the archive. Returning 0, 0
+	// makes an archive owned by root whoever built it.
+	Owner func(path string, uid, gid uint32) (uint32, uint32)
+}
+
+// Entry is a file in the archive.
+type Entry struct {
+	// Path is the slash-separated path inside the archive. A leading
+	// slash is optional.
+	Path string
+	// Mode holds the file type and permission bits. Regular files, and
+	// with os.ModeDir, os.ModeSymlink, os.ModeDevice (with
+	// os.ModeCharDevice for character devices) and os.ModeNamedPipe the
+	// other types, are supported.
+	Mode fs.FileMode
+	// UID and GID own the entry.
+	UID, GID uint32
+	// Data is the content of a regular file, unless Source is set.
+	Data []byte
+	// Source is a host file to read the content of a regular file from.
+	Source string
+	// Linkname is the target of a symlink.
+	Linkname string
+	// DevMajor and DevMinor are the device number of a device node.
+	DevMajor, DevMinor uint32
+
+	fsys fs.FS // with Source, read Source from fsys
+}
+
+// Dir lists the directory tree at dir as archive entries, with the modes,
+// owners and device numbers found on disk. Hardlinked files are stored as
+// separate copies and sockets are skipped. File contents are read when the
+// archive is written.
+func Dir(dir string) ([]Entry, error) {
+	var entries []Entry
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		e := Entry{Path: filepath.ToSlash(rel), Mode: fi.Mode()}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			e.UID, e.GID = st.Uid, st.Gid
+			if fi.Mode()&os.ModeDevice != 0 {
+				e.DevMajor, e.DevMinor = unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+			}
+		}
+		switch t := fi.Mode().Type(); {
+		case t == 0:
+			e.Source = p
+		case t == os.ModeSymlink:
+			if e.Linkname, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case t&os.ModeSocket != 0:
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initramfs: %w", err)
+	}
+	return entries, nil
+}
+
+// FS lists the files in fsys as archive entries, owned by root. Symlinks
+// are included when fsys implements fs.ReadLinkFS. File contents are read
+// when the archive is written.
+func FS(fsys fs.FS) ([]Entry, error) {
+	var entries []Entry
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := Entry{Path: p, Mode: fi.Mode()}
+		switch t := fi.Mode().Type(); {
+		case t == 0:
+			e.Source, e.fsys = p, fsys
+		case t == os.ModeSymlink:
+			if e.Linkname, err = fs.ReadLink(fsys, p); err != nil {
+				return err
+			}
+		case t&(os.ModeDir|os.ModeNamedPipe) == 0:
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initramfs: %w", err)
+	}
+	return entries, nil
+}
+
+// Build writes the archive of entries to the file dst, replacing it if it
+// exists.
+func Build(dst string, entries []Entry, opts Options) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("initramfs: %w", err)
+	}
+	err = Write(f, entries, opts)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("initramfs: %w", cerr)
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// Write writes the archive of entries to w. Entries are sorted by path, and
+// missing parent directories are added with mode 0755, owned by root.
+func Write(w io.Writer, entries []Entry, opts Options) error {
+	entries, err := normalize(entries)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	var cw io.WriteCloser
+	switch opts.Compression {
+	case None:
+		cw = nopCloser{bw}
+	case Gzip:
+		// No name or timestamp in the gzip header, which stays reproducible.
+		cw, _ = gzip.NewWriterLevel(bw, gzip.BestCompression)
+	case Zstd:
+		// A single encoder goroutine keeps the output independent of the
+		// number of CPUs.
+		cw, err = zstd.NewWriter(bw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return fmt.Errorf("initramfs: %w", err)
+		}
+	default:
+		return fmt.Errorf("initramfs: unknown compression %v", opts.Compression)
+	}
+
+	mtime := opts.ModTime
+	if mtime.IsZero() {
+		mtime = time.Unix(0, 0)
+	}
+	aw := &archiveWriter{w: cw, mtime: uint32(mtime.Unix())}
+	for i := range entries {
+		e := &entries[i]
+		if opts.Owner != nil {
+			e.UID, e.GID = opts.Owner("/"+e.Path, e.UID, e.GID)
+		}
+		if err := aw.writeEntry(uint32(i+1), e); err != nil {
+			return fmt.Errorf("initramfs: %s: %w", e.Path, err)
+		}
+	}
+	if err := aw.writeTrailer(); err != nil {
+		return fmt.Errorf("initramfs: %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("initramfs: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("initramfs: %w", err)
+	}
+	return nil
+}
+
+// normalize cleans and sorts entry paths, rejects duplicates and adds
+// missing parent directories.
+func normalize(in []Entry) ([]Entry, error) {
+	entries := make([]Entry, 0, len(in))
+	seen := make(map[string]bool, len(in))
+	for _, e := range in {
+		p := path.Clean("/" + e.Path)[1:]
+		if p == "" {
+			return nil, fmt.Errorf("initramfs: invalid path %q", e.Path)
+		}
+		if seen[p] {
+			return nil, fmt.Errorf("initramfs: %s listed twice", p)
+		}
+		seen[p] = true
+		e.Path = p
+		entries = append(entries, e)
+	}
+	for _, e := range entries {
+		for dir := path.Dir(e.Path); dir != "."; dir = path.Dir(dir) {
+			if seen[dir] {
+				break
+			}
+			seen[dir] = true
+			entries = append(entries, Entry{Path: dir, Mode: os.ModeDir | 0755})
+		}
+	}
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.Path, b.Path) })
+	return entries, nil
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,221 @@
+package initramfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type record struct {
+	ino, mode, uid, gid, nlink, mtime uint32
+	rdevMajor, rdevMinor              uint32
+	name, data                        string
+}
+
+// readArchive parses a newc archive, checking field alignment.
+func readArchive(t *testing.T, b []byte) []record {
+	t.Helper()
+	var out []record
+	off := 0
+	for {
+		if off%4 != 0 || len(b) < off+headerSize || string(b[off:off+6]) != newcMagic {
+			t.Fatalf("bad header at offset %d", off)
+		}
+		var f [13]uint32
+		for i := range f {
+			v, err := strconv.ParseUint(string(b[off+6+8*i:off+14+8*i]), 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f[i] = uint32(v)
+		}
+		off += headerSize
+		name := string(b[off : off+int(f[11])-1])
+		off = (off + int(f[11]) + 3) &^ 3
+		data := string(b[off : off+int(f[6])])
+		off = (off + int(f[6]) + 3) &^ 3
+		if name == trailerName {
+			if len(b)%512 != 0 {
+				t.Errorf("archive size %d not a multiple of 512", len(b))
+			}
+			return out
+		}
+		out = append(out, record{f[0], f[1], f[2], f[3], f[4], f[5], f[9], f[10], name, data})
+	}
+}
+
+func write(t *testing.T, entries []Entry, opts Options) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Write(&buf, entries, opts); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWrite(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	b := write(t, []Entry{
+		{Path: "/init", Mode: 0755, Data: []byte("#!/bin/sh\n")},
+		{Path: "bin/sh", Mode: os.ModeSymlink | 0777, Linkname: "busybox"},
+		{Path: "dev/console", Mode: os.ModeDevice | os.ModeCharDevice | 0600, DevMajor: 5, DevMinor: 1},
+		{Path: "tmp", Mode: os.ModeDir | os.ModeSticky | 0777},
+	}, Options{ModTime: mtime, Owner: func(string, uint32, uint32) (uint32, uint32) { return 0, 0 }})
+
+	want := []record{
+		{1, modeDir | 0755, 0, 0, 2, 1700000000, 0, 0, "bin", ""},
+		{2, modeLnk | 0777, 0, 0, 1, 1700000000, 0, 0, "bin/sh", "busybox"},
+		{3, modeDir | 0755, 0, 0, 2, 1700000000, 0, 0, "dev", ""},
+		{4, modeChr | 0600, 0, 0, 1, 1700000000, 5, 1, "dev/console", ""},
+		{5, modeReg | 0755, 0, 0, 1, 1700000000, 0, 0, "init", "#!/bin/sh\n"},
+		{6, modeDir | 01777, 0, 0, 2, 1700000000, 0, 0, "tmp", ""},
+	}
+	got := readArchive(t, b)
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	for name, entries := range map[string][]Entry{
+		"duplicate": {{Path: "/a"}, {Path: "a/"}},
+		"root":      {{Path: "/"}},
+		"socket":    {{Path: "s", Mode: os.ModeSocket}},
+		"missing":   {{Path: "f", Source: "/nonexistent"}},
+	} {
+		if err := Write(io.Discard, entries, Options{}); err == nil {
+			t.Errorf("%s: Write succeeded", name)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "etc"), 0700)
+	os.WriteFile(filepath.Join(dir, "etc/motd"), []byte("hello\n"), 0640)
+	os.Symlink("etc/motd", filepath.Join(dir, "motd"))
+
+	entries, err := Dir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := write(t, entries, Options{})
+
+	// Newer files on disk give the same archive.
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, "etc/motd"), later, later)
+	entries, _ = Dir(dir)
+	if second := write(t, entries, Options{}); !bytes.Equal(first, second) {
+		t.Error("archive not reproducible")
+	}
+
+	got := readArchive(t, first)
+	names := make([]string, len(got))
+	for i, r := range got {
+		names[i] = r.name
+		if r.mtime != 0 {
+			t.Errorf("%s: mtime %d", r.name, r.mtime)
+		}
+	}
+	if strings.Join(names, " ") != "etc etc/motd motd" {
+		t.Errorf("entries = %v", names)
+	}
+	if got[0].mode != modeDir|0700 || got[1].mode != modeReg|0640 || got[1].data != "hello\n" || got[2].data != "etc/motd" {
+		t.Errorf("entries = %+v", got)
+	}
+	if uid := uint32(os.Getuid()); got[1].uid != uid {
+		t.Errorf("uid = %d, want %d", got[1].uid, uid)
+	}
+
+	if path, err := exec.LookPath("bsdtar"); err == nil {
+		out := filepath.Join(t.TempDir(), "out")
+		os.Mkdir(out, 0755)
+		cmd := exec.Command(path, "-x", "-C", out, "-f", "-")
+		cmd.Stdin = bytes.NewReader(first)
+		if b, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("bsdtar: %v\n%s", err, b)
+		}
+		if b, _ := os.ReadFile(filepath.Join(out, "motd")); string(b) != "hello\n" {
+			t.Errorf("bsdtar extracted %q", b)
+		}
+	}
+}
+
+func TestFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"init":          {Data: []byte("init"), Mode: 0755},
+		"etc/hostname":  {Data: []byte("vm\n"), Mode: 0644},
+		"lib/modules":   {Mode: os.ModeDir | 0755},
+		"etc/localtime": {Data: []byte("UTC"), Mode: os.ModeSymlink},
+	}
+	entries, err := FS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readArchive(t, write(t, entries, Options{}))
+	var names []string
+	for _, r := range got {
+		names = append(names, r.name+"="+r.data)
+	}
+	if s := strings.Join(names, " "); s != "etc= etc/hostname=vm\n etc/localtime=UTC init=init lib= lib/modules=" {
+		t.Errorf("entries = %q", s)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	entries := []Entry{{Path: "init", Mode: 0755, Data: bytes.Repeat([]byte("x"), 10000)}}
+	plain := write(t, entries, Options{})
+	for _, c := range []Compression{Gzip, Zstd} {
+		b := write(t, entries, Options{Compression: c})
+		if !bytes.Equal(b, write(t, entries, Options{Compression: c})) {
+			t.Errorf("%v: output not reproducible", c)
+		}
+		var r io.Reader
+		switch c {
+		case Gzip:
+			r, _ = gzip.NewReader(bytes.NewReader(b))
+		case Zstd:
+			d, _ := zstd.NewReader(bytes.NewReader(b))
+			defer d.Close()
+			r = d
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%v: decompressed archive differs", c)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "initrd.img")
+	if err := Build(dst, []Entry{{Path: "init", Data: []byte("x")}}, Options{Compression: Gzip}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dst); len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		t.Error("not a gzip file")
+	}
+	if err := Build(dst, []Entry{{Path: "/"}}, Options{}); err == nil {
+		t.Fatal("Build succeeded")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("failed Build left the file behind")
+	}
+}
@@ -12,7 +12,7 @@ type KernelConfig struct {
 	Path      string
 	Format    KernelFormat // 0 = KernelFormatRaw
 	Initramfs string       // "" = none
-	Cmdline   string       // "" = none
+	Cmdline   string       // "" = none; see [Cmdline]
 }
 
 // SetFirmware sets the path to the firmware to be loaded into the microVM.
@@ -23,7 +23,13 @@ func (c *Context) SetFirmware(firmwarePath string) error {
 }
 
 // SetKernel configures the kernel to be loaded in the microVM.
+// A warning is logged with [log/slog] if cfg.Cmdline names a console other
+// than the one set with [Context.SetKernelConsole].
 func (c *Context) SetKernel(cfg KernelConfig) error {
+	if err := cfg.resolveFormat(); err != nil {
+		return err
+	}
+
 	cKernel := C.CString(cfg.Path)
 	defer C.free(unsafe.Pointer(cKernel))
 
@@ -39,10 +45,17 @@ func (c *Context) SetKernel(cfg KernelConfig) error {
 		defer C.free(unsafe.Pointer(cCmdline))
 	}
 
-	return checkRet(
+	if err := checkRet(
 		C.krun_set_kernel(
 			C.uint32_t(c.id), cKernel, C.uint32_t(cfg.Format), cInitramfs, cCmdline,
 		),
 		"krun_set_kernel",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) {
+		s.cmdlineConsoles = cmdlineConsoles(cfg.Cmdline)
+		s.checkConsoles(c.id)
+	})
+	return nil
 }
@@ -0,0 +1,243 @@
+package krun
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrUnsupportedKernel is returned by [DetectKernelFormat] for files that
+// are not a kernel image libkrun can load.
+var ErrUnsupportedKernel = errors.New("krun: unsupported kernel image")
+
+// ErrKernelArch is returned by SetKernel with KernelFormatAuto when the
+// kernel is built for a different architecture than the host.
+var ErrKernelArch = errors.New("krun: kernel architecture does not match the host")
+
+// KernelImage describes a kernel image inspected by [DetectKernelFormat].
+type KernelImage struct {
+	Path   string
+	Format KernelFormat
+	// Arch is the architecture the kernel is built for, as a GOARCH value
+	// ("amd64", "arm64", "riscv64"), or "" if it could not be told.
+	Arch string
+}
+
+// Magic numbers and offsets of the formats DetectKernelFormat understands.
+const (
+	kernelHeaderSize = 4096
+
+	elfMagic   = "\x7fELF"
+	gzipMagic  = "\x1f\x8b\x08"
+	bzip2Magic = "BZh"
+	zstdMagic  = "\x28\xb5\x2f\xfd"
+	peMagic    = "MZ"
+
+	// The arm64 and RISC-V Image headers carry a magic at offset 56.
+	imageMagicOffset = 56
+	arm64ImageMagic  = "ARM\x64"
+	riscvImageMagic  = "RSC\x05"
+
+	// An EFI zboot image (CONFIG_EFI_ZBOOT) is a PE file with "zimg" at
+	// offset 4, followed by the payload offset and size and, at offset 24,
+	// the compression type.
+	zbootMagic = "zimg"
+
+	// x86 bzImage has its setup header signature at 0x202. From boot
+	// protocol 2.08 the header gives the offset and length of the
+	// compressed vmlinux, from the end of the setup sectors.
+	bzImageMagicOffset   = 0x202
+	bzImageMagic         = "HdrS"
+	bzImageSetupSects    = 0x1f1
+	bzImageVersion       = 0x206
+	bzImagePayloadOffset = 0x248
+	bzImageMinVersion    = 0x0208
+	bzImageDefaultSetup  = 4
+	bzImageSectorSize    = 512
+)
+
+var elfMachines = map[uint16]string{62: "amd64", 183: "arm64", 243: "riscv64"}
+
+var peMachines = map[uint16]string{0x8664: "amd64", 0xaa64: "arm64", 0x5064: "riscv64"}
+
+// DetectKernelFormat identifies the kernel image at path from its magic
+// bytes: an ELF file, an arm64 Image (raw, or compressed with gzip, bzip2
+// or zstd), an x86 bzImage whose vmlinux is compressed with one of those,
+// or a PE/EFI zboot image with a gzip payload. Compressed images are
+// partly decompressed to read the architecture.
+//
+// bzImages compressed otherwise (xz, lzma, lzo, lz4) and zboot images
+// compressed with anything but gzip fail with [ErrUnsupportedKernel], as
+// do files without a recognized magic.
+func DetectKernelFormat(path string) (*KernelImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("krun: %w", err)
+	}
+	defer f.Close()
+	head := make([]byte, kernelHeaderSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("krun: %s: %w", path, err)
+	}
+	head = head[:n]
+
+	k := &KernelImage{Path: path}
+	switch {
+	case bytes.HasPrefix(head, []byte(elfMagic)):
+		k.Format, k.Arch = KernelFormatELF, elfArch(head)
+	case imageArch(head) != "":
+		k.Format, k.Arch = KernelFormatRaw, imageArch(head)
+	case bytes.HasPrefix(head, []byte(gzipMagic)):
+		k.Format, k.Arch = KernelFormatImageGz, compressedArch(f, 0, gzipReader)
+	case bytes.HasPrefix(head, []byte(bzip2Magic)):
+		k.Format, k.Arch = KernelFormatImageBz2, compressedArch(f, 0, bzip2Reader)
+	case bytes.HasPrefix(head, []byte(zstdMagic)):
+		k.Format, k.Arch = KernelFormatImageZstd, compressedArch(f, 0, zstdReader)
+	case len(head) >= bzImageMagicOffset+4 && string(head[bzImageMagicOffset:bzImageMagicOffset+4]) == bzImageMagic:
+		// Checked before the PE magic: a bzImage with an EFI stub has both.
+		if err := inspectBzImage(f, head, k); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(head, []byte(peMagic)):
+		if err := inspectPE(f, head, k); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s: unrecognized format", ErrUnsupportedKernel, path)
+	}
+	return k, nil
+}
+
+// inspectPE identifies an EFI zboot image with a gzip payload.
+func inspectPE(f io.ReaderAt, head []byte, k *KernelImage) error {
+	if len(head) >= 0x40 {
+		if off := binary.LittleEndian.Uint32(head[0x3c:]); int(off)+6 <= len(head) && string(head[off:off+4]) == "PE\x00\x00" {
+			k.Arch = peMachines[binary.LittleEndian.Uint16(head[off+4:])]
+		}
+	}
+	if len(head) < 56 || string(head[4:8]) != zbootMagic {
+		return fmt.Errorf("%w: %s: PE image without a zboot payload", ErrUnsupportedKernel, k.Path)
+	}
+	comp := string(bytes.TrimRight(head[24:56], "\x00"))
+	if comp != "gzip" {
+		return fmt.Errorf("%w: %s: %s-compressed zboot image", ErrUnsupportedKernel, k.Path, comp)
+	}
+	k.Format = KernelFormatPEGz
+	if k.Arch == "" {
+		k.Arch = compressedArch(f, int64(binary.LittleEndian.Uint32(head[8:])), gzipReader)
+	}
+	return nil
+}
+
+// inspectBzImage identifies the compression of an x86 bzImage's payload,
+// which libkrun finds and decompresses with the matching Image format.
+func inspectBzImage(f io.ReaderAt, head []byte, k *KernelImage) error {
+	if len(head) < bzImagePayloadOffset+8 || binary.LittleEndian.Uint16(head[bzImageVersion:]) < bzImageMinVersion {
+		return fmt.Errorf("%w: %s: bzImage before boot protocol 2.08", ErrUnsupportedKernel, k.Path)
+	}
+	setup := int64(head[bzImageSetupSects])
+	if setup == 0 {
+		setup = bzImageDefaultSetup
+	}
+	off := (setup+1)*bzImageSectorSize + int64(binary.LittleEndian.Uint32(head[bzImagePayloadOffset:]))
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, off); err != nil {
+		return fmt.Errorf("%w: %s: bzImage payload: %v", ErrUnsupportedKernel, k.Path, err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte(gzipMagic)):
+		k.Format, k.Arch = KernelFormatImageGz, compressedArch(f, off, gzipReader)
+	case bytes.HasPrefix(magic, []byte(bzip2Magic)):
+		k.Format, k.Arch = KernelFormatImageBz2, compressedArch(f, off, bzip2Reader)
+	case bytes.HasPrefix(magic, []byte(zstdMagic)):
+		k.Format, k.Arch = KernelFormatImageZstd, compressedArch(f, off, zstdReader)
+	default:
+		return fmt.Errorf("%w: %s: bzImage payload compressed with neither gzip, bzip2 nor zstd", ErrUnsupportedKernel, k.Path)
+	}
+	if k.Arch == "" {
+		// The setup header is x86's alone.
+		k.Arch = "amd64"
+	}
+	return nil
+}
+
+// compressedArch decompresses the start of the stream at off in f and
+// returns the architecture of the Image or ELF file inside, or "".
+func compressedArch(f io.ReaderAt, off int64, newReader func(io.Reader) (io.Reader, error)) string {
+	r, err := newReader(io.NewSectionReader(f, off, 1<<62))
+	if err != nil {
+		return ""
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	head := make([]byte, 64)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return ""
+	}
+	if bytes.HasPrefix(head, []byte(elfMagic)) {
+		return elfArch(head)
+	}
+	return imageArch(head)
+}
+
+func gzipReader(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+
+func bzip2Reader(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }
+
+func zstdReader(r io.Reader) (io.Reader, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// elfArch returns the architecture of a 64-bit little-endian ELF header.
+func elfArch(head []byte) string {
+	if len(head) < 20 || head[4] != 2 || head[5] != 1 {
+		return ""
+	}
+	return elfMachines[binary.LittleEndian.Uint16(head[18:])]
+}
+
+// imageArch returns the architecture of an arm64 or RISC-V Image header,
+// or "" if head is not one.
+func imageArch(head []byte) string {
+	if len(head) < imageMagicOffset+4 {
+		return ""
+	}
+	switch string(head[imageMagicOffset : imageMagicOffset+4]) {
+	case arm64ImageMagic:
+		return "arm64"
+	case riscvImageMagic:
+		return "riscv64"
+	}
+	return ""
+}
+
+// resolveFormat replaces KernelFormatAuto in cfg with the detected format,
+// after checking that the kernel matches the host architecture.
+func (cfg *KernelConfig) resolveFormat() error {
+	if cfg.Format != KernelFormatAuto {
+		return nil
+	}
+	k, err := DetectKernelFormat(cfg.Path)
+	if err != nil {
+		return err
+	}
+	if k.Arch != "" && k.Arch != runtime.GOARCH {
+		return fmt.Errorf("%w: %s is built for %s, host is %s", ErrKernelArch, cfg.Path, k.Arch, runtime.GOARCH)
+	}
+	cfg.Format = k.Format
+	return nil
+}
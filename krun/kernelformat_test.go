@@ -0,0 +1,158 @@
+package krun
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// testELF returns the start of a 64-bit little-endian ELF file for machine.
+func testELF(machine uint16) []byte {
+	b := make([]byte, 64)
+	copy(b, elfMagic)
+	b[4], b[5] = 2, 1
+	binary.LittleEndian.PutUint16(b[18:], machine)
+	return b
+}
+
+func testArm64Image() []byte {
+	b := make([]byte, 128)
+	copy(b[imageMagicOffset:], arm64ImageMagic)
+	return b
+}
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+// testZboot returns an arm64 EFI zboot image with a gzip payload.
+func testZboot(t *testing.T, comp string) []byte {
+	payload := gzipBytes(t, testArm64Image())
+	b := make([]byte, 512)
+	copy(b, peMagic)
+	copy(b[4:], zbootMagic)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(payload)))
+	copy(b[24:], comp)
+	binary.LittleEndian.PutUint32(b[0x3c:], 0x80)
+	copy(b[0x80:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(b[0x84:], 0xaa64)
+	return append(b, payload...)
+}
+
+// testBzImage returns an x86 bzImage with an EFI stub and payload as the
+// compressed vmlinux.
+func testBzImage(payload []byte) []byte {
+	b := make([]byte, 2*bzImageSectorSize+0x100) // one setup sector
+	copy(b, peMagic)
+	b[bzImageSetupSects] = 1
+	copy(b[bzImageMagicOffset:], bzImageMagic)
+	binary.LittleEndian.PutUint16(b[bzImageVersion:], 0x020f)
+	binary.LittleEndian.PutUint32(b[bzImagePayloadOffset:], 0x100)
+	binary.LittleEndian.PutUint32(b[bzImagePayloadOffset+4:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func TestDetectKernelFormat(t *testing.T) {
+	zstdBytes := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw, _ := zstd.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	type kernelTest struct {
+		name   string
+		data   []byte
+		format KernelFormat
+		arch   string
+	}
+	tests := []kernelTest{
+		{"vmlinux-x86", testELF(62), KernelFormatELF, "amd64"},
+		{"vmlinux-arm64", testELF(183), KernelFormatELF, "arm64"},
+		{"Image", testArm64Image(), KernelFormatRaw, "arm64"},
+		{"Image.gz", gzipBytes(t, testArm64Image()), KernelFormatImageGz, "arm64"},
+		{"Image.zst", zstdBytes(testArm64Image()), KernelFormatImageZstd, "arm64"},
+		{"vmlinuz.efi", testZboot(t, "gzip"), KernelFormatPEGz, "arm64"},
+		{"bzImage", testBzImage(gzipBytes(t, testELF(62))), KernelFormatImageGz, "amd64"},
+		{"bzImage-zst", testBzImage(zstdBytes(testELF(62))), KernelFormatImageZstd, "amd64"},
+	}
+	if bz, err := exec.LookPath("bzip2"); err == nil {
+		cmd := exec.Command(bz, "-c")
+		cmd.Stdin = bytes.NewReader(testArm64Image())
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests = append(tests, kernelTest{"Image.bz2", out, KernelFormatImageBz2, "arm64"})
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			writeTestFile(t, path, string(tt.data))
+			k, err := DetectKernelFormat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.Format != tt.format || k.Arch != tt.arch {
+				t.Errorf("DetectKernelFormat = %+v, want format %d arch %s", k, tt.format, tt.arch)
+			}
+		})
+	}
+}
+
+func TestDetectKernelFormat_Unsupported(t *testing.T) {
+	old := make([]byte, 1024)
+	copy(old, peMagic)
+	copy(old[bzImageMagicOffset:], bzImageMagic)
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"text":         []byte("not a kernel"),
+		"bzImage-2.00": old,
+		"bzImage-xz":   testBzImage([]byte("\xfd7zXZ\x00")),
+		"zboot-zst":    testZboot(t, "zstd"),
+	} {
+		path := filepath.Join(dir, name)
+		writeTestFile(t, path, string(data))
+		if _, err := DetectKernelFormat(path); !errors.Is(err, ErrUnsupportedKernel) {
+			t.Errorf("%s: err = %v, want ErrUnsupportedKernel", name, err)
+		}
+	}
+}
+
+func TestSetKernel_Auto(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+	host, other := testELF(62), testELF(183)
+	if runtime.GOARCH == "arm64" {
+		host, other = other, host
+	}
+
+	path := filepath.Join(dir, "vmlinux")
+	writeTestFile(t, path, string(host))
+	if err := ctx.SetKernel(KernelConfig{Path: path, Format: KernelFormatAuto}); err != nil {
+		t.Fatal(err)
+	}
+
+	path = filepath.Join(dir, "vmlinux-other")
+	writeTestFile(t, path, string(other))
+	if err := ctx.SetKernel(KernelConfig{Path: path, Format: KernelFormatAuto}); !errors.Is(err, ErrKernelArch) {
+		t.Errorf("err = %v, want ErrKernelArch", err)
+	}
+}
@@ -82,16 +82,28 @@ func CreateContext() (*Context, error) {
 	return &Context{id: uint32(ret)}, nil
 }
 
-// Free releases the configuration context.
+// Free releases the configuration context and runs its [Context.OnExit]
+// functions.
 func (c *Context) Free() error {
+	defer forgetState(c.id)
+	defer forgetConsoleLog(c.id)
+	defer runExitHooks(c.id)
 	return checkRet(C.krun_free_ctx(C.uint32_t(c.id)), "krun_free_ctx")
 }
 
 // StartEnter starts and enters the microVM. This function consumes the context.
 // It only returns if an error occurs before starting the microVM. Otherwise,
 // the VMM calls exit() with the workload's exit code once the VM shuts down.
+// [Context.OnExit] functions run in either case.
 func (c *Context) StartEnter() error {
-	return checkRet(C.krun_start_enter(C.uint32_t(c.id)), "krun_start_enter")
+	registerAtexit()
+	forgetState(c.id)
+	if err := checkRet(C.krun_start_enter(C.uint32_t(c.id)), "krun_start_enter"); err != nil {
+		runExitHooks(c.id)
+		forgetConsoleLog(c.id)
+		return err
+	}
+	return nil
 }
 
 // HasFeature checks if a specific feature was enabled at build time.
@@ -11,6 +11,8 @@ import (
 )
 
 func TestMain(m *testing.M) {
+	// When re-execed by Cmd, run its VM and exit.
+	CommandMain()
 	// When re-execed as an e2e helper subprocess, run the VM and exit.
 	if os.Getenv("KRUN_E2E_HELPER") == "1" {
 		e2eHelper() // never returns on success
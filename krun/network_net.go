@@ -7,7 +7,10 @@ package krun
 #include <stdlib.h>
 */
 import "C"
-import "unsafe"
+import (
+	"fmt"
+	"unsafe"
+)
 
 // AddNetUnixStream adds a virtio-net device connected to a unixstream-based
 // network proxy (e.g., passt or socket_vmnet).
@@ -17,14 +20,18 @@ func (c *Context) AddNetUnixStream(cfg NetUnixConfig) error {
 		cPath = C.CString(cfg.Path)
 		defer C.free(unsafe.Pointer(cPath))
 	}
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_net_unixstream(
 			C.uint32_t(c.id), cPath, C.int(cfg.FD),
 			(*C.uint8_t)(unsafe.Pointer(&cfg.MAC[0])),
 			C.uint32_t(cfg.Features), C.uint32_t(cfg.Flags),
 		),
 		"krun_add_net_unixstream",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) { s.nets = append(s.nets, netHost(cfg)) })
+	return nil
 }
 
 // AddNetUnixGram adds a virtio-net device with a unixgram-based backend
@@ -36,28 +43,36 @@ func (c *Context) AddNetUnixGram(cfg NetUnixConfig) error {
 		cPath = C.CString(cfg.Path)
 		defer C.free(unsafe.Pointer(cPath))
 	}
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_net_unixgram(
 			C.uint32_t(c.id), cPath, C.int(cfg.FD),
 			(*C.uint8_t)(unsafe.Pointer(&cfg.MAC[0])),
 			C.uint32_t(cfg.Features), C.uint32_t(cfg.Flags),
 		),
 		"krun_add_net_unixgram",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) { s.nets = append(s.nets, netHost(cfg)) })
+	return nil
 }
 
 // AddNetTap adds a virtio-net device with the TAP backend.
 func (c *Context) AddNetTap(cfg NetTapConfig) error {
 	cTapName := C.CString(cfg.TapName)
 	defer C.free(unsafe.Pointer(cTapName))
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_net_tap(
 			C.uint32_t(c.id), cTapName,
 			(*C.uint8_t)(unsafe.Pointer(&cfg.MAC[0])),
 			C.uint32_t(cfg.Features), C.uint32_t(cfg.Flags),
 		),
 		"krun_add_net_tap",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) { s.nets = append(s.nets, "tap "+cfg.TapName) })
+	return nil
 }
 
 // SetNetMac sets the MAC address for the virtio-net device when using the
@@ -68,3 +83,11 @@ func (c *Context) SetNetMac(mac [6]byte) error {
 		"krun_set_net_mac",
 	)
 }
+
+// netHost describes the backend of a UNIX socket network device.
+func netHost(cfg NetUnixConfig) string {
+	if cfg.Path != "" {
+		return cfg.Path
+	}
+	return fmt.Sprintf("fd %d", cfg.FD)
+}
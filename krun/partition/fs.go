@@ -0,0 +1,58 @@
+package partition
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// ext2/3/4 superblock fields.
+const (
+	extSuperblockOffset = 1024
+	extMagic            = 0xef53
+
+	extCompatHasJournal = 0x4
+	// Features ext2 and ext3 lack: extents, 64bit, flex_bg, and huge_file,
+	// gdt_csum, dir_nlink, extra_isize and metadata_csum.
+	extIncompatExt4 = 0x40 | 0x80 | 0x200
+	extROCompatExt4 = 0x8 | 0x10 | 0x20 | 0x40 | 0x400
+)
+
+// DetectFilesystem identifies the filesystem starting at offset off in r
+// from its magic number and returns its type as passed to mount(8): "ext4",
+// "ext3", "ext2", "xfs", "btrfs", "vfat", "squashfs", "erofs" or "f2fs",
+// "swap" for a swap area, or "" if it is not recognized.
+func DetectFilesystem(r io.ReaderAt, off int64) string {
+	sb := make([]byte, 0x68)
+	if _, err := r.ReadAt(sb, off+extSuperblockOffset); err == nil && binary.LittleEndian.Uint16(sb[0x38:]) == extMagic {
+		switch {
+		case binary.LittleEndian.Uint32(sb[0x60:])&extIncompatExt4 != 0,
+			binary.LittleEndian.Uint32(sb[0x64:])&extROCompatExt4 != 0:
+			return "ext4"
+		case binary.LittleEndian.Uint32(sb[0x5c:])&extCompatHasJournal != 0:
+			return "ext3"
+		}
+		return "ext2"
+	}
+	switch {
+	case hasAt(r, off, []byte("XFSB")):
+		return "xfs"
+	case hasAt(r, off, []byte("hsqs")):
+		return "squashfs"
+	case hasAt(r, off+0x10040, []byte("_BHRfS_M")):
+		return "btrfs"
+	case hasAt(r, off+1024, []byte{0xe2, 0xe1, 0xf5, 0xe0}):
+		return "erofs"
+	case hasAt(r, off+1024, []byte{0x10, 0x20, 0xf5, 0xf2}):
+		return "f2fs"
+	case hasAt(r, off+510, []byte{0x55, 0xaa}) &&
+		(hasAt(r, off+82, []byte("FAT32   ")) || hasAt(r, off+54, []byte("FAT1"))):
+		return "vfat"
+	}
+	// The swap signature ends the first page, whatever the page size.
+	for _, page := range []int64{4096, 16384, 65536} {
+		if hasAt(r, off+page-10, []byte("SWAPSPACE2")) {
+			return "swap"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+package partition
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	gptSignature      = "EFI PART"
+	gptRevision       = 0x00010000
+	gptHeaderSize     = 92
+	gptEntryCount     = 128
+	gptEntrySize      = 128
+	gptEntrySectors   = gptEntryCount * gptEntrySize / SectorSize
+	gptTrailerSectors = gptEntrySectors + 1 // backup entries + backup header
+	gptNameUnits      = 36
+
+	mbrEntryOffset       = 446
+	mbrTypeGPTProtective = 0xee
+)
+
+// WriteGPT writes a protective MBR plus primary and backup GPT describing t
+// to a disk of diskSize bytes. Partition data is not touched. Zero GUIDs in
+// t are replaced with random ones.
+func WriteGPT(w io.WriterAt, diskSize int64, t Table) error {
+	if diskSize%SectorSize != 0 {
+		return fmt.Errorf("partition: disk size %d is not a multiple of %d", diskSize, SectorSize)
+	}
+	if len(t.Partitions) > gptEntryCount {
+		return fmt.Errorf("partition: too many partitions (%d > %d)", len(t.Partitions), gptEntryCount)
+	}
+	sectors := uint64(diskSize / SectorSize)
+	if sectors < 2*gptTrailerSectors+2 {
+		return errors.New("partition: disk too small for GPT")
+	}
+	lastLBA := sectors - 1
+	firstUsable := uint64(2 + gptEntrySectors)
+	lastUsable := lastLBA - gptTrailerSectors
+
+	entries := make([]byte, gptEntryCount*gptEntrySize)
+	for i, p := range t.Partitions {
+		if p.Start%SectorSize != 0 || p.Size%SectorSize != 0 || p.Size <= 0 {
+			return fmt.Errorf("partition: partition %d is not sector aligned", i+1)
+		}
+		first := uint64(p.Start / SectorSize)
+		last := first + uint64(p.Size/SectorSize) - 1
+		if first < firstUsable || last > lastUsable {
+			return fmt.Errorf("partition: partition %d lies outside the usable range", i+1)
+		}
+		guid := p.GUID
+		if guid.IsZero() {
+			guid = NewGUID()
+		}
+		units := utf16.Encode([]rune(p.Name))
+		if len(units) > gptNameUnits {
+			return fmt.Errorf("partition: name of partition %d is too long", i+1)
+		}
+
+		e := entries[i*gptEntrySize : (i+1)*gptEntrySize]
+		copy(e[0:16], p.Type[:])
+		copy(e[16:32], guid[:])
+		binary.LittleEndian.PutUint64(e[32:], first)
+		binary.LittleEndian.PutUint64(e[40:], last)
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		for j, u := range units {
+			binary.LittleEndian.PutUint16(e[56+2*j:], u)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	diskGUID := t.DiskGUID
+	if diskGUID.IsZero() {
+		diskGUID = NewGUID()
+	}
+	header := func(self, alternate, entriesLBA uint64) []byte {
+		h := make([]byte, SectorSize)
+		copy(h[0:8], gptSignature)
+		binary.LittleEndian.PutUint32(h[8:], gptRevision)
+		binary.LittleEndian.PutUint32(h[12:], gptHeaderSize)
+		binary.LittleEndian.PutUint64(h[24:], self)
+		binary.LittleEndian.PutUint64(h[32:], alternate)
+		binary.LittleEndian.PutUint64(h[40:], firstUsable)
+		binary.LittleEndian.PutUint64(h[48:], lastUsable)
+		copy(h[56:72], diskGUID[:])
+		binary.LittleEndian.PutUint64(h[72:], entriesLBA)
+		binary.LittleEndian.PutUint32(h[80:], gptEntryCount)
+		binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+		binary.LittleEndian.PutUint32(h[88:], entriesCRC)
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:gptHeaderSize]))
+		return h
+	}
+
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, protectiveMBR(sectors)},
+		{1, header(1, lastLBA, 2)},
+		{2, entries},
+		{lastLBA - gptEntrySectors, entries},
+		{lastLBA, header(lastLBA, 1, lastLBA-gptEntrySectors)},
+	}
+	for _, wr := range writes {
+		if _, err := w.WriteAt(wr.data, int64(wr.lba)*SectorSize); err != nil {
+			return fmt.Errorf("partition: write GPT: %w", err)
+		}
+	}
+	return nil
+}
+
+// protectiveMBR returns an MBR with a single 0xEE partition spanning the disk.
+func protectiveMBR(sectors uint64) []byte {
+	mbr := make([]byte, SectorSize)
+	e := mbr[mbrEntryOffset:]
+	copy(e[1:4], []byte{0x00, 0x02, 0x00}) // CHS of LBA 1
+	e[4] = mbrTypeGPTProtective
+	copy(e[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(e[8:], 1)
+	binary.LittleEndian.PutUint32(e[12:], uint32(min(sectors-1, 0xffffffff)))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
@@ -0,0 +1,104 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGUIDRoundTrip(t *testing.T) {
+	const s = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	g, err := ParseGUID(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mixed-endian on-disk encoding.
+	want := []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+	if !bytes.Equal(g[:], want) {
+		t.Errorf("encoded = % x, want % x", g[:], want)
+	}
+	if g.String() != s {
+		t.Errorf("String() = %q, want %q", g.String(), s)
+	}
+	if _, err := ParseGUID("not-a-guid"); err == nil {
+		t.Error("ParseGUID accepted garbage")
+	}
+}
+
+func TestWriteGPT(t *testing.T) {
+	const size = 8 << 20
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	first, end := UsableRange(size)
+	err = WriteGPT(f, size, Table{Partitions: []Partition{{
+		Type:  TypeLinuxFilesystem,
+		Name:  "root",
+		Start: first,
+		Size:  end - first,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk[510] != 0x55 || disk[511] != 0xaa || disk[446+4] != 0xee {
+		t.Error("protective MBR missing")
+	}
+
+	lastLBA := uint64(size/SectorSize - 1)
+	for _, lba := range []uint64{1, lastLBA} {
+		h := disk[lba*SectorSize : lba*SectorSize+gptHeaderSize]
+		if string(h[:8]) != gptSignature {
+			t.Fatalf("LBA %d: signature = %q", lba, h[:8])
+		}
+		if self := binary.LittleEndian.Uint64(h[24:]); self != lba {
+			t.Errorf("LBA %d: MyLBA = %d", lba, self)
+		}
+		hc := bytes.Clone(h)
+		binary.LittleEndian.PutUint32(hc[16:], 0)
+		if got, want := binary.LittleEndian.Uint32(h[16:]), crc32.ChecksumIEEE(hc); got != want {
+			t.Errorf("LBA %d: header CRC = %#x, want %#x", lba, got, want)
+		}
+		entriesLBA := binary.LittleEndian.Uint64(h[72:])
+		entries := disk[entriesLBA*SectorSize : entriesLBA*SectorSize+gptEntryCount*gptEntrySize]
+		if got, want := binary.LittleEndian.Uint32(h[88:]), crc32.ChecksumIEEE(entries); got != want {
+			t.Errorf("LBA %d: entries CRC = %#x, want %#x", lba, got, want)
+		}
+		if !bytes.Equal(entries[:16], TypeLinuxFilesystem[:]) {
+			t.Errorf("LBA %d: partition type = % x", lba, entries[:16])
+		}
+		if start := binary.LittleEndian.Uint64(entries[32:]); start != uint64(first/SectorSize) {
+			t.Errorf("LBA %d: first LBA = %d", lba, start)
+		}
+	}
+}
+
+func TestWriteGPT_OutOfRange(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = WriteGPT(f, 4<<20, Table{Partitions: []Partition{{
+		Type:  TypeLinuxFilesystem,
+		Start: Alignment,
+		Size:  4 << 20,
+	}}})
+	if err == nil {
+		t.Fatal("WriteGPT accepted a partition past the end of the disk")
+	}
+}
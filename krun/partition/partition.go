@@ -0,0 +1,128 @@
+// Package partition reads and writes partition tables in raw disk images.
+//
+// Disks created with [WriteGPT] expose their first partition to the guest
+// as /dev/vda1, the device usually passed to SetRootDiskRemount.
+// [ReadTable] lists the GPT or MBR partitions of an existing image with
+// the filesystem each one holds.
+package partition
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// SectorSize is the logical sector size assumed for all disk images.
+const SectorSize = 512
+
+// Alignment is the default partition alignment (1 MiB), matching what
+// fdisk, sgdisk and parted use.
+const Alignment = 1 << 20
+
+// GUID is a GPT globally unique identifier in its on-disk (mixed-endian) form.
+type GUID [16]byte
+
+// Well-known partition type GUIDs.
+var (
+	TypeLinuxFilesystem = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	TypeEFISystem       = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	TypeLinuxSwap       = MustParseGUID("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+
+	// Root partition types from the Discoverable Partitions Specification.
+	TypeLinuxRootAMD64   = MustParseGUID("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+	TypeLinuxRootARM64   = MustParseGUID("B921B045-1DF0-41C3-AF44-4C6F280D3FAE")
+	TypeLinuxRootRISCV64 = MustParseGUID("72EC70A6-CF74-40E6-BD49-4BDA08E8F224")
+)
+
+// ParseGUID parses a GUID in the canonical textual form
+// "XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX".
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 ||
+		len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return g, fmt.Errorf("partition: invalid GUID %q", s)
+	}
+	raw, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return g, fmt.Errorf("partition: invalid GUID %q", s)
+	}
+	// The first three fields are stored little-endian.
+	binary.LittleEndian.PutUint32(g[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(g[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(g[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(g[8:], raw[8:])
+	return g, nil
+}
+
+// MustParseGUID is like [ParseGUID] but panics if s cannot be parsed.
+func MustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// NewGUID returns a random (version 4) GUID.
+func NewGUID() GUID {
+	var g GUID
+	rand.Read(g[:])
+	// Version and variant bits live in the little-endian third field
+	// and the big-endian fourth field respectively.
+	g[7] = g[7]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return g
+}
+
+// IsZero reports whether g is the all-zero GUID.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+// Partition describes a single partition. Offsets and sizes are in bytes.
+type Partition struct {
+	Type       GUID
+	GUID       GUID // zero = random when writing
+	Name       string
+	Start      int64
+	Size       int64
+	Attributes uint64
+
+	// The fields below are set by ReadTable and ignored when writing.
+
+	// Number is the partition number the guest kernel uses, as in
+	// /dev/vda1: the GPT entry index plus one, or for MBR 1-4 for primary
+	// and 5 onwards for logical partitions.
+	Number int
+	// MBRType is the partition type byte of an MBR partition.
+	MBRType byte
+	// FSType is the filesystem found in the partition; see
+	// [DetectFilesystem].
+	FSType string
+}
+
+// Table is a partition table.
+type Table struct {
+	DiskGUID   GUID // zero = random when writing
+	Partitions []Partition
+	MBR        bool // read from an MBR rather than a GPT
+}
+
+// UsableRange returns the byte range [first, end) that GPT partitions may
+// occupy on a disk of diskSize bytes, with first aligned to [Alignment].
+func UsableRange(diskSize int64) (first, end int64) {
+	first = Alignment
+	end = (diskSize/SectorSize - gptTrailerSectors) * SectorSize
+	return first, end
+}
@@ -0,0 +1,242 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+// ErrNoTable is returned by [ReadTable] for disks without an MBR or GPT
+// partition table.
+var ErrNoTable = errors.New("partition: no partition table")
+
+// MBR partition types with a meaning to ReadTable.
+const (
+	MBRTypeLinux        = 0x83
+	mbrTypeExtendedCHS  = 0x05
+	mbrTypeExtendedLBA  = 0x0f
+	mbrTypeExtendedLnx  = 0x85
+	mbrMaxLogical       = 128
+	gptMaxEntries       = 1024
+	gptMinEntrySize     = 128
+	firstLogicalPartNum = 5
+)
+
+// ReadTable reads the GPT or MBR partition table of a disk of diskSize
+// bytes. A GPT is read from the primary header, or from the backup if the
+// primary is damaged; logical partitions in an MBR extended partition are
+// included. Each partition's filesystem is identified with
+// [DetectFilesystem].
+func ReadTable(r io.ReaderAt, diskSize int64) (*Table, error) {
+	mbr := make([]byte, SectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrNoTable
+		}
+		return nil, fmt.Errorf("partition: %w", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, ErrNoTable
+	}
+	entries, ok := mbrEntries(mbr)
+	if !ok {
+		return nil, ErrNoTable
+	}
+
+	var t *Table
+	var err error
+	if entries[0][4] == mbrTypeGPTProtective {
+		t, err = readGPT(r, diskSize)
+	} else {
+		t, err = readMBR(r, entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range t.Partitions {
+		p := &t.Partitions[i]
+		if p.MBRType == 0 || !isExtended(p.MBRType) {
+			p.FSType = DetectFilesystem(r, p.Start)
+		}
+	}
+	return t, nil
+}
+
+// mbrEntries returns the four primary entries of mbr, and whether they
+// look like a partition table rather than, say, a FAT boot sector.
+func mbrEntries(mbr []byte) ([4][]byte, bool) {
+	var entries [4][]byte
+	used := false
+	for i := range entries {
+		e := mbr[mbrEntryOffset+16*i : mbrEntryOffset+16*(i+1)]
+		if e[0] != 0 && e[0] != 0x80 {
+			return entries, false
+		}
+		entries[i] = e
+		used = used || e[4] != 0
+	}
+	return entries, used
+}
+
+func readGPT(r io.ReaderAt, diskSize int64) (*Table, error) {
+	lastLBA := uint64(diskSize/SectorSize) - 1
+	var errs []error
+	for _, lba := range []uint64{1, lastLBA} {
+		t, err := readGPTAt(r, lba)
+		if err == nil {
+			return t, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("partition: invalid GPT: %w", errors.Join(errs...))
+}
+
+func readGPTAt(r io.ReaderAt, lba uint64) (*Table, error) {
+	h := make([]byte, SectorSize)
+	if _, err := r.ReadAt(h, int64(lba)*SectorSize); err != nil {
+		return nil, err
+	}
+	if string(h[0:8]) != gptSignature {
+		return nil, fmt.Errorf("header at LBA %d: bad signature", lba)
+	}
+	size := binary.LittleEndian.Uint32(h[12:])
+	if size < gptHeaderSize || size > SectorSize {
+		return nil, fmt.Errorf("header at LBA %d: bad size %d", lba, size)
+	}
+	sum := binary.LittleEndian.Uint32(h[16:])
+	binary.LittleEndian.PutUint32(h[16:], 0)
+	if crc32.ChecksumIEEE(h[:size]) != sum {
+		return nil, fmt.Errorf("header at LBA %d: bad checksum", lba)
+	}
+
+	t := &Table{}
+	copy(t.DiskGUID[:], h[56:72])
+	entriesLBA := binary.LittleEndian.Uint64(h[72:])
+	count := binary.LittleEndian.Uint32(h[80:])
+	entrySize := binary.LittleEndian.Uint32(h[84:])
+	if count > gptMaxEntries || entrySize < gptMinEntrySize || entrySize%8 != 0 || entrySize > SectorSize {
+		return nil, fmt.Errorf("header at LBA %d: bad entry array", lba)
+	}
+	entries := make([]byte, count*entrySize)
+	if _, err := r.ReadAt(entries, int64(entriesLBA)*SectorSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(h[88:]) {
+		return nil, fmt.Errorf("header at LBA %d: bad entry array checksum", lba)
+	}
+
+	for i := range int(count) {
+		e := entries[i*int(entrySize) : (i+1)*int(entrySize)]
+		var p Partition
+		copy(p.Type[:], e[0:16])
+		if p.Type.IsZero() {
+			continue
+		}
+		copy(p.GUID[:], e[16:32])
+		first := binary.LittleEndian.Uint64(e[32:])
+		last := binary.LittleEndian.Uint64(e[40:])
+		p.Number = i + 1
+		p.Start = int64(first) * SectorSize
+		p.Size = int64(last-first+1) * SectorSize
+		p.Attributes = binary.LittleEndian.Uint64(e[48:])
+		units := make([]uint16, gptNameUnits)
+		for j := range units {
+			units[j] = binary.LittleEndian.Uint16(e[56+2*j:])
+		}
+		if n := indexZero(units); n >= 0 {
+			units = units[:n]
+		}
+		p.Name = string(utf16.Decode(units))
+		t.Partitions = append(t.Partitions, p)
+	}
+	return t, nil
+}
+
+func indexZero(units []uint16) int {
+	for i, u := range units {
+		if u == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func readMBR(r io.ReaderAt, entries [4][]byte) (*Table, error) {
+	t := &Table{MBR: true}
+	for i, e := range entries {
+		if e[4] == 0 {
+			continue
+		}
+		p := mbrPartition(e, 0)
+		p.Number = i + 1
+		t.Partitions = append(t.Partitions, p)
+		if isExtended(p.MBRType) {
+			logical, err := readLogical(r, p)
+			if err != nil {
+				return nil, err
+			}
+			t.Partitions = append(t.Partitions, logical...)
+		}
+	}
+	return t, nil
+}
+
+// readLogical follows the chain of extended boot records of the extended
+// partition ext. Every link must lead to a record inside ext not visited
+// before, so a corrupt or hostile chain cannot loop.
+func readLogical(r io.ReaderAt, ext Partition) ([]Partition, error) {
+	var parts []Partition
+	ebr := make([]byte, SectorSize)
+	visited := make(map[int64]bool)
+	for off := ext.Start; len(visited) < mbrMaxLogical; {
+		visited[off] = true
+		if _, err := r.ReadAt(ebr, off); err != nil {
+			return nil, fmt.Errorf("partition: extended boot record: %w", err)
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			return nil, errors.New("partition: invalid extended boot record")
+		}
+		first, next := ebr[mbrEntryOffset:mbrEntryOffset+16], ebr[mbrEntryOffset+16:mbrEntryOffset+32]
+		if first[4] != 0 {
+			p := mbrPartition(first, off)
+			p.Number = firstLogicalPartNum + len(parts)
+			parts = append(parts, p)
+		}
+		if next[4] == 0 {
+			return parts, nil
+		}
+		// Links are relative to the start of the extended partition.
+		rel := int64(binary.LittleEndian.Uint32(next[8:])) * SectorSize
+		if rel+SectorSize > ext.Size {
+			return nil, errors.New("partition: extended boot record link outside the extended partition")
+		}
+		off = ext.Start + rel
+		if visited[off] {
+			return nil, errors.New("partition: extended boot record chain loops")
+		}
+	}
+	return nil, errors.New("partition: extended boot record chain too long")
+}
+
+func mbrPartition(e []byte, base int64) Partition {
+	return Partition{
+		MBRType: e[4],
+		Start:   base + int64(binary.LittleEndian.Uint32(e[8:]))*SectorSize,
+		Size:    int64(binary.LittleEndian.Uint32(e[12:])) * SectorSize,
+	}
+}
+
+func isExtended(t byte) bool {
+	return t == mbrTypeExtendedCHS || t == mbrTypeExtendedLBA || t == mbrTypeExtendedLnx
+}
+
+// hasAt reports whether the bytes at off in r equal magic.
+func hasAt(r io.ReaderAt, off int64, magic []byte) bool {
+	buf := make([]byte, len(magic))
+	_, err := r.ReadAt(buf, off)
+	return err == nil && bytes.Equal(buf, magic)
+}
@@ -0,0 +1,192 @@
+package partition
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// memDisk is an in-memory disk image.
+type memDisk []byte
+
+func (d memDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d)) {
+		return 0, os.ErrNotExist
+	}
+	n := copy(p, d[off:])
+	if n < len(p) {
+		return n, errors.New("short read")
+	}
+	return n, nil
+}
+
+func (d memDisk) WriteAt(p []byte, off int64) (int, error) {
+	return copy(d[off:], p), nil
+}
+
+// putExt4 writes an ext4 superblock magic and extents feature at off.
+func putExt4(d memDisk, off int64) {
+	sb := d[off+extSuperblockOffset:]
+	binary.LittleEndian.PutUint16(sb[0x38:], extMagic)
+	binary.LittleEndian.PutUint32(sb[0x60:], 0x40)
+}
+
+func TestReadGPT(t *testing.T) {
+	const size = 8 << 20
+	d := make(memDisk, size)
+	first, end := UsableRange(size)
+	mid := first + (end-first)/2/SectorSize*SectorSize
+	err := WriteGPT(d, size, Table{Partitions: []Partition{
+		{Type: TypeEFISystem, Name: "esp", Start: first, Size: mid - first},
+		{Type: TypeLinuxRootAMD64, Name: "root ✓", Start: mid, Size: end - mid},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putExt4(d, mid)
+
+	check := func(t *testing.T) {
+		tbl, err := ReadTable(d, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tbl.MBR || len(tbl.Partitions) != 2 {
+			t.Fatalf("table = %+v", tbl)
+		}
+		p := tbl.Partitions[1]
+		if p.Number != 2 || p.Type != TypeLinuxRootAMD64 || p.Name != "root ✓" || p.Start != mid || p.Size != end-mid || p.FSType != "ext4" {
+			t.Errorf("partition 2 = %+v", p)
+		}
+		if tbl.Partitions[0].FSType != "" {
+			t.Errorf("partition 1 FSType = %q", tbl.Partitions[0].FSType)
+		}
+	}
+	t.Run("primary", check)
+	// A damaged primary header falls back to the backup.
+	d[SectorSize+20] ^= 0xff
+	t.Run("backup", check)
+}
+
+func TestReadMBR(t *testing.T) {
+	const size = 16 << 20
+	d := make(memDisk, size)
+	entry := func(sector []byte, i int, typ byte, startLBA, sectors uint32) {
+		e := sector[mbrEntryOffset+16*i:]
+		e[4] = typ
+		binary.LittleEndian.PutUint32(e[8:], startLBA)
+		binary.LittleEndian.PutUint32(e[12:], sectors)
+		sector[510], sector[511] = 0x55, 0xaa
+	}
+	entry(d, 0, MBRTypeLinux, 2048, 4096)
+	entry(d, 1, mbrTypeExtendedLBA, 8192, 16384)
+	// Two logical partitions: 5 at 8192+2048, 6 at 16384+2048.
+	ebr1 := d[8192*SectorSize:]
+	entry(ebr1, 0, MBRTypeLinux, 2048, 2048)
+	entry(ebr1, 1, mbrTypeExtendedCHS, 8192, 8192)
+	ebr2 := d[16384*SectorSize:]
+	entry(ebr2, 0, 0x82, 2048, 2048)
+	putExt4(d, 10240*SectorSize)
+
+	tbl, err := ReadTable(d, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		number int
+		typ    byte
+		start  int64
+		fs     string
+	}{
+		{1, MBRTypeLinux, 2048 * SectorSize, ""},
+		{2, mbrTypeExtendedLBA, 8192 * SectorSize, ""},
+		{5, MBRTypeLinux, 10240 * SectorSize, "ext4"},
+		{6, 0x82, 18432 * SectorSize, ""},
+	}
+	if !tbl.MBR || len(tbl.Partitions) != len(want) {
+		t.Fatalf("table = %+v", tbl)
+	}
+	for i, w := range want {
+		p := tbl.Partitions[i]
+		if p.Number != w.number || p.MBRType != w.typ || p.Start != w.start || p.FSType != w.fs {
+			t.Errorf("partition %d = %+v", i, p)
+		}
+	}
+}
+
+func TestReadTableNone(t *testing.T) {
+	d := make(memDisk, 1<<20)
+	putExt4(d, 0)
+	if _, err := ReadTable(d, int64(len(d))); !errors.Is(err, ErrNoTable) {
+		t.Errorf("err = %v, want ErrNoTable", err)
+	}
+	if fs := DetectFilesystem(d, 0); fs != "ext4" {
+		t.Errorf("DetectFilesystem = %q", fs)
+	}
+}
+
+func TestDetectFilesystem(t *testing.T) {
+	tests := map[string]func(d memDisk){
+		"ext2":     func(d memDisk) { binary.LittleEndian.PutUint16(d[1024+0x38:], extMagic) },
+		"ext3":     func(d memDisk) { binary.LittleEndian.PutUint16(d[1024+0x38:], extMagic); d[1024+0x5c] = 4 },
+		"xfs":      func(d memDisk) { copy(d, "XFSB") },
+		"btrfs":    func(d memDisk) { copy(d[0x10040:], "_BHRfS_M") },
+		"squashfs": func(d memDisk) { copy(d, "hsqs") },
+		"erofs":    func(d memDisk) { copy(d[1024:], []byte{0xe2, 0xe1, 0xf5, 0xe0}) },
+		"vfat":     func(d memDisk) { copy(d[82:], "FAT32   "); d[510], d[511] = 0x55, 0xaa },
+		"swap":     func(d memDisk) { copy(d[4086:], "SWAPSPACE2") },
+		"":         func(memDisk) {},
+	}
+	for want, setup := range tests {
+		d := make(memDisk, 1<<20)
+		setup(d)
+		if got := DetectFilesystem(d, 0); got != want {
+			t.Errorf("DetectFilesystem = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestReadMBR_BadChain(t *testing.T) {
+	const size = 16 << 20
+	for _, tc := range []struct {
+		name  string
+		links []uint32 // next link of the EBR at 8192, then of the one it leads to
+	}{
+		{"self", []uint32{0}},
+		{"cycle", []uint32{4096, 0}},
+		{"outside", []uint32{1 << 20}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := make(memDisk, size)
+			d[mbrEntryOffset+4] = mbrTypeExtendedLBA
+			binary.LittleEndian.PutUint32(d[mbrEntryOffset+8:], 8192)
+			binary.LittleEndian.PutUint32(d[mbrEntryOffset+12:], 16384)
+			d[510], d[511] = 0x55, 0xaa
+			off := int64(8192)
+			for _, link := range tc.links {
+				// An empty first entry and a link to the next record.
+				ebr := d[off*SectorSize:]
+				ebr[mbrEntryOffset+16+4] = mbrTypeExtendedCHS
+				binary.LittleEndian.PutUint32(ebr[mbrEntryOffset+16+8:], link)
+				binary.LittleEndian.PutUint32(ebr[mbrEntryOffset+16+12:], 2048)
+				ebr[510], ebr[511] = 0x55, 0xaa
+				off = 8192 + int64(link)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := ReadTable(d, size)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("ReadTable accepted the chain")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ReadTable did not return")
+			}
+		})
+	}
+}
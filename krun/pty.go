@@ -0,0 +1,249 @@
+package krun
+
+/*
+#define _XOPEN_SOURCE 600
+#include <fcntl.h>
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// PTY is a pseudo-terminal pair. The VM gets the slave as a TTY console
+// port; the host reads and writes the master.
+type PTY struct {
+	Master *os.File
+	Slave  *os.File
+}
+
+// ptsnameMu guards ptsname's static buffer.
+var ptsnameMu sync.Mutex
+
+// OpenPTY allocates a pseudo-terminal pair. The slave is in raw mode, so
+// the host side passes bytes through unchanged and line editing and echo
+// are left to the guest's terminal.
+func OpenPTY() (*PTY, error) {
+	fd, err := C.posix_openpt(C.O_RDWR | C.O_NOCTTY)
+	if fd < 0 {
+		return nil, fmt.Errorf("krun: posix_openpt: %w", err)
+	}
+	if err := unix.SetNonblock(int(fd), true); err != nil {
+		unix.Close(int(fd))
+		return nil, fmt.Errorf("krun: %w", err)
+	}
+	// Non-blocking, so that reads can be given a deadline.
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	if ret, err := C.grantpt(fd); ret != 0 {
+		master.Close()
+		return nil, fmt.Errorf("krun: grantpt: %w", err)
+	}
+	if ret, err := C.unlockpt(fd); ret != 0 {
+		master.Close()
+		return nil, fmt.Errorf("krun: unlockpt: %w", err)
+	}
+	ptsnameMu.Lock()
+	cName, err := C.ptsname(fd)
+	name := C.GoString(cName)
+	ptsnameMu.Unlock()
+	if cName == nil {
+		master.Close()
+		return nil, fmt.Errorf("krun: ptsname: %w", err)
+	}
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("krun: %w", err)
+	}
+	if _, err := makeRaw(int(slave.Fd())); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, err
+	}
+	return &PTY{Master: master, Slave: slave}, nil
+}
+
+// Resize sets the terminal size the guest sees.
+func (p *PTY) Resize(rows, cols uint16) error {
+	ws := &unix.Winsize{Row: rows, Col: cols}
+	if err := unix.IoctlSetWinsize(int(p.Master.Fd()), unix.TIOCSWINSZ, ws); err != nil {
+		return fmt.Errorf("krun: resize pty: %w", err)
+	}
+	return nil
+}
+
+// Size returns the terminal size the guest sees.
+func (p *PTY) Size() (rows, cols uint16, err error) {
+	ws, err := unix.IoctlGetWinsize(int(p.Master.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0, fmt.Errorf("krun: pty size: %w", err)
+	}
+	return ws.Row, ws.Col, nil
+}
+
+// Close closes both ends.
+func (p *PTY) Close() error {
+	err := p.Master.Close()
+	if serr := p.Slave.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// ConsolePortPTYConfig configures a TTY port on a multi-port
+// virtio-console device backed by a new pseudo-terminal.
+type ConsolePortPTYConfig struct {
+	ConsoleID uint32
+	Name      string
+	// Stdin and Stdout connect the port to the host, usually os.Stdin and
+	// os.Stdout. If Stdin is a terminal, it is in raw mode until the VM
+	// exits, and its size changes are forwarded to the guest. Either may
+	// be nil, leaving that direction to the caller through PTY.Master.
+	Stdin  *os.File
+	Stdout io.Writer
+	// OnResize, if set, is called with the size forwarded to the guest:
+	// first the terminal's initial size, then each change.
+	OnResize func(rows, cols uint16)
+}
+
+// AddConsolePortPTY allocates a pseudo-terminal, adds its slave as a TTY
+// port with [Context.AddConsolePortTTY], and copies between the master and
+// cfg.Stdin and cfg.Stdout until the VM exits. With a terminal on Stdin, an
+// interactive shell in the guest behaves like a local one: keys reach it
+// unprocessed, and resizing the host window resizes the guest's.
+//
+// The host terminal's mode is restored when the VM exits. Output still
+// buffered then is copied before the [Context.OnExit] functions
+// registered earlier run.
+//
+// The VMM learns of a new size from a SIGWINCH, but the pty is no
+// process's controlling terminal, so each time the host terminal is
+// resized this process signals itself. Other users of
+// signal.Notify(SIGWINCH) in the program see one extra signal per resize.
+func (c *Context) AddConsolePortPTY(cfg ConsolePortPTYConfig) (*PTY, error) {
+	p, err := OpenPTY()
+	if err != nil {
+		return nil, err
+	}
+	t := &ptyTerminal{pty: p, term: -1, onResize: cfg.OnResize}
+	if cfg.Stdin != nil && isTerminal(int(cfg.Stdin.Fd())) {
+		// Before the port is added: once libkrun has the slave, it must
+		// stay open.
+		t.term = int(cfg.Stdin.Fd())
+		if t.restore, err = makeRaw(t.term); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	if err := c.AddConsolePortTTY(ConsolePortTTYConfig{
+		ConsoleID: cfg.ConsoleID, Name: cfg.Name, TTYFD: int(p.Slave.Fd()),
+	}); err != nil {
+		if t.restore != nil {
+			unix.IoctlSetTermios(t.term, ioctlSetTermios, t.restore)
+		}
+		p.Close()
+		return nil, err
+	}
+
+	if t.term >= 0 {
+		t.resize()
+		t.winch = make(chan os.Signal, 1)
+		signal.Notify(t.winch, unix.SIGWINCH)
+		go func() {
+			for range t.winch {
+				t.resize()
+			}
+		}()
+	}
+	if cfg.Stdin != nil {
+		// Ends when Stdin does, or at the first write after the VM is gone.
+		go io.Copy(p.Master, cfg.Stdin)
+	}
+	if cfg.Stdout != nil {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			copyOutput(cfg.Stdout, p.Master)
+		}()
+	}
+	c.OnExit(t.stop)
+	return p, nil
+}
+
+// ptyTerminal connects a PTY to the host terminal for the VM's lifetime.
+type ptyTerminal struct {
+	pty      *PTY
+	term     int // host terminal, or -1
+	onResize func(rows, cols uint16)
+	restore  *unix.Termios
+	winch    chan os.Signal
+	wg       sync.WaitGroup
+}
+
+// resize copies the host terminal's size to the pty.
+func (t *ptyTerminal) resize() {
+	ws, err := unix.IoctlGetWinsize(t.term, unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+	if rows, cols, err := t.pty.Size(); err == nil && rows == ws.Row && cols == ws.Col {
+		return
+	}
+	if t.pty.Resize(ws.Row, ws.Col) != nil {
+		return
+	}
+	if t.onResize != nil {
+		t.onResize(ws.Row, ws.Col)
+	}
+	// The pty is no process's controlling terminal, so no one is told
+	// about the change: signal this process again for the VMM, which
+	// reads the size from the pty on SIGWINCH. The size now matches, so
+	// that signal ends here.
+	unix.Kill(os.Getpid(), unix.SIGWINCH)
+}
+
+func (t *ptyTerminal) stop() {
+	if t.winch != nil {
+		signal.Stop(t.winch)
+		close(t.winch)
+	}
+	if t.restore != nil {
+		unix.IoctlSetTermios(t.term, ioctlSetTermios, t.restore)
+	}
+	stopOutput(t.pty.Master)
+	t.wg.Wait()
+	t.pty.Close()
+}
+
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	return err == nil
+}
+
+// makeRaw puts the terminal fd into raw mode, as cfmakeraw(3) does, and
+// returns the previous state.
+func makeRaw(fd int) (*unix.Termios, error) {
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, fmt.Errorf("krun: raw mode: %w", err)
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, fmt.Errorf("krun: raw mode: %w", err)
+	}
+	return old, nil
+}
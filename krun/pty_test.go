@@ -0,0 +1,101 @@
+package krun
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenPTY(t *testing.T) {
+	p, err := OpenPTY()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Resize(40, 120); err != nil {
+		t.Fatal(err)
+	}
+	ws, err := unix.IoctlGetWinsize(int(p.Slave.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.Row != 40 || ws.Col != 120 {
+		t.Errorf("slave size = %dx%d, want 40x120", ws.Row, ws.Col)
+	}
+
+	// Raw: no echo, no CR/LF translation.
+	if _, err := p.Master.Write([]byte("a\r")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	n, err := p.Slave.Read(buf)
+	if err != nil || string(buf[:n]) != "a\r" {
+		t.Errorf("slave read %q, %v", buf[:n], err)
+	}
+}
+
+func TestAddConsolePortPTY(t *testing.T) {
+	ctx := newTestContext(t)
+	id, err := ctx.AddVirtioConsoleMultiport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second pty stands in for the user's terminal.
+	term, err := OpenPTY()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+	before, err := makeRaw(int(term.Slave.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before.Lflag |= unix.ECHO | unix.ICANON
+	if err := unix.IoctlSetTermios(int(term.Slave.Fd()), ioctlSetTermios, before); err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Resize(30, 100); err != nil {
+		t.Fatal(err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outR.Close()
+
+	var resized []uint16
+	p, err := ctx.AddConsolePortPTY(ConsolePortPTYConfig{
+		ConsoleID: id, Name: "console", Stdin: term.Slave, Stdout: outW,
+		OnResize: func(rows, cols uint16) { resized = append(resized, rows, cols) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resized) != 2 || resized[0] != 30 || resized[1] != 100 {
+		t.Errorf("OnResize calls = %v, want [30 100]", resized)
+	}
+	if rows, cols, err := p.Size(); err != nil || rows != 30 || cols != 100 {
+		t.Errorf("pty size = %dx%d, %v; want 30x100", rows, cols, err)
+	}
+	tio, _ := unix.IoctlGetTermios(int(term.Slave.Fd()), ioctlGetTermios)
+	if tio.Lflag&(unix.ECHO|unix.ICANON) != 0 {
+		t.Error("host terminal not in raw mode")
+	}
+
+	if _, err := p.Slave.Write([]byte("guest output")); err != nil {
+		t.Fatal(err)
+	}
+	runExitHooks(ctx.id)
+	outW.Close()
+	out, _ := io.ReadAll(outR)
+	if !bytes.Equal(out, []byte("guest output")) {
+		t.Errorf("output = %q", out)
+	}
+	tio, _ = unix.IoctlGetTermios(int(term.Slave.Fd()), ioctlGetTermios)
+	if tio.Lflag&(unix.ECHO|unix.ICANON) != unix.ECHO|unix.ICANON {
+		t.Error("host terminal mode not restored")
+	}
+}
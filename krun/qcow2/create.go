@@ -0,0 +1,216 @@
+package qcow2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Options configures [Create].
+type Options struct {
+	// Size is the virtual disk size in bytes, rounded up to a multiple of
+	// 512. With a backing file, zero means the size of the backing file.
+	Size int64
+
+	// BackingFile makes the new image an overlay. It is stored as given;
+	// relative names are resolved against the directory of the new image,
+	// as qemu-img does.
+	BackingFile string
+
+	// BackingFormat is "raw" or "qcow2". Empty means detect it from the
+	// backing file.
+	BackingFormat string
+
+	// ClusterBits is log2 of the cluster size, 9 to 21. Zero means
+	// DefaultClusterBits.
+	ClusterBits uint32
+}
+
+// Create creates a qcow2 image at path, which must not exist, and returns
+// it opened for reading and writing.
+func Create(path string, opts Options) (*Image, error) {
+	cb := opts.ClusterBits
+	if cb == 0 {
+		cb = DefaultClusterBits
+	}
+	if cb < 9 || cb > 21 {
+		return nil, fmt.Errorf("qcow2: invalid cluster bits %d", cb)
+	}
+	cs := int64(1) << cb
+
+	size := opts.Size
+	format := opts.BackingFormat
+	if opts.BackingFile != "" {
+		if len(opts.BackingFile) > maxBackingName {
+			return nil, fmt.Errorf("qcow2: backing file name too long")
+		}
+		bsize, bformat, err := inspectBacking(BackingPath(path, opts.BackingFile))
+		if err != nil {
+			return nil, fmt.Errorf("qcow2: backing file: %w", err)
+		}
+		if format == "" {
+			format = bformat
+		} else if format != bformat {
+			return nil, fmt.Errorf("qcow2: backing file is %s, not %s", bformat, format)
+		}
+		if size == 0 {
+			size = bsize
+		}
+	} else if format != "" {
+		return nil, errors.New("qcow2: BackingFormat set without BackingFile")
+	}
+	if size <= 0 {
+		return nil, errors.New("qcow2: size must be positive")
+	}
+	size = (size + 511) &^ 511
+
+	// Layout: header, refcount table, refcount block, L1 table.
+	l1Size := (size + cs*(cs/8) - 1) / (cs * (cs / 8))
+	l1Clusters := (l1Size*8 + cs - 1) / cs
+	const (
+		reftableCluster = 1
+		refblockCluster = 2
+		l1Cluster       = 3
+	)
+	clusters := l1Cluster + l1Clusters
+	if clusters > cs/2 {
+		return nil, fmt.Errorf("qcow2: size %d too large for %d-byte clusters", size, cs)
+	}
+
+	hdr := encodeHeader(cb, size, l1Size, l1Cluster*cs, reftableCluster*cs, opts.BackingFile, format)
+	if int64(len(hdr)) > cs {
+		return nil, fmt.Errorf("qcow2: header does not fit in a %d-byte cluster", cs)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+	err = writeLayout(f, cs, hdr, clusters, reftableCluster, refblockCluster)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+
+	img, err := OpenFile(path, os.O_RDWR)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return img, nil
+}
+
+// encodeHeader encodes the version 3 header, header extensions and backing
+// file name.
+func encodeHeader(cb uint32, size, l1Size, l1Offset, reftableOffset int64, backing, format string) []byte {
+	buf := make([]byte, headerLength)
+	copy(buf, Magic)
+	be.PutUint32(buf[4:], 3)
+	be.PutUint32(buf[20:], cb)
+	be.PutUint64(buf[24:], uint64(size))
+	be.PutUint32(buf[36:], uint32(l1Size))
+	be.PutUint64(buf[40:], uint64(l1Offset))
+	be.PutUint64(buf[48:], uint64(reftableOffset))
+	be.PutUint32(buf[56:], 1)
+	be.PutUint32(buf[96:], refcountOrder)
+	be.PutUint32(buf[100:], headerLength)
+
+	if format != "" {
+		buf = appendExtension(buf, extBackingFormat, []byte(format))
+	}
+	buf = appendExtension(buf, extEnd, nil)
+	if backing != "" {
+		be.PutUint64(buf[8:], uint64(len(buf)))
+		be.PutUint32(buf[16:], uint32(len(backing)))
+		buf = append(buf, backing...)
+	}
+	return buf
+}
+
+func appendExtension(buf []byte, typ uint32, data []byte) []byte {
+	buf = be.AppendUint32(buf, typ)
+	buf = be.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	return append(buf, make([]byte, (8-len(data)%8)%8)...)
+}
+
+// writeLayout writes the header and the refcount structures covering the
+// first clusters metadata clusters. The L1 table starts out zeroed.
+func writeLayout(f *os.File, cs int64, hdr []byte, clusters, reftable, refblock int64) error {
+	if err := f.Truncate(clusters * cs); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	var entry [8]byte
+	be.PutUint64(entry[:], uint64(refblock*cs))
+	if _, err := f.WriteAt(entry[:], reftable*cs); err != nil {
+		return err
+	}
+	refs := make([]byte, clusters*2)
+	for i := range clusters {
+		be.PutUint16(refs[i*2:], 1)
+	}
+	if _, err := f.WriteAt(refs, refblock*cs); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// inspectBacking returns the virtual size and format of a backing file.
+func inspectBacking(path string) (int64, string, error) {
+	format, err := probeFormat(path)
+	if err != nil {
+		return 0, "", err
+	}
+	if format == "qcow2" {
+		img, err := Open(path)
+		if err != nil {
+			return 0, "", err
+		}
+		defer img.Close()
+		return img.Size(), format, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, "", err
+	}
+	return fi.Size(), format, nil
+}
+
+// CreateOverlay creates a qcow2 image at path that records writes and reads
+// everything else from backing, a raw or qcow2 image. The overlay has the
+// size of its backing file.
+func CreateOverlay(path, backing string) error {
+	img, err := Create(path, Options{BackingFile: backing})
+	if err != nil {
+		return err
+	}
+	return img.Close()
+}
+
+// Discard deletes the overlay at path, throwing away everything written to
+// it. It refuses to delete files that are not qcow2 overlays, so a
+// misconfigured path cannot remove a base image.
+func Discard(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+	hdr, err := ReadHeader(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if hdr.BackingFile == "" {
+		return fmt.Errorf("qcow2: %s is not an overlay", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+package qcow2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxBackingDepth bounds backing chains, guarding against loops.
+const maxBackingDepth = 16
+
+// Image is an open qcow2 image. Reads fall through to the backing file for
+// clusters the image does not allocate. Image is safe for concurrent use.
+type Image struct {
+	mu       sync.Mutex
+	f        *os.File
+	hdr      *Header
+	writable bool
+	l1       []uint64
+	l2       map[int64][]uint64 // L2 tables by file offset
+	reftable []uint64
+	end      int64 // offset of the next cluster to allocate
+	size     int64 // file size when opened
+
+	backing     io.ReaderAt
+	backingSize int64
+	closers     []io.Closer
+}
+
+// Open opens the qcow2 image at path for reading.
+func Open(path string) (*Image, error) {
+	return OpenFile(path, os.O_RDONLY)
+}
+
+// OpenFile opens the qcow2 image at path. flag is os.O_RDONLY or os.O_RDWR.
+// Backing files are always opened read-only.
+func OpenFile(path string, flag int) (*Image, error) {
+	return openImage(path, flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR), 0)
+}
+
+func openImage(path string, flag, depth int) (*Image, error) {
+	if depth > maxBackingDepth {
+		return nil, fmt.Errorf("qcow2: %s: backing chain too deep", path)
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+	img := &Image{f: f, writable: flag != os.O_RDONLY, l2: make(map[int64][]uint64)}
+	if err := img.load(path, depth); err != nil {
+		img.Close()
+		return nil, fmt.Errorf("qcow2: %s: %w", path, err)
+	}
+	return img, nil
+}
+
+func (img *Image) load(path string, depth int) error {
+	hdr, err := ReadHeader(img.f)
+	if err != nil {
+		return err
+	}
+	if err := hdr.checkSupported(img.writable); err != nil {
+		return err
+	}
+	img.hdr = hdr
+	fi, err := img.f.Stat()
+	if err != nil {
+		return err
+	}
+	img.size = fi.Size()
+
+	// The L1 table must cover the virtual size; it can be larger, after a
+	// shrink, but readTable keeps it within the file.
+	cs := hdr.ClusterSize()
+	if hdr.Size < 0 {
+		return fmt.Errorf("invalid virtual size %d", hdr.Size)
+	}
+	if need := (hdr.Size + cs*(cs/8) - 1) / (cs * (cs / 8)); int64(hdr.L1Size) < need {
+		return fmt.Errorf("L1 table of %d entries too small for %d bytes", hdr.L1Size, hdr.Size)
+	}
+	img.l1, err = img.readTable(hdr.L1TableOffset, int64(hdr.L1Size))
+	if err != nil {
+		return err
+	}
+	if img.writable {
+		n := int64(hdr.RefcountTableCluster) * cs / 8
+		if img.reftable, err = img.readTable(hdr.RefcountTableOffset, n); err != nil {
+			return err
+		}
+		img.end = (img.size + cs - 1) &^ (cs - 1)
+	}
+
+	if hdr.BackingFile == "" {
+		return nil
+	}
+	bpath := BackingPath(path, hdr.BackingFile)
+	format := hdr.BackingFormat
+	if format == "" {
+		if format, err = probeFormat(bpath); err != nil {
+			return err
+		}
+	}
+	switch format {
+	case "raw":
+		bf, err := os.Open(bpath)
+		if err != nil {
+			return err
+		}
+		img.closers = append(img.closers, bf)
+		fi, err := bf.Stat()
+		if err != nil {
+			return err
+		}
+		img.backing, img.backingSize = bf, fi.Size()
+	case "qcow2":
+		bimg, err := openImage(bpath, os.O_RDONLY, depth+1)
+		if err != nil {
+			return err
+		}
+		img.closers = append(img.closers, bimg)
+		img.backing, img.backingSize = bimg, bimg.Size()
+	default:
+		return fmt.Errorf("%w: backing format %q", ErrUnsupported, format)
+	}
+	return nil
+}
+
+// readTable reads a table of entries, which must lie within the file, so
+// a corrupt header or L1 entry cannot make it allocate more.
+func (img *Image) readTable(off, entries int64) ([]uint64, error) {
+	size := max(img.size, img.end)
+	if off < 0 || off > size || entries > (size-off)/8 {
+		return nil, fmt.Errorf("table of %d entries at %#x beyond the end of the file", entries, off)
+	}
+	buf := make([]byte, entries*8)
+	if _, err := img.f.ReadAt(buf, off); err != nil {
+		return nil, fmt.Errorf("read table at %#x: %w", off, err)
+	}
+	table := make([]uint64, entries)
+	for i := range table {
+		table[i] = be.Uint64(buf[i*8:])
+	}
+	return table, nil
+}
+
+// BackingPath resolves the backing file name stored in the image at
+// imagePath. Relative names are relative to the image's directory.
+func BackingPath(imagePath, backingFile string) string {
+	if filepath.IsAbs(backingFile) {
+		return backingFile
+	}
+	return filepath.Join(filepath.Dir(imagePath), backingFile)
+}
+
+// probeFormat returns "qcow2" or "raw" depending on the file's magic.
+func probeFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := ReadHeader(f); errors.Is(err, ErrNotQcow2) {
+		return "raw", nil
+	} else if err != nil {
+		return "", err
+	}
+	return "qcow2", nil
+}
+
+// Header returns the image header.
+func (img *Image) Header() Header {
+	return *img.hdr
+}
+
+// Size returns the virtual disk size in bytes.
+func (img *Image) Size() int64 {
+	return img.hdr.Size
+}
+
+// Close closes the image and its backing files.
+func (img *Image) Close() error {
+	err := img.f.Close()
+	for _, c := range img.closers {
+		c.Close()
+	}
+	return err
+}
+
+// l2Entry returns the L2 entry for the cluster containing off, or 0 if the
+// cluster has no L2 table.
+func (img *Image) l2Entry(off int64) (uint64, error) {
+	table, _, idx, err := img.l2Table(off, false)
+	if table == nil || err != nil {
+		return 0, err
+	}
+	return table[idx], nil
+}
+
+// l2Table returns the L2 table covering off, its file offset and the index
+// of off within it. With alloc set a missing table is allocated.
+func (img *Image) l2Table(off int64, alloc bool) ([]uint64, int64, int, error) {
+	cb := img.hdr.ClusterBits
+	l2Bits := cb - 3
+	l1Idx := off >> (cb + l2Bits)
+	l2Idx := int(off>>cb) & (1<<l2Bits - 1)
+	if l1Idx >= int64(len(img.l1)) {
+		return nil, 0, 0, fmt.Errorf("qcow2: offset %#x beyond L1 table", off)
+	}
+
+	tableOff := int64(img.l1[l1Idx] & l1OffsetMask)
+	if tableOff == 0 {
+		if !alloc {
+			return nil, 0, 0, nil
+		}
+		var err error
+		if tableOff, err = img.allocCluster(); err != nil {
+			return nil, 0, 0, err
+		}
+		if err := img.writeUint64(img.hdr.L1TableOffset+l1Idx*8, uint64(tableOff)|entryCopied); err != nil {
+			return nil, 0, 0, err
+		}
+		img.l1[l1Idx] = uint64(tableOff) | entryCopied
+		img.l2[tableOff] = make([]uint64, 1<<l2Bits)
+	}
+
+	table, ok := img.l2[tableOff]
+	if !ok {
+		var err error
+		if table, err = img.readTable(tableOff, 1<<l2Bits); err != nil {
+			return nil, 0, 0, fmt.Errorf("qcow2: %w", err)
+		}
+		img.l2[tableOff] = table
+	}
+	return table, tableOff, l2Idx, nil
+}
+
+// ReadAt implements io.ReaderAt over the virtual disk.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("qcow2: negative offset %d", off)
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	cs := img.hdr.ClusterSize()
+	n := 0
+	for len(p) > 0 {
+		if off >= img.hdr.Size {
+			return n, io.EOF
+		}
+		within := off & (cs - 1)
+		chunk := min(int64(len(p)), cs-within, img.hdr.Size-off)
+		if err := img.readCluster(p[:chunk], off); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+		p = p[chunk:]
+		off += chunk
+	}
+	return n, nil
+}
+
+// readCluster reads p, which lies within a single cluster, at off.
+func (img *Image) readCluster(p []byte, off int64) error {
+	entry, err := img.l2Entry(off)
+	if err != nil {
+		return err
+	}
+	within := off & (img.hdr.ClusterSize() - 1)
+	switch {
+	case entry&entryCompr != 0:
+		return fmt.Errorf("%w: compressed clusters", ErrUnsupported)
+	case entry&entryZero != 0 && img.hdr.Version >= 3:
+		clear(p)
+	case entry&l2OffsetMask != 0:
+		if _, err := img.f.ReadAt(p, int64(entry&l2OffsetMask)+within); err != nil {
+			return fmt.Errorf("qcow2: %w", err)
+		}
+	default:
+		return img.readBacking(p, off)
+	}
+	return nil
+}
+
+// readBacking reads p at off from the backing file; anything past its end
+// reads as zeros.
+func (img *Image) readBacking(p []byte, off int64) error {
+	clear(p)
+	if img.backing == nil || off >= img.backingSize {
+		return nil
+	}
+	n := min(int64(len(p)), img.backingSize-off)
+	if _, err := img.backing.ReadAt(p[:n], off); err != nil && err != io.EOF {
+		return fmt.Errorf("qcow2: read backing file: %w", err)
+	}
+	return nil
+}
+
+// WriteAt implements io.WriterAt over the virtual disk. Clusters not yet
+// allocated in the image are copied up from the backing file first.
+func (img *Image) WriteAt(p []byte, off int64) (int, error) {
+	if !img.writable {
+		return 0, fmt.Errorf("qcow2: image opened read-only")
+	}
+	if off < 0 || off+int64(len(p)) > img.hdr.Size {
+		return 0, fmt.Errorf("qcow2: write beyond end of disk")
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	cs := img.hdr.ClusterSize()
+	n := 0
+	for len(p) > 0 {
+		within := off & (cs - 1)
+		chunk := min(int64(len(p)), cs-within)
+		if err := img.writeCluster(p[:chunk], off); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+		p = p[chunk:]
+		off += chunk
+	}
+	return n, nil
+}
+
+func (img *Image) writeCluster(p []byte, off int64) error {
+	cs := img.hdr.ClusterSize()
+	within := off & (cs - 1)
+	table, tableOff, idx, err := img.l2Table(off, true)
+	if err != nil {
+		return err
+	}
+	entry := table[idx]
+
+	if entry&entryCompr == 0 && entry&entryZero == 0 && entry&l2OffsetMask != 0 {
+		if entry&entryCopied == 0 {
+			return fmt.Errorf("%w: writing to shared clusters", ErrUnsupported)
+		}
+		if _, err := img.f.WriteAt(p, int64(entry&l2OffsetMask)+within); err != nil {
+			return fmt.Errorf("qcow2: %w", err)
+		}
+		return nil
+	}
+
+	// Build the full cluster: current contents overlaid with p.
+	buf := make([]byte, cs)
+	if int64(len(p)) < cs {
+		start := off - within
+		if err := img.readCluster(buf[:min(cs, img.hdr.Size-start)], start); err != nil {
+			return err
+		}
+	}
+	copy(buf[within:], p)
+
+	// A zero cluster can keep a preallocated cluster this image owns;
+	// writing there instead of to a new one keeps it from leaking.
+	data := int64(entry & l2OffsetMask)
+	reuse := entry&entryCompr == 0 && entry&entryZero != 0 && entry&entryCopied != 0 && data != 0
+	if !reuse {
+		if data, err = img.allocCluster(); err != nil {
+			return err
+		}
+	}
+	if _, err := img.f.WriteAt(buf, data); err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+	newEntry := uint64(data) | entryCopied
+	if err := img.writeUint64(tableOff+int64(idx)*8, newEntry); err != nil {
+		return err
+	}
+	table[idx] = newEntry
+	return nil
+}
+
+// allocCluster appends a zeroed cluster to the file and sets its refcount
+// to 1, allocating a new refcount block first if needed.
+func (img *Image) allocCluster() (int64, error) {
+	cs := img.hdr.ClusterSize()
+	perBlock := cs * 8 / (1 << refcountOrder)
+	for {
+		off := img.end
+		idx := off / cs
+		rt := idx / perBlock
+		if rt >= int64(len(img.reftable)) {
+			return 0, fmt.Errorf("%w: image outgrew its refcount table", ErrUnsupported)
+		}
+		if err := img.zeroCluster(off); err != nil {
+			return 0, err
+		}
+		img.end += cs
+
+		if img.reftable[rt] == 0 {
+			// The new refcount block covers its own cluster.
+			if err := img.writeUint64(img.hdr.RefcountTableOffset+rt*8, uint64(off)); err != nil {
+				return 0, err
+			}
+			img.reftable[rt] = uint64(off)
+			if err := img.setRefcount(off, 1); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := img.setRefcount(off, 1); err != nil {
+			return 0, err
+		}
+		return off, nil
+	}
+}
+
+func (img *Image) zeroCluster(off int64) error {
+	if _, err := img.f.WriteAt(make([]byte, img.hdr.ClusterSize()), off); err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+	return nil
+}
+
+func (img *Image) setRefcount(off int64, refcount uint16) error {
+	cs := img.hdr.ClusterSize()
+	perBlock := cs * 8 / (1 << refcountOrder)
+	idx := off / cs
+	block := int64(img.reftable[idx/perBlock])
+	var buf [2]byte
+	be.PutUint16(buf[:], refcount)
+	if _, err := img.f.WriteAt(buf[:], block+(idx%perBlock)*2); err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+	return nil
+}
+
+func (img *Image) writeUint64(off int64, v uint64) error {
+	var buf [8]byte
+	be.PutUint64(buf[:], v)
+	if _, err := img.f.WriteAt(buf[:], off); err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// check runs qemu-img check on the image if it is installed.
+func check(t *testing.T, path string) {
+	t.Helper()
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		t.Log("qemu-img not found, skipping consistency check")
+		return
+	}
+	if out, err := exec.Command(qemuImg, "check", path).CombinedOutput(); err != nil {
+		t.Fatalf("qemu-img check: %v\n%s", err, out)
+	}
+}
+
+func readUint64(t *testing.T, f *os.File, off int64) uint64 {
+	t.Helper()
+	var buf [8]byte
+	if _, err := f.ReadAt(buf[:], off); err != nil {
+		t.Fatal(err)
+	}
+	return be.Uint64(buf[:])
+}
+
+func readUint16(t *testing.T, f *os.File, off int64) uint16 {
+	t.Helper()
+	var buf [2]byte
+	if _, err := f.ReadAt(buf[:], off); err != nil {
+		t.Fatal(err)
+	}
+	return be.Uint16(buf[:])
+}
+
+func TestCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := Create(path, Options{Size: 1<<30 + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	check(t, path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h, err := ReadHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const cs = 1 << DefaultClusterBits
+	want := Header{
+		Version:              3,
+		ClusterBits:          DefaultClusterBits,
+		Size:                 1<<30 + 512,
+		L1Size:               3, // 512 MiB per L2 table
+		L1TableOffset:        3 * cs,
+		RefcountTableOffset:  cs,
+		RefcountTableCluster: 1,
+		RefcountOrder:        4,
+		HeaderLength:         112,
+	}
+	if *h != want {
+		t.Errorf("header = %+v\nwant %+v", *h, want)
+	}
+
+	refblock := int64(readUint64(t, f, h.RefcountTableOffset))
+	if refblock != 2*cs {
+		t.Fatalf("refcount block at %#x, want %#x", refblock, 2*cs)
+	}
+	for i := range int64(5) {
+		wantRef := uint16(0)
+		if i < 4 {
+			wantRef = 1
+		}
+		if got := readUint16(t, f, refblock+i*2); got != wantRef {
+			t.Errorf("refcount of cluster %d = %d, want %d", i, got, wantRef)
+		}
+	}
+	if fi, _ := f.Stat(); fi.Size() != 4*cs {
+		t.Errorf("file size = %d, want %d", fi.Size(), 4*cs)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := Create(path, Options{Size: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const cs = 1 << DefaultClusterBits
+	data := bytes.Repeat([]byte("krun"), 1024)
+	off := int64(600<<20 + 100) // second L2 table, unaligned
+	if _, err := img.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data)+200)
+	if _, err := img.ReadAt(got, off-100); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[100:100+len(data)], data) || !isZero(got[:100]) || !isZero(got[100+len(data):]) {
+		t.Error("read back differs from written data")
+	}
+	img.Close()
+	check(t, path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h, err := ReadHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l1 := readUint64(t, f, h.L1TableOffset); l1 != 0 {
+		t.Errorf("L1[0] = %#x, want unallocated", l1)
+	}
+	// The L2 table is the first cluster allocated after the metadata, the
+	// data cluster the second.
+	l1 := readUint64(t, f, h.L1TableOffset+8)
+	if l1 != 4*cs|entryCopied {
+		t.Fatalf("L1[1] = %#x, want %#x", l1, uint64(4*cs|entryCopied))
+	}
+	l2Idx := (off >> DefaultClusterBits) % (cs / 8)
+	l2 := readUint64(t, f, int64(l1&l1OffsetMask)+l2Idx*8)
+	if l2 != 5*cs|entryCopied {
+		t.Fatalf("L2[%d] = %#x, want %#x", l2Idx, l2, uint64(5*cs|entryCopied))
+	}
+	refblock := int64(readUint64(t, f, h.RefcountTableOffset))
+	for _, c := range []int64{4, 5} {
+		if ref := readUint16(t, f, refblock+c*2); ref != 1 {
+			t.Errorf("refcount of cluster %d = %d, want 1", c, ref)
+		}
+	}
+	raw := make([]byte, len(data))
+	if _, err := f.ReadAt(raw, 5*cs+off%cs); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, data) {
+		t.Error("data not at the cluster named by the L2 entry")
+	}
+}
+
+func TestWriteAt_PreallocatedZero(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := Create(path, Options{Size: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt([]byte("old"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Turn the cluster into a zero cluster that keeps its allocation, as
+	// qemu does for preallocated images.
+	table, tableOff, idx, err := img.l2Table(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := table[idx] | entryZero
+	if err := img.writeUint64(tableOff+int64(idx)*8, entry); err != nil {
+		t.Fatal(err)
+	}
+	table[idx] = entry
+	end := img.end
+
+	if _, err := img.WriteAt([]byte("new"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if img.end != end {
+		t.Errorf("write to a preallocated zero cluster allocated %d bytes", img.end-end)
+	}
+	if table[idx] != entry&^entryZero {
+		t.Errorf("L2 entry = %#x, want %#x", table[idx], entry&^entryZero)
+	}
+	got := make([]byte, 16)
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := append(make([]byte, 10), "new\x00\x00\x00"...); !bytes.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	img.Close()
+	check(t, path)
+}
+
+func TestWriteAt_NewRefcountBlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	// 512-byte clusters: a refcount block covers 256 clusters.
+	img, err := Create(path, Options{Size: 1 << 20, ClusterBits: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	buf := bytes.Repeat([]byte{0xaa}, 512)
+	for off := int64(0); off < 1<<20; off += 4096 {
+		if _, err := img.WriteAt(buf, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if img.reftable[1] == 0 {
+		t.Fatal("second refcount block not allocated")
+	}
+	got := make([]byte, 512)
+	if _, err := img.ReadAt(got, 1<<20-4096); err != nil || !bytes.Equal(got, buf) {
+		t.Errorf("ReadAt = %v, data match %v", err, bytes.Equal(got, buf))
+	}
+	img.Close()
+	check(t, path)
+}
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	base := make([]byte, 3<<20)
+	for i := range base {
+		base[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// raw <- mid.qcow2 <- top.qcow2, with relative backing names.
+	mid := filepath.Join(dir, "mid.qcow2")
+	if err := CreateOverlay(mid, "base.raw"); err != nil {
+		t.Fatal(err)
+	}
+	img, err := OpenFile(mid, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("mid"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	top := filepath.Join(dir, "top.qcow2")
+	if err := CreateOverlay(top, "mid.qcow2"); err != nil {
+		t.Fatal(err)
+	}
+	img, err = OpenFile(top, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if h := img.Header(); h.BackingFile != "mid.qcow2" || h.BackingFormat != "qcow2" || h.Size != 3<<20 {
+		t.Errorf("header = %+v", h)
+	}
+	if _, err := img.WriteAt([]byte("top"), 2<<20+5); err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Clone(base)
+	copy(want[1<<20:], "mid")
+	copy(want[2<<20+5:], "top")
+	got := make([]byte, len(want))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("overlay contents differ from base plus writes")
+	}
+	img.Close()
+	check(t, top)
+
+	// The base must be untouched.
+	if b, _ := os.ReadFile(filepath.Join(dir, "base.raw")); !bytes.Equal(b, base) {
+		t.Error("base image modified")
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.qcow2")
+	img, err := Create(base, Options{Size: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	overlay := filepath.Join(dir, "vm.qcow2")
+	if err := CreateOverlay(overlay, base); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Discard(base); err == nil {
+		t.Error("Discard removed an image without a backing file")
+	}
+	raw := filepath.Join(dir, "raw.img")
+	if err := os.WriteFile(raw, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Discard(raw); !errors.Is(err, ErrNotQcow2) {
+		t.Errorf("Discard(raw) = %v, want ErrNotQcow2", err)
+	}
+	if err := Discard(overlay); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{base, raw} {
+		if _, err := os.Stat(p); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(overlay); !os.IsNotExist(err) {
+		t.Error("overlay still exists")
+	}
+}
+
+func TestOpen_Unsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := Create(path, Options{Size: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [8]byte
+	be.PutUint64(buf[:], FeatureExternalData)
+	f.WriteAt(buf[:], 72)
+	f.Close()
+	if _, err := Open(path); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Open = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestOpen_BadL1Size(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := Create(path, Options{Size: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var buf [4]byte
+	for _, l1Size := range []uint32{0xffffffff, 0} {
+		be.PutUint32(buf[:], l1Size)
+		f.WriteAt(buf[:], 36)
+		if img, err := Open(path); err == nil {
+			img.Close()
+			t.Errorf("L1 size %#x: Open succeeded", l1Size)
+		}
+	}
+}
+
+func TestReadAt_NegativeOffset(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "disk.qcow2"), Options{Size: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.ReadAt(make([]byte, 512), -1<<40); err == nil {
+		t.Error("ReadAt at a negative offset succeeded")
+	}
+}
+
+func isZero(p []byte) bool {
+	for _, c := range p {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
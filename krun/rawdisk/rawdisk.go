@@ -0,0 +1,132 @@
+// Package rawdisk creates and grows sparse raw disk images.
+//
+// Images are sparse files: creating a large one is instant and takes no
+// space until the guest writes to it. They can optionally carry a GPT
+// partition table and an empty ext4 filesystem, so the guest can mount
+// them without running mkfs first:
+//
+//	err := rawdisk.Create("scratch.img", 10<<30, rawdisk.Options{Partitioned: true, Ext4: true})
+//	...
+//	ctx.AddDisk(krun.DiskConfig{BlockID: "scratch", Path: "scratch.img"})
+package rawdisk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mishushakov/libkrun-go/krun/ext4"
+	"github.com/mishushakov/libkrun-go/krun/partition"
+)
+
+// Options configures how an image is created.
+type Options struct {
+	// Partitioned adds a GPT partition table with a single Linux
+	// filesystem partition spanning the disk, /dev/vda1 in the guest.
+	Partitioned bool
+	// Ext4 formats the disk, or with Partitioned its partition, with an
+	// empty ext4 filesystem.
+	Ext4 bool
+	// Label is the ext4 volume label.
+	Label string
+}
+
+// Create creates a sparse raw image of size bytes at path, which must not
+// exist. The size is rounded up to a whole number of 512-byte sectors.
+func Create(path string, size int64, opts Options) error {
+	if size <= 0 {
+		return fmt.Errorf("rawdisk: invalid size %d", size)
+	}
+	size = (size + partition.SectorSize - 1) / partition.SectorSize * partition.SectorSize
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("rawdisk: %w", err)
+	}
+	err = create(f, path, size, opts)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("rawdisk: %w", cerr)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func create(f *os.File, path string, size int64, opts Options) error {
+	if opts.Ext4 {
+		// Build replaces the file we reserved with O_EXCL.
+		return ext4.Build(path, "", ext4.Options{Size: size, Partitioned: opts.Partitioned, Label: opts.Label})
+	}
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("rawdisk: %w", err)
+	}
+	if opts.Partitioned {
+		first, end := partition.UsableRange(size)
+		if end <= first {
+			return errors.New("rawdisk: disk too small for a partition table")
+		}
+		return partition.WriteGPT(f, size, partition.Table{Partitions: []partition.Partition{{
+			Type:  partition.TypeLinuxFilesystem,
+			Start: first,
+			Size:  (end - first) / partition.Alignment * partition.Alignment,
+		}}})
+	}
+	return nil
+}
+
+// Resize grows the raw image at path to size bytes, rounded up to a whole
+// number of sectors. The new space is sparse. A GPT is rewritten so that
+// its backup copy sits at the new end of the disk; partitions and the
+// filesystems in them keep their size, and can be grown by the guest with
+// growpart and resize2fs. Shrinking is refused.
+func Resize(path string, size int64) error {
+	size = (size + partition.SectorSize - 1) / partition.SectorSize * partition.SectorSize
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("rawdisk: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("rawdisk: %w", err)
+	}
+	old := fi.Size()
+	if size < old {
+		return fmt.Errorf("rawdisk: %s: shrinking from %d to %d bytes is not supported", path, old, size)
+	}
+	if size == old {
+		return nil
+	}
+
+	t, err := partition.ReadTable(f, old)
+	switch {
+	case errors.Is(err, partition.ErrNoTable):
+		t = nil
+	case err != nil:
+		return fmt.Errorf("rawdisk: %s: %w", path, err)
+	case t.MBR:
+		t = nil // MBR has no backup copy to move
+	}
+	if t != nil {
+		for i, p := range t.Partitions {
+			if p.Number != i+1 {
+				return fmt.Errorf("rawdisk: %s: GPT with unused entries between partitions cannot be moved", path)
+			}
+		}
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("rawdisk: %w", err)
+	}
+	if t != nil {
+		// Clear the old backup header so it is not mistaken for a valid one.
+		if _, err := f.WriteAt(make([]byte, partition.SectorSize), old-partition.SectorSize); err != nil {
+			return fmt.Errorf("rawdisk: %w", err)
+		}
+		if err := partition.WriteGPT(f, size, *t); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
@@ -0,0 +1,114 @@
+package rawdisk
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mishushakov/libkrun-go/krun/partition"
+)
+
+func readTable(t *testing.T, path string) *partition.Table {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	tbl, err := partition.ReadTable(f, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tbl
+}
+
+// allocated returns the bytes of disk space path uses.
+func allocated(t *testing.T, path string) int64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks * 512
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.img")
+	if err := Create(plain, 1<<30+1, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(plain); fi.Size() != 1<<30+512 {
+		t.Errorf("size = %d", fi.Size())
+	}
+	if n := allocated(t, plain); n != 0 {
+		t.Errorf("plain image allocates %d bytes", n)
+	}
+	if err := Create(plain, 1<<20, Options{}); err == nil {
+		t.Error("Create replaced an existing image")
+	}
+
+	gpt := filepath.Join(dir, "gpt.img")
+	if err := Create(gpt, 64<<20, Options{Partitioned: true}); err != nil {
+		t.Fatal(err)
+	}
+	if tbl := readTable(t, gpt); len(tbl.Partitions) != 1 || tbl.Partitions[0].Type != partition.TypeLinuxFilesystem {
+		t.Errorf("table = %+v", tbl)
+	}
+
+	fs := filepath.Join(dir, "fs.img")
+	if err := Create(fs, 20<<30, Options{Partitioned: true, Ext4: true, Label: "scratch"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := readTable(t, fs).Partitions[0]; p.FSType != "ext4" {
+		t.Errorf("partition = %+v", p)
+	}
+	// Only the used metadata is written; empty inode tables stay holes.
+	if n := allocated(t, fs); n > 8<<20 {
+		t.Errorf("20 GiB ext4 image allocates %d bytes", n)
+	}
+	if path, err := exec.LookPath("e2fsck"); err == nil {
+		// e2fsck needs the filesystem on its own; check an unpartitioned one.
+		whole := filepath.Join(dir, "whole.img")
+		if err := Create(whole, 64<<20, Options{Ext4: true}); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(path, "-fn", whole).CombinedOutput(); err != nil {
+			t.Errorf("e2fsck: %v\n%s", err, out)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "disk.img")
+	if err := Create(path, 64<<20, Options{Partitioned: true, Ext4: true}); err != nil {
+		t.Fatal(err)
+	}
+	before := readTable(t, path)
+
+	if err := Resize(path, 128<<20); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != 128<<20 {
+		t.Errorf("size = %d", fi.Size())
+	}
+	after := readTable(t, path)
+	if after.DiskGUID != before.DiskGUID || len(after.Partitions) != 1 || after.Partitions[0] != before.Partitions[0] {
+		t.Errorf("table changed: %+v -> %+v", before, after)
+	}
+
+	// The backup GPT at the new end of the disk is valid on its own.
+	f, _ := os.OpenFile(path, os.O_RDWR, 0)
+	f.WriteAt(make([]byte, partition.SectorSize), partition.SectorSize)
+	f.Close()
+	if tbl := readTable(t, path); tbl.DiskGUID != before.DiskGUID {
+		t.Errorf("backup GPT = %+v", tbl)
+	}
+
+	if err := Resize(path, 1<<20); err == nil {
+		t.Error("Resize shrank the image")
+	}
+}
@@ -0,0 +1,159 @@
+package krun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/mishushakov/libkrun-go/krun/partition"
+	"github.com/mishushakov/libkrun-go/krun/qcow2"
+)
+
+// ErrNoRootDisk is returned by [FindRootDisk] when none of the disks holds
+// a filesystem that can be the root.
+var ErrNoRootDisk = errors.New("krun: no root filesystem found on the disks")
+
+// rootPartitionTypes are the Discoverable Partitions root types by GOARCH.
+var rootPartitionTypes = map[string]partition.GUID{
+	"amd64":   partition.TypeLinuxRootAMD64,
+	"arm64":   partition.TypeLinuxRootARM64,
+	"riscv64": partition.TypeLinuxRootRISCV64,
+}
+
+// ReadPartitions reads the partition table of the raw or qcow2 disk image
+// at path, following qcow2 backing files. It returns
+// [partition.ErrNoTable] for an unpartitioned image.
+func ReadPartitions(path string) (*partition.Table, error) {
+	img, err := DetectDiskFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	return readPartitions(img)
+}
+
+func readPartitions(img *DiskImage) (*partition.Table, error) {
+	r, size, err := openDiskImage(img)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return partition.ReadTable(r, size)
+}
+
+type diskReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openDiskImage opens img for reading its guest-visible contents.
+func openDiskImage(img *DiskImage) (diskReader, int64, error) {
+	switch img.Format {
+	case DiskFormatRaw:
+		f, err := os.Open(img.Path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("krun: %w", err)
+		}
+		return f, img.Size, nil
+	case DiskFormatQcow2:
+		q, err := qcow2.Open(img.Path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("krun: %s: %w", img.Path, err)
+		}
+		return q, q.Size(), nil
+	}
+	return nil, 0, fmt.Errorf("%w: %s: cannot read partitions of this format", ErrUnsupportedDisk, img.Path)
+}
+
+// FindRootDisk looks for the root filesystem on disks, given in the order
+// they are added with AddDisk, which is the order the guest names them
+// /dev/vda, /dev/vdb and so on. It returns the config to pass to
+// SetRootDiskRemount, with the filesystem type filled in and "ro" for a
+// read-only disk.
+//
+// A GPT partition with the root type of the host architecture (from the
+// Discoverable Partitions Specification) is preferred, then a Linux
+// filesystem partition, then any partition or unpartitioned disk holding
+// a filesystem other than vfat. Disks with DiskFormatAuto are checked
+// against their Policy first.
+func FindRootDisk(disks []DiskConfig) (RootDiskRemountConfig, error) {
+	type candidate struct {
+		device, fsType string
+		readOnly       bool
+		rank           int
+	}
+	var best *candidate
+	consider := func(c candidate) {
+		if best == nil || c.rank < best.rank {
+			best = &c
+		}
+	}
+	for i, cfg := range disks {
+		img, err := cfg.image()
+		if err != nil {
+			return RootDiskRemountConfig{}, err
+		}
+		if cfg.Format == DiskFormatAuto {
+			if !cfg.ReadOnly {
+				return RootDiskRemountConfig{}, fmt.Errorf("%w: %s", ErrWritableAutoDisk, cfg.Path)
+			}
+			if err := cfg.Policy.Check(img); err != nil {
+				return RootDiskRemountConfig{}, err
+			}
+		}
+		device := "/dev/" + virtioBlkName(i)
+		t, err := readPartitions(img)
+		if errors.Is(err, partition.ErrNoTable) {
+			r, _, err := openDiskImage(img)
+			if err != nil {
+				return RootDiskRemountConfig{}, err
+			}
+			fsType := partition.DetectFilesystem(r, 0)
+			r.Close()
+			if isRootFS(fsType) {
+				consider(candidate{device, fsType, cfg.ReadOnly, 2})
+			}
+			continue
+		}
+		if err != nil {
+			return RootDiskRemountConfig{}, err
+		}
+		for _, p := range t.Partitions {
+			if !isRootFS(p.FSType) {
+				continue
+			}
+			rank := 2
+			switch {
+			case p.Type == rootPartitionTypes[runtime.GOARCH] && !p.Type.IsZero():
+				rank = 0
+			case p.Type == partition.TypeLinuxFilesystem, t.MBR && p.MBRType == partition.MBRTypeLinux:
+				rank = 1
+			}
+			consider(candidate{fmt.Sprintf("%s%d", device, p.Number), p.FSType, cfg.ReadOnly, rank})
+		}
+	}
+	if best == nil {
+		return RootDiskRemountConfig{}, ErrNoRootDisk
+	}
+	cfg := RootDiskRemountConfig{Device: best.device, FSType: best.fsType}
+	if best.readOnly {
+		cfg.Options = "ro"
+	}
+	return cfg, nil
+}
+
+// isRootFS reports whether a filesystem of type fsType can hold a root.
+func isRootFS(fsType string) bool {
+	return fsType != "" && fsType != "swap" && fsType != "vfat"
+}
+
+// virtioBlkName returns the guest name of the i-th virtio-blk disk: vda,
+// ..., vdz, vdaa, ...
+func virtioBlkName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('a'+(i-1)%26)) + name
+	}
+	return "vd" + name
+}
@@ -0,0 +1,79 @@
+package krun
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mishushakov/libkrun-go/krun/ext4"
+	"github.com/mishushakov/libkrun-go/krun/partition"
+	"github.com/mishushakov/libkrun-go/krun/qcow2"
+)
+
+func TestVirtioBlkName(t *testing.T) {
+	for i, want := range map[int]string{0: "vda", 1: "vdb", 25: "vdz", 26: "vdaa", 27: "vdab", 701: "vdzz", 702: "vdaaa"} {
+		if got := virtioBlkName(i); got != want {
+			t.Errorf("virtioBlkName(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestFindRootDisk(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.Mkdir(src, 0755)
+	writeTestFile(t, filepath.Join(src, "etc/os-release"), "ID=test\n")
+
+	data := filepath.Join(dir, "data.img")
+	writeTestFile(t, data, string(make([]byte, 1<<20)))
+	root := filepath.Join(dir, "root.img")
+	if err := ext4.Build(root, src, ext4.Options{Partitioned: true}); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "plain.img")
+	if err := ext4.Build(plain, src, ext4.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	overlay := filepath.Join(dir, "root.qcow2")
+	if err := qcow2.CreateOverlay(overlay, root); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl, err := ReadPartitions(overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tbl.Partitions) != 1 || tbl.Partitions[0].FSType != "ext4" {
+		t.Errorf("ReadPartitions = %+v", tbl)
+	}
+	if _, err := ReadPartitions(plain); !errors.Is(err, partition.ErrNoTable) {
+		t.Errorf("ReadPartitions(unpartitioned): err = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		disks []DiskConfig
+		want  RootDiskRemountConfig
+	}{
+		{"second disk", []DiskConfig{{Path: data}, {Path: root}}, RootDiskRemountConfig{Device: "/dev/vdb1", FSType: "ext4"}},
+		{"qcow2", []DiskConfig{{Path: overlay, Format: DiskFormatQcow2, ReadOnly: true}}, RootDiskRemountConfig{Device: "/dev/vda1", FSType: "ext4", Options: "ro"}},
+		{"partition preferred", []DiskConfig{{Path: plain}, {Path: root}}, RootDiskRemountConfig{Device: "/dev/vdb1", FSType: "ext4"}},
+		{"unpartitioned", []DiskConfig{{Path: data}, {Path: plain}}, RootDiskRemountConfig{Device: "/dev/vdb", FSType: "ext4"}},
+	}
+	for _, tt := range tests {
+		got, err := FindRootDisk(tt.disks)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: FindRootDisk = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := FindRootDisk([]DiskConfig{{Path: data}}); !errors.Is(err, ErrNoRootDisk) {
+		t.Errorf("no root: err = %v", err)
+	}
+	if _, err := FindRootDisk([]DiskConfig{{Path: overlay, Format: DiskFormatAuto, ReadOnly: true}}); !errors.Is(err, ErrDiskPolicy) {
+		t.Errorf("policy: err = %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+package rootfs
+
+import "golang.org/x/sys/unix"
+
+// cloneFile creates dst sharing the data blocks of src (clonefile).
+func cloneFile(dst, src string) error {
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW|unix.CLONE_NOOWNERCOPY)
+}
@@ -0,0 +1,195 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// copier copies a directory tree, preserving hardlinks, ownership where
+// permitted, modes, timestamps and extended attributes.
+type copier struct {
+	clone bool // clone regular files instead of copying them
+	links map[fileID]string
+}
+
+type fileID struct{ dev, ino uint64 }
+
+// Copy copies the tree at src to dst, which must not exist, preserving
+// hardlinks, ownership where permitted, modes, timestamps and extended
+// attributes. Regular files share their data blocks with src where the
+// filesystem can clone them.
+//
+// Sockets are left out, being meaningless in a copy, and so are device
+// nodes when the caller may not create them (EPERM); a guest gets its own
+// /dev. FIFOs are always copied.
+func Copy(dst, src string) error {
+	if err := copyTree(dst, src, true); err == nil {
+		return nil
+	}
+	removeTree(dst)
+	if err := copyTree(dst, src, false); err != nil {
+		removeTree(dst)
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	return nil
+}
+
+// copyTree copies the tree at src to dst, which must not exist.
+func copyTree(dst, src string, clone bool) error {
+	c := &copier{clone: clone, links: make(map[fileID]string)}
+	return c.copy(dst, src)
+}
+
+func (c *copier) copy(dst, src string) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		return &os.PathError{Op: "lstat", Path: src, Err: err}
+	}
+	typ := uint32(st.Mode) & unix.S_IFMT
+	if typ != unix.S_IFDIR && st.Nlink > 1 {
+		id := fileID{uint64(st.Dev), uint64(st.Ino)}
+		if first, ok := c.links[id]; ok {
+			return os.Link(first, dst)
+		}
+		c.links[id] = dst
+	}
+
+	switch typ {
+	case unix.S_IFDIR:
+		// Filled while owner-writable; the real mode is applied afterwards.
+		if err := os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := c.copy(filepath.Join(dst, e.Name()), filepath.Join(src, e.Name())); err != nil {
+				return err
+			}
+		}
+	case unix.S_IFREG:
+		if err := c.copyFile(dst, src); err != nil {
+			return err
+		}
+	case unix.S_IFLNK:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	case unix.S_IFCHR, unix.S_IFBLK, unix.S_IFIFO:
+		if err := unix.Mknod(dst, uint32(st.Mode), int(st.Rdev)); err != nil {
+			// Unprivileged users cannot create device nodes; the guest
+			// gets its own /dev anyway.
+			if typ != unix.S_IFIFO && errors.Is(err, unix.EPERM) {
+				return nil
+			}
+			return &os.PathError{Op: "mknod", Path: dst, Err: err}
+		}
+	default:
+		// Sockets are meaningless in a copy.
+		return nil
+	}
+	return copyMetadata(dst, src, &st)
+}
+
+// copySkips reports whether a copy may lack a file like st: sockets are
+// never copied, and device nodes not without the privilege to create them.
+func copySkips(st *unix.Stat_t) bool {
+	switch uint32(st.Mode) & unix.S_IFMT {
+	case unix.S_IFSOCK, unix.S_IFCHR, unix.S_IFBLK:
+		return true
+	}
+	return false
+}
+
+func (c *copier) copyFile(dst, src string) error {
+	if c.clone {
+		if err := cloneFile(dst, src); err != nil {
+			return &os.PathError{Op: "clone", Path: src, Err: err}
+		}
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyMetadata applies the extended attributes, owner, mode and timestamps
+// of src, described by st, to dst. Attributes and owners the caller may not
+// set are skipped.
+func copyMetadata(dst, src string, st *unix.Stat_t) error {
+	copyXattrs(dst, src)
+	if err := unix.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, unix.EPERM) {
+		return &os.PathError{Op: "lchown", Path: dst, Err: err}
+	}
+	if uint32(st.Mode)&unix.S_IFMT != unix.S_IFLNK {
+		// After chown, which clears the setuid and setgid bits.
+		if err := unix.Chmod(dst, uint32(st.Mode)&07777); err != nil {
+			return &os.PathError{Op: "chmod", Path: dst, Err: err}
+		}
+	}
+	ts := []unix.Timespec{st.Atim, st.Mtim}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "utimes", Path: dst, Err: err}
+	}
+	return nil
+}
+
+func copyXattrs(dst, src string) {
+	for _, name := range listXattrs(src) {
+		size, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(src, name, value); err != nil {
+			continue
+		}
+		unix.Lsetxattr(dst, name, value[:size], 0)
+	}
+}
+
+// listXattrs returns the names of the extended attributes of path, or nil
+// if they cannot be listed.
+func listXattrs(path string) []string {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil
+	}
+	var names []string
+	start := 0
+	for i, c := range buf[:size] {
+		if c == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}
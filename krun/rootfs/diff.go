@@ -0,0 +1,306 @@
+package rootfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChangeKind says how a path differs from the base rootfs.
+type ChangeKind int
+
+const (
+	ChangeAdded ChangeKind = iota + 1
+	ChangeModified
+	ChangeDeleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// Change is a path that differs between the base rootfs and a VM's
+// writable layer.
+type Change struct {
+	Kind ChangeKind
+	Path string // slash-separated, absolute within the rootfs ("/etc/hosts")
+}
+
+// Diff returns the changes the VM made to its view, parents before
+// children. It works before and after Close if the view was created with
+// KeepUpper.
+func (r *Root) Diff() ([]Change, error) {
+	if r.Mode == ModeOverlay {
+		return DiffOverlay(r.Base, r.Upper)
+	}
+	return DiffCopy(r.Base, r.Upper)
+}
+
+// DiffOverlay returns the changes recorded in an overlayfs upper directory
+// over base. Whiteouts and opaque directories are reported as deletions;
+// directories renamed with redirect_dir are not understood.
+func DiffOverlay(base, upper string) ([]Change, error) {
+	d := &differ{base: base, upper: upper}
+	if err := d.diff("/", false); err != nil {
+		return nil, err
+	}
+	return d.changes, nil
+}
+
+// DiffCopy returns the changes between base and dir, a full copy of it.
+// Files are compared by type, mode, owner, size, modification time and
+// symlink target, not by content. Owners are only compared where the
+// calling process could have preserved them: without privileges, [Copy]
+// leaves the files it may not give away owned by the caller. Sockets and
+// device nodes missing from dir are not reported as deleted, since Copy
+// may have left them out.
+func DiffCopy(base, dir string) ([]Change, error) {
+	groups, err := os.Getgroups()
+	if err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+	d := &differ{base: base, upper: dir, chown: chowner{uid: os.Geteuid(), groups: append(groups, os.Getegid())}.can, uncopied: copySkips}
+	// A full copy behaves like an overlay whose directories are all
+	// opaque: whatever the copy lacks was deleted.
+	if err := d.diff("/", true); err != nil {
+		return nil, err
+	}
+	return d.changes, nil
+}
+
+type differ struct {
+	base, upper string
+	changes     []Change
+	// chown, if set, reports whether the upper copy of a base file
+	// described by st can have kept its owner.
+	chown func(st *unix.Stat_t) bool
+	// uncopied, if set, reports whether a base file described by st may
+	// be missing from the upper directory without having been deleted.
+	uncopied func(st *unix.Stat_t) bool
+}
+
+// chowner is the identity of a process, for what owners it may set.
+type chowner struct {
+	uid    int
+	groups []int
+}
+
+// can reports whether the process may give a file the owner of st.
+func (c chowner) can(st *unix.Stat_t) bool {
+	return c.uid == 0 || int(st.Uid) == c.uid && slices.Contains(c.groups, int(st.Gid))
+}
+
+func (d *differ) add(kind ChangeKind, p string) {
+	d.changes = append(d.changes, Change{Kind: kind, Path: p})
+}
+
+// diff compares the upper directory rel with the same directory in base.
+// With opaque set, base entries missing from upper count as deleted.
+func (d *differ) diff(rel string, opaque bool) error {
+	upperDir := filepath.Join(d.upper, filepath.FromSlash(rel))
+	baseDir := filepath.Join(d.base, filepath.FromSlash(rel))
+	opaque = opaque || isOpaque(upperDir)
+
+	upperNames, err := readDirNames(upperDir)
+	if err != nil {
+		return err
+	}
+	baseNames, err := readDirNames(baseDir)
+	if err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.ENOTDIR) {
+		return err
+	}
+
+	present := make(map[string]*unix.Stat_t, len(upperNames))
+	whiteouts := make(map[string]bool)
+	for _, name := range upperNames {
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(upperDir, name), &st); err != nil {
+			return &os.PathError{Op: "lstat", Path: filepath.Join(upperDir, name), Err: err}
+		}
+		if isWhiteout(&st) {
+			whiteouts[name] = true
+		} else {
+			present[name] = &st
+		}
+	}
+
+	// Merge both sorted name lists so changes come out in path order.
+	names := slices.Concat(upperNames, baseNames)
+	slices.Sort(names)
+	names = slices.Compact(names)
+	for _, name := range names {
+		p := path.Join(rel, name)
+		ust := present[name]
+		var bst unix.Stat_t
+		_, listed := slices.BinarySearch(baseNames, name)
+		inBase := listed && unix.Lstat(filepath.Join(baseDir, name), &bst) == nil
+
+		switch {
+		case ust == nil:
+			if inBase && (opaque || whiteouts[name]) && (d.uncopied == nil || !d.uncopied(&bst)) {
+				d.add(ChangeDeleted, p)
+			}
+		case !inBase:
+			d.add(ChangeAdded, p)
+			if isDir(ust) {
+				if err := d.addAll(p); err != nil {
+					return err
+				}
+			}
+		default:
+			owners := d.chown == nil || d.chown(&bst)
+			if changed(&bst, ust, owners, filepath.Join(baseDir, name), filepath.Join(upperDir, name)) {
+				d.add(ChangeModified, p)
+			}
+			if isDir(ust) {
+				if err := d.diff(p, opaque || !isDir(&bst)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addAll reports everything below the upper directory rel as added.
+func (d *differ) addAll(rel string) error {
+	dir := filepath.Join(d.upper, filepath.FromSlash(rel))
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		p := path.Join(rel, name)
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(dir, name), &st); err != nil {
+			return &os.PathError{Op: "lstat", Path: filepath.Join(dir, name), Err: err}
+		}
+		if isWhiteout(&st) {
+			continue
+		}
+		d.add(ChangeAdded, p)
+		if isDir(&st) {
+			if err := d.addAll(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func isDir(st *unix.Stat_t) bool {
+	return uint32(st.Mode)&unix.S_IFMT == unix.S_IFDIR
+}
+
+// isWhiteout reports whether st is an overlayfs whiteout: a character
+// device with device number 0/0.
+func isWhiteout(st *unix.Stat_t) bool {
+	return uint32(st.Mode)&unix.S_IFMT == unix.S_IFCHR && st.Rdev == 0
+}
+
+// overlayXattrPrefixes are the xattr namespaces overlayfs keeps its own
+// metadata in: trusted for privileged mounts, user with "userxattr".
+var overlayXattrPrefixes = []string{"trusted.overlay.", "user.overlay."}
+
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	for _, prefix := range overlayXattrPrefixes {
+		if n, err := unix.Lgetxattr(dir, prefix+"opaque", buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// changed reports whether the entry described by b (in base) differs from
+// u (in the writable layer). Directory timestamps are ignored since they
+// change whenever an entry is added or removed; owners are compared only
+// if owners is set.
+func changed(b, u *unix.Stat_t, owners bool, basePath, upperPath string) bool {
+	if b.Mode != u.Mode {
+		return true
+	}
+	if owners && (b.Uid != u.Uid || b.Gid != u.Gid) {
+		return true
+	}
+	switch uint32(u.Mode) & unix.S_IFMT {
+	case unix.S_IFDIR:
+		return false
+	case unix.S_IFLNK:
+		bt, _ := os.Readlink(basePath)
+		ut, _ := os.Readlink(upperPath)
+		return bt != ut
+	case unix.S_IFCHR, unix.S_IFBLK:
+		return b.Rdev != u.Rdev
+	}
+	return b.Size != u.Size || b.Mtim != u.Mtim || !xattrsEqual(basePath, upperPath)
+}
+
+func xattrsEqual(a, b string) bool {
+	an, bn := userXattrs(a), userXattrs(b)
+	if !slices.Equal(an, bn) {
+		return false
+	}
+	for _, name := range an {
+		if !bytes.Equal(getXattr(a, name), getXattr(b, name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// userXattrs lists the xattrs of path that belong to the file rather than
+// to overlayfs, sorted.
+func userXattrs(path string) []string {
+	names := slices.DeleteFunc(listXattrs(path), func(name string) bool {
+		for _, prefix := range overlayXattrPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+	slices.Sort(names)
+	return names
+}
+
+func getXattr(path, name string) []byte {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil
+	}
+	value := make([]byte, size)
+	if size, err = unix.Lgetxattr(path, name, value); err != nil {
+		return nil
+	}
+	return value[:size]
+}
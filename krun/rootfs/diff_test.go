@@ -0,0 +1,145 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// modifyView makes the same set of changes in every test view.
+func modifyView(t *testing.T, view string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(view, "etc/hostname"), []byte("vm\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(view, "new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(view, "new/x"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(view, "bin/link")); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(filepath.Join(view, "ro"), 0755)
+	if err := os.RemoveAll(filepath.Join(view, "ro")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var wantChanges = []Change{
+	{ChangeDeleted, "/bin/link"},
+	{ChangeModified, "/etc/hostname"},
+	{ChangeAdded, "/new"},
+	{ChangeAdded, "/new/x"},
+	{ChangeDeleted, "/ro"},
+}
+
+func TestDiff(t *testing.T) {
+	for _, mode := range []Mode{ModeOverlay, ModeCopy} {
+		t.Run(mode.String(), func(t *testing.T) {
+			base := newTestBase(t)
+			r := ephemeral(t, base, EphemeralOptions{Mode: mode, KeepUpper: true})
+			modifyView(t, r.Path)
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { removeTree(r.state) })
+
+			changes, err := r.Diff()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(changes, wantChanges) {
+				t.Errorf("Diff =\n%v\nwant\n%v", changes, wantChanges)
+			}
+		})
+	}
+}
+
+func TestDiffCopy_Unprivileged(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to set up files owned by others")
+	}
+	base := newTestBase(t)
+	dir := filepath.Join(t.TempDir(), "copy")
+	if err := Copy(dir, base); err != nil {
+		t.Fatal(err)
+	}
+	// What an unprivileged Copy leaves: the files it may not give away
+	// are owned by the caller.
+	const uid = 12345
+	if err := os.Lchown(filepath.Join(dir, "etc/hostname"), uid, uid); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &differ{base: base, upper: dir, chown: chowner{uid: uid, groups: []int{uid}}.can}
+	if err := d.diff("/", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.changes) != 0 {
+		t.Errorf("unprivileged diff = %v, want no changes", d.changes)
+	}
+
+	changes, err := DiffCopy(base, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Change{{ChangeModified, "/etc/hostname"}}; !slices.Equal(changes, want) {
+		t.Errorf("DiffCopy as root = %v, want %v", changes, want)
+	}
+}
+
+func TestDiffCopy_Skipped(t *testing.T) {
+	base := newTestBase(t)
+	if err := unix.Mknod(filepath.Join(base, "sock"), unix.S_IFSOCK|0755, 0); err != nil {
+		t.Fatal(err)
+	}
+	// A device node, where the test may create one.
+	unix.Mknod(filepath.Join(base, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3)))
+	dir := filepath.Join(t.TempDir(), "copy")
+	if err := Copy(dir, base); err != nil {
+		t.Fatal(err)
+	}
+	// What Copy does without the privilege to create device nodes.
+	os.Remove(filepath.Join(dir, "null"))
+
+	changes, err := DiffCopy(base, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("DiffCopy of an untouched copy = %v, want no changes", changes)
+	}
+}
+
+func TestDiffOverlay_Opaque(t *testing.T) {
+	base := newTestBase(t)
+	r := ephemeral(t, base, EphemeralOptions{Mode: ModeOverlay})
+	defer r.Close()
+	// Replacing a lower directory makes the new one opaque.
+	if err := os.RemoveAll(filepath.Join(r.Path, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(r.Path, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(r.Path, "etc/motd"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := r.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{ChangeAdded, "/etc/motd"},
+		{ChangeDeleted, "/etc/hostname"},
+	}
+	slices.SortFunc(changes, func(a, b Change) int { return int(a.Kind) - int(b.Kind) })
+	if !slices.Equal(changes, want) {
+		t.Errorf("Diff = %v, want %v", changes, want)
+	}
+}
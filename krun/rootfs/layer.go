@@ -0,0 +1,409 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OCI layer whiteout names.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	paxXattr       = "SCHILY.xattr."
+)
+
+// Commit writes the VM's changes to w as an uncompressed OCI layer tar.
+// Applied with [ApplyLayer] over a copy of the base, or stacked on the base
+// image's layers, it reproduces the view. Wrap w in a gzip.Writer for a
+// tar+gzip layer.
+func (r *Root) Commit(w io.Writer) error {
+	changes, err := r.Diff()
+	if err != nil {
+		return err
+	}
+	return WriteLayer(w, r.Upper, changes)
+}
+
+// WriteLayer writes changes as an OCI layer tar to w. Added and modified
+// entries are read from dir, the tree holding the new contents; deletions
+// become whiteout files.
+func WriteLayer(w io.Writer, dir string, changes []Change) error {
+	tw := tar.NewWriter(w)
+	links := make(map[fileID]string)
+	for _, c := range changes {
+		name := strings.TrimPrefix(c.Path, "/")
+		if c.Kind == ChangeDeleted {
+			hdr := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     path.Join(path.Dir(name), whiteoutPrefix+path.Base(name)),
+				Mode:     0644,
+				ModTime:  time.Unix(0, 0),
+				Format:   tar.FormatPAX,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("rootfs: %w", err)
+			}
+			continue
+		}
+		if err := writeEntry(tw, filepath.Join(dir, filepath.FromSlash(name)), name, links); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	return nil
+}
+
+func writeEntry(tw *tar.Writer, src, name string, links map[fileID]string) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		return fmt.Errorf("rootfs: %w", &os.PathError{Op: "lstat", Path: src, Err: err})
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	var target string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if target, err = os.Readlink(src); err != nil {
+			return fmt.Errorf("rootfs: %w", err)
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, target)
+	if err != nil {
+		return fmt.Errorf("rootfs: %s: %w", src, err)
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// Keep layers reproducible: numeric owners, no access or change times.
+	hdr.Uid, hdr.Gid = int(st.Uid), int(st.Gid)
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	hdr.Format = tar.FormatPAX
+	for _, x := range userXattrs(src) {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattr+x] = string(getXattr(src, x))
+	}
+
+	if hdr.Typeflag == tar.TypeReg && st.Nlink > 1 {
+		id := fileID{uint64(st.Dev), uint64(st.Ino)}
+		if first, ok := links[id]; ok {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+		} else {
+			links[id] = name
+		}
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+		return fmt.Errorf("rootfs: %s: %w", src, err)
+	}
+	return nil
+}
+
+// ApplyLayer extracts the OCI layer tar read from r into dir, processing
+// whiteouts. Entries cannot escape dir, through ".." or through symlinks
+// in dir. Owners and device nodes are restored when the caller may create
+// them, and skipped otherwise.
+func ApplyLayer(dir string, r io.Reader) error {
+	return applyLayer(dir, r, false)
+}
+
+// applyLayer is ApplyLayer. With overlay set, dir is an empty overlayfs
+// layer directory: whiteouts become overlayfs whiteouts and opaque
+// directories instead of removing what lower layers hold.
+func applyLayer(dir string, r io.Reader, overlay bool) error {
+	a := &applier{dir: dir, overlay: overlay, created: make(map[string]bool)}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("rootfs: %w", err)
+		}
+		if err := a.apply(hdr, tr); err != nil {
+			return fmt.Errorf("rootfs: %s: %w", hdr.Name, err)
+		}
+	}
+	// Directory modes and times last: a read-only directory would stop
+	// its entries from being extracted, and extracting them changes the
+	// modification time.
+	for i := len(a.dirs) - 1; i >= 0; i-- {
+		if err := a.setDirAttrs(a.dirs[i]); err != nil {
+			return fmt.Errorf("rootfs: %w", err)
+		}
+	}
+	return nil
+}
+
+type applier struct {
+	dir     string
+	overlay bool
+	created map[string]bool // entries written by this layer
+	dirs    []dirAttrs
+}
+
+type dirAttrs struct {
+	rel   string // slash-separated, relative to the layer directory
+	mode  uint32
+	mtime time.Time
+}
+
+func (a *applier) apply(hdr *tar.Header, r io.Reader) error {
+	name := path.Clean("/" + hdr.Name)[1:]
+	if name == "" {
+		name = "."
+	}
+	parent, base := path.Split(name)
+	parentPath, err := a.resolve(parent)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(parentPath, base)
+
+	switch {
+	case base == whiteoutOpaque && a.overlay:
+		if err := unix.Lsetxattr(parentPath, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: parentPath, Err: err}
+		}
+		return nil
+	case strings.HasPrefix(base, whiteoutPrefix) && a.overlay:
+		wh, err := a.whiteoutTarget(parentPath, base)
+		if err != nil {
+			return err
+		}
+		a.forget(path.Join(parent, base[len(whiteoutPrefix):]))
+		if err := removeTree(wh); err != nil {
+			return err
+		}
+		if err := unix.Mknod(wh, unix.S_IFCHR, 0); err != nil {
+			return &os.PathError{Op: "mknod", Path: wh, Err: err}
+		}
+		return nil
+	case base == whiteoutOpaque:
+		// Hide what lower layers put in the directory, keeping this
+		// layer's own entries.
+		names, err := readDirNames(parentPath)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if !a.created[path.Join(parent, n)] {
+				if err := removeTree(filepath.Join(parentPath, n)); err != nil {
+					return err
+				}
+				a.forget(path.Join(parent, n))
+			}
+		}
+		return nil
+	case strings.HasPrefix(base, whiteoutPrefix):
+		wh, err := a.whiteoutTarget(parentPath, base)
+		if err != nil {
+			return err
+		}
+		a.forget(path.Join(parent, base[len(whiteoutPrefix):]))
+		return removeTree(wh)
+	}
+	if name == "." && hdr.Typeflag != tar.TypeDir {
+		return errors.New("root entry is not a directory")
+	}
+
+	if fi, err := os.Lstat(dst); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := removeTree(dst); err != nil {
+			return err
+		}
+		a.forget(name)
+	}
+	a.created[path.Clean(name)] = true
+
+	mode := uint32(hdr.Mode) & 07777
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(dst, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		a.dirs = append(a.dirs, dirAttrs{name, mode, hdr.ModTime})
+	case tar.TypeReg:
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, dst); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		lparent, lbase := path.Split(path.Clean("/" + hdr.Linkname)[1:])
+		lp, err := a.resolve(lparent)
+		if err != nil {
+			return err
+		}
+		return os.Link(filepath.Join(lp, lbase), dst)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		typ := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+		dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+		if err := unix.Mknod(dst, typ|mode, dev); err != nil {
+			if hdr.Typeflag != tar.TypeFifo && errors.Is(err, unix.EPERM) {
+				return nil
+			}
+			return err
+		}
+	default:
+		return nil
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if x, ok := strings.CutPrefix(key, paxXattr); ok {
+			unix.Lsetxattr(dst, x, []byte(value), 0)
+		}
+	}
+	if err := unix.Lchown(dst, hdr.Uid, hdr.Gid); err != nil && !errors.Is(err, unix.EPERM) {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil // mode and times are applied once the layer is done
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := unix.Chmod(dst, mode); err != nil {
+			return err
+		}
+	}
+	return setTimes(dst, hdr.ModTime)
+}
+
+// whiteoutTarget returns the path the whiteout file base in parentPath
+// hides. Names that are empty, . or .. or that hold a slash are refused,
+// so a whiteout can only remove an entry inside a.dir, never a.dir itself
+// or what is above it.
+func (a *applier) whiteoutTarget(parentPath, base string) (string, error) {
+	name := base[len(whiteoutPrefix):]
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return "", fmt.Errorf("invalid whiteout %q", base)
+	}
+	p := filepath.Join(parentPath, name)
+	rel, err := filepath.Rel(a.dir, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("whiteout %q outside the layer", base)
+	}
+	return p, nil
+}
+
+// forget drops the recorded attributes of the directory rel and those
+// below it, once it has been removed or replaced.
+func (a *applier) forget(rel string) {
+	a.dirs = slices.DeleteFunc(a.dirs, func(d dirAttrs) bool {
+		return d.rel == rel || strings.HasPrefix(d.rel, rel+"/")
+	})
+}
+
+// setDirAttrs applies a directory's mode and modification time. The
+// directory is reached through descriptors opened without following
+// symlinks, so a directory replaced by a symlink is never followed out of
+// a.dir; such a directory is skipped.
+func (a *applier) setDirAttrs(d dirAttrs) error {
+	fd, err := a.openDir(d.rel)
+	if err != nil {
+		if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.ENOTDIR) || errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Fchmod(fd, d.mode); err != nil {
+		return &os.PathError{Op: "chmod", Path: d.rel, Err: err}
+	}
+	if d.rel == "." {
+		return setTimes(a.dir, d.mtime)
+	}
+	pfd, err := a.openDir(path.Dir(d.rel))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(pfd)
+	ts := unix.NsecToTimespec(d.mtime.UnixNano())
+	unix.UtimesNanoAt(pfd, path.Base(d.rel), []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+	return nil
+}
+
+// openDir opens the directory rel inside a.dir one component at a time,
+// refusing symlinks.
+func (a *applier) openDir(rel string) (int, error) {
+	fd, err := unix.Open(a.dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: a.dir, Err: err}
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		next, err := unix.Openat(fd, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, &os.PathError{Op: "open", Path: rel, Err: err}
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// resolve returns the host path of the directory rel inside a.dir,
+// creating missing directories and refusing to follow symlinks.
+func (a *applier) resolve(rel string) (string, error) {
+	p := a.dir
+	for _, part := range strings.Split(strings.Trim(rel, "/"), "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		p = filepath.Join(p, part)
+		fi, err := os.Lstat(p)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(p, 0755); err != nil {
+				return "", err
+			}
+		case err != nil:
+			return "", err
+		case !fi.IsDir():
+			return "", fmt.Errorf("%s is not a directory", p)
+		}
+	}
+	return p, nil
+}
+
+func setTimes(path string, mtime time.Time) error {
+	ts := unix.NsecToTimespec(mtime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,151 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommit(t *testing.T) {
+	base := newTestBase(t)
+	r := ephemeral(t, base, EphemeralOptions{})
+	defer r.Close()
+	modifyView(t, r.Path)
+
+	var layer bytes.Buffer
+	if err := r.Commit(&layer); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(layer.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	if want := "bin/.wh.link etc/hostname new/ new/x .wh.ro"; strings.Join(names, " ") != want {
+		t.Errorf("layer entries = %q, want %q", strings.Join(names, " "), want)
+	}
+
+	// Base plus the layer must match the view.
+	applied := filepath.Join(t.TempDir(), "root")
+	if err := copyTree(applied, base, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { removeTree(applied) })
+	if err := ApplyLayer(applied, &layer); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := DiffCopy(r.Path, applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("applied layer differs from the view: %v", changes)
+	}
+}
+
+func TestApplyLayer_Escape(t *testing.T) {
+	outside := t.TempDir()
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../../escape", Mode: 0644})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: outside})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "link/file", Mode: 0644})
+	tw.Close()
+
+	if err := ApplyLayer(dir, &buf); err == nil {
+		t.Error("ApplyLayer wrote through a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err != nil {
+		t.Errorf("dot-dot entry not confined to the directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); !os.IsNotExist(err) {
+		t.Error("file written outside the directory")
+	}
+}
+
+func TestApplyLayer_Opaque(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "etc"), 0755)
+	os.WriteFile(filepath.Join(dir, "etc/old"), nil, 0644)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/new", Mode: 0644})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh..wh..opq", Mode: 0644})
+	tw.Close()
+
+	if err := ApplyLayer(dir, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "etc/old")); !os.IsNotExist(err) {
+		t.Error("opaque whiteout kept a lower entry")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "etc/new")); err != nil {
+		t.Error("opaque whiteout removed an entry of the same layer")
+	}
+}
+
+func TestApplyLayer_WhiteoutNames(t *testing.T) {
+	for _, name := range []string{".wh...", "a/.wh...", ".wh..", "a/.wh..", ".wh."} {
+		t.Run(name, func(t *testing.T) {
+			for _, overlay := range []bool{false, true} {
+				root := t.TempDir()
+				dir := filepath.Join(root, "layer")
+				os.MkdirAll(filepath.Join(dir, "a"), 0755)
+				os.WriteFile(filepath.Join(root, "sibling"), nil, 0644)
+
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644})
+				tw.Close()
+
+				if err := applyLayer(dir, &buf, overlay); err == nil {
+					t.Errorf("overlay=%v: whiteout %q accepted", overlay, name)
+				}
+				if _, err := os.Stat(filepath.Join(root, "sibling")); err != nil {
+					t.Errorf("overlay=%v: entry next to the layer removed: %v", overlay, err)
+				}
+				if fi, err := os.Lstat(filepath.Join(dir, "a")); err != nil || !fi.IsDir() {
+					t.Errorf("overlay=%v: directory holding the whiteout replaced: %v", overlay, err)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyLayer_DirReplaced(t *testing.T) {
+	outside := t.TempDir()
+	os.Chmod(outside, 0700)
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "d/", Mode: 0777})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "p/", Mode: 0755})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "p/sub/", Mode: 0777})
+	// Later entries replace both with symlinks out of the directory.
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "d", Linkname: outside})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "p", Linkname: filepath.Dir(outside)})
+	tw.Close()
+	os.Mkdir(filepath.Join(filepath.Dir(outside), "sub"), 0700)
+	t.Cleanup(func() { os.Remove(filepath.Join(filepath.Dir(outside), "sub")) })
+
+	if err := ApplyLayer(dir, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{outside, filepath.Join(filepath.Dir(outside), "sub")} {
+		if fi, err := os.Stat(p); err != nil || fi.Mode().Perm() != 0700 {
+			t.Errorf("%s changed through a replaced directory: %v %v", p, fi.Mode(), err)
+		}
+	}
+}
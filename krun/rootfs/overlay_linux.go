@@ -0,0 +1,35 @@
+package rootfs
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountOverlay mounts an overlay of upper over lowers, topmost first, at
+// merged.
+func mountOverlay(lowers []string, upper, work, merged string) error {
+	for _, p := range append([]string{upper, work}, lowers...) {
+		// The option parser splits on these.
+		if strings.ContainsAny(p, ",:\\") {
+			return fmt.Errorf("%w: overlay path %q", ErrUnsupported, p)
+		}
+	}
+	opts := "lowerdir=" + strings.Join(lowers, ":") + ",upperdir=" + upper + ",workdir=" + work
+	if err := unix.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("mount overlay: %w", err)
+	}
+	return nil
+}
+
+func unmountOverlay(merged string) error {
+	err := unix.Unmount(merged, 0)
+	if err == unix.EBUSY {
+		err = unix.Unmount(merged, unix.MNT_DETACH)
+	}
+	if err != nil {
+		return fmt.Errorf("unmount overlay: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package rootfs
+
+func mountOverlay(lowers []string, upper, work, merged string) error {
+	return ErrUnsupported
+}
+
+func unmountOverlay(merged string) error {
+	return ErrUnsupported
+}
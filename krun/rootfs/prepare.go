@@ -0,0 +1,255 @@
+package rootfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"golang.org/x/sys/unix"
+)
+
+// CABundlePath is where [Prepare] adds Spec.CACerts: the Debian, Ubuntu
+// and Alpine bundle that most TLS libraries read.
+const CABundlePath = "/etc/ssl/certs/ca-certificates.crt"
+
+// Spec declares the files [Prepare] writes into a rootfs.
+type Spec struct {
+	// Hostname is written to /etc/hostname and added to /etc/hosts.
+	Hostname string
+
+	// Hosts are extra /etc/hosts entries. /etc/hosts is generated, with
+	// localhost entries, when Hostname or Hosts is set.
+	Hosts []HostEntry
+
+	// Nameservers and Search generate /etc/resolv.conf when Nameservers
+	// is set.
+	Nameservers []string
+	Search      []string
+
+	// CACerts are PEM certificates appended to the rootfs's CA bundle at
+	// CABundlePath. If the bundle is not a regular file it is replaced by
+	// one holding just these certificates.
+	CACerts []byte
+
+	// Files are injected as given. A file at the same path as a generated
+	// one replaces it.
+	Files []File
+
+	// Metadata is the data File templates are executed with, plus
+	// "hostname" set from Hostname unless present.
+	Metadata map[string]string
+}
+
+// HostEntry is a line of /etc/hosts.
+type HostEntry struct {
+	IP    string
+	Names []string
+}
+
+// File is a file to inject into a rootfs.
+type File struct {
+	// Path is the absolute path inside the rootfs.
+	Path string
+	// Content is the file content, or with Template a text/template
+	// executed with Spec.Metadata.
+	Content  []byte
+	Template bool
+	// Mode holds the permission bits; 0 means 0644.
+	Mode os.FileMode
+	// UID and GID own the file inside the guest. They are applied only
+	// when running as root.
+	UID, GID int
+
+	appendExisting bool // add Content to the end of an existing file
+}
+
+// Prepared records what [Prepare] changed, so shared rootfs directories can
+// be restored with [Prepared.Undo].
+type Prepared struct {
+	root    string
+	changes []prepared
+}
+
+type prepared struct {
+	path    string     // absolute inside the rootfs
+	old     *fileState // nil for directories Prepare created
+	created bool       // directory created by Prepare
+}
+
+// Prepare writes the files declared by spec into the rootfs directory root.
+//
+// Every file is replaced atomically, and all paths are resolved inside root
+// without following symlinks, so a hostile rootfs cannot redirect writes
+// elsewhere; a path whose parent is a symlink is an error. Missing parent
+// directories are created. If any file fails, the ones already written are
+// restored before Prepare returns.
+func Prepare(root string, spec Spec) (*Prepared, error) {
+	files, err := spec.files()
+	if err != nil {
+		return nil, err
+	}
+	p := &Prepared{root: root}
+	for _, f := range files {
+		if err := p.write(f); err != nil {
+			p.Undo()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// files returns spec.Files, rendered, followed by the generated files they
+// do not replace.
+func (spec *Spec) files() ([]File, error) {
+	var gen []File
+	if spec.Hostname != "" {
+		gen = append(gen, File{Path: "/etc/hostname", Content: []byte(spec.Hostname + "\n")})
+	}
+	if spec.Hostname != "" || len(spec.Hosts) > 0 {
+		var b bytes.Buffer
+		b.WriteString("127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n")
+		if spec.Hostname != "" {
+			fmt.Fprintf(&b, "127.0.1.1\t%s\n", spec.Hostname)
+		}
+		for _, h := range spec.Hosts {
+			fmt.Fprintf(&b, "%s\t%s\n", h.IP, strings.Join(h.Names, " "))
+		}
+		gen = append(gen, File{Path: "/etc/hosts", Content: b.Bytes()})
+	}
+	if len(spec.Nameservers) > 0 {
+		var b bytes.Buffer
+		for _, ns := range spec.Nameservers {
+			fmt.Fprintf(&b, "nameserver %s\n", ns)
+		}
+		if len(spec.Search) > 0 {
+			fmt.Fprintf(&b, "search %s\n", strings.Join(spec.Search, " "))
+		}
+		gen = append(gen, File{Path: "/etc/resolv.conf", Content: b.Bytes()})
+	}
+	if len(spec.CACerts) > 0 {
+		gen = append(gen, File{Path: CABundlePath, Content: spec.CACerts, appendExisting: true})
+	}
+
+	data := map[string]string{"hostname": spec.Hostname}
+	for k, v := range spec.Metadata {
+		data[k] = v
+	}
+	seen := make(map[string]bool)
+	var files []File
+	for _, f := range spec.Files {
+		clean := path.Clean(f.Path)
+		if !path.IsAbs(f.Path) || clean == "/" {
+			return nil, fmt.Errorf("rootfs: invalid file path %q", f.Path)
+		}
+		if seen[clean] {
+			return nil, fmt.Errorf("rootfs: %s listed twice", clean)
+		}
+		seen[clean] = true
+		f.Path = clean
+		if f.Template {
+			t, err := template.New(clean).Option("missingkey=error").Parse(string(f.Content))
+			if err != nil {
+				return nil, fmt.Errorf("rootfs: %w", err)
+			}
+			var b bytes.Buffer
+			if err := t.Execute(&b, data); err != nil {
+				return nil, fmt.Errorf("rootfs: %w", err)
+			}
+			f.Content, f.Template = b.Bytes(), false
+		}
+		files = append(files, f)
+	}
+	for _, f := range gen {
+		if !seen[f.Path] {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (p *Prepared) write(f File) error {
+	dirfd, name, created, err := walkParent(p.root, f.Path, true)
+	for _, d := range created {
+		p.changes = append(p.changes, prepared{path: d, created: true})
+	}
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	defer unix.Close(dirfd)
+
+	old, err := readState(dirfd, name)
+	if err != nil {
+		return pathError("read", f.Path, err)
+	}
+	content := f.Content
+	if f.appendExisting && old.exists && !old.symlink {
+		content = bytes.Clone(old.content)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			content = append(content, '\n')
+		}
+		content = append(content, f.Content...)
+	}
+	mode := uint32(f.Mode.Perm())
+	if f.Mode == 0 {
+		mode = 0644
+	}
+	if f.Mode&os.ModeSetuid != 0 {
+		mode |= unix.S_ISUID
+	}
+	if f.Mode&os.ModeSetgid != 0 {
+		mode |= unix.S_ISGID
+	}
+	if err := replaceFile(dirfd, name, &fileState{content: content, mode: mode, uid: f.UID, gid: f.GID}); err != nil {
+		return pathError("write", f.Path, err)
+	}
+	p.changes = append(p.changes, prepared{path: f.Path, old: old})
+	return nil
+}
+
+// Undo restores every file Prepare replaced, with its original content,
+// mode, owner and modification time, removes the files it added and the
+// directories it created (if they are empty). Use it to return a shared
+// rootfs directory to its original state after the VM exits.
+func (p *Prepared) Undo() error {
+	var errs []error
+	for i := len(p.changes) - 1; i >= 0; i-- {
+		c := p.changes[i]
+		if err := p.restore(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	p.changes = nil
+	return errors.Join(errs...)
+}
+
+func (p *Prepared) restore(c prepared) error {
+	dirfd, name, _, err := walkParent(p.root, c.path, false)
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	defer unix.Close(dirfd)
+	switch {
+	case c.created:
+		if err := removeEntry(dirfd, name, true); err != nil && !errors.Is(err, unix.ENOTEMPTY) && !errors.Is(err, unix.EEXIST) {
+			return pathError("remove", c.path, err)
+		}
+	case !c.old.exists:
+		if err := removeEntry(dirfd, name, false); err != nil {
+			return pathError("remove", c.path, err)
+		}
+	default:
+		if err := replaceFile(dirfd, name, c.old); err != nil {
+			return pathError("restore", c.path, err)
+		}
+	}
+	return nil
+}
+
+// UndoOnExit arranges for [Prepared.Undo] to run when vm exits.
+func (p *Prepared) UndoOnExit(vm VM) {
+	vm.OnExit(func() { p.Undo() })
+}
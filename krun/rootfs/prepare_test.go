@@ -0,0 +1,128 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrepare(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "resolv.conf")
+	os.WriteFile(outside, []byte("outside\n"), 0644)
+	os.MkdirAll(filepath.Join(root, "etc/ssl/certs"), 0755)
+	os.WriteFile(filepath.Join(root, "etc/hosts"), []byte("old\n"), 0600)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(root, "etc/hosts"), mtime, mtime)
+	os.WriteFile(filepath.Join(root, CABundlePath), []byte("SYSTEM CA"), 0644)
+	if err := os.Symlink(outside, filepath.Join(root, "etc/resolv.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Prepare(root, Spec{
+		Hostname:    "vm1",
+		Hosts:       []HostEntry{{IP: "10.0.0.1", Names: []string{"gateway"}}},
+		Nameservers: []string{"1.1.1.1"},
+		Search:      []string{"example.com"},
+		CACerts:     []byte("MY CA\n"),
+		Files: []File{{
+			Path:     "/opt/app/config",
+			Content:  []byte("name={{.hostname}} env={{.env}}\n"),
+			Template: true,
+			Mode:     0600,
+		}},
+		Metadata: map[string]string{"env": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"etc/hostname":    "vm1\n",
+		"etc/hosts":       "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n127.0.1.1\tvm1\n10.0.0.1\tgateway\n",
+		"etc/resolv.conf": "nameserver 1.1.1.1\nsearch example.com\n",
+		"opt/app/config":  "name=vm1 env=test\n",
+		CABundlePath[1:]:  "SYSTEM CA\nMY CA\n",
+	} {
+		if got := readFile(t, filepath.Join(root, path)); got != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+	if fi, err := os.Lstat(filepath.Join(root, "etc/resolv.conf")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("resolv.conf symlink not replaced: %v", err)
+	}
+	if got := readFile(t, outside); got != "outside\n" {
+		t.Errorf("write followed a symlink out of the rootfs: %q", got)
+	}
+	if fi, _ := os.Stat(filepath.Join(root, "opt/app/config")); fi.Mode().Perm() != 0600 {
+		t.Errorf("config mode = %v", fi.Mode())
+	}
+
+	if err := p.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(root, "etc/hosts")); got != "old\n" {
+		t.Errorf("hosts not restored: %q", got)
+	}
+	if fi, _ := os.Stat(filepath.Join(root, "etc/hosts")); fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("hosts metadata not restored: %v %v", fi.Mode(), fi.ModTime())
+	}
+	if target, err := os.Readlink(filepath.Join(root, "etc/resolv.conf")); err != nil || target != outside {
+		t.Errorf("resolv.conf symlink not restored: %q, %v", target, err)
+	}
+	if got := readFile(t, filepath.Join(root, CABundlePath)); got != "SYSTEM CA" {
+		t.Errorf("CA bundle not restored: %q", got)
+	}
+	for _, path := range []string{"etc/hostname", "opt"} {
+		if _, err := os.Lstat(filepath.Join(root, path)); !os.IsNotExist(err) {
+			t.Errorf("%s not removed", path)
+		}
+	}
+}
+
+func TestPrepare_SymlinkParent(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Prepare(root, Spec{Hostname: "vm1"}); err == nil {
+		t.Error("Prepare wrote through a symlinked directory")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "hostname")); !os.IsNotExist(err) {
+		t.Error("file written outside the rootfs")
+	}
+}
+
+func TestPrepare_Errors(t *testing.T) {
+	root := t.TempDir()
+	for name, spec := range map[string]Spec{
+		"relative path": {Files: []File{{Path: "etc/motd"}}},
+		"duplicate":     {Files: []File{{Path: "/a"}, {Path: "/a/"}}},
+		"missing key":   {Files: []File{{Path: "/a", Content: []byte("{{.nope}}"), Template: true}}},
+	} {
+		if _, err := Prepare(root, spec); err == nil {
+			t.Errorf("%s: Prepare succeeded", name)
+		}
+	}
+	// Files too large to snapshot are refused rather than read whole.
+	big, err := os.Create(filepath.Join(root, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	big.Truncate(maxStateSize + 1)
+	big.Close()
+	if _, err := Prepare(root, Spec{Files: []File{{Path: "/big", Content: []byte("x")}}}); err == nil {
+		t.Error("Prepare read a file larger than maxStateSize")
+	}
+	// A failure part-way restores the files already written.
+	os.WriteFile(filepath.Join(root, "file"), nil, 0644)
+	_, err = Prepare(root, Spec{Files: []File{{Path: "/new", Content: []byte("x")}, {Path: "/file/below"}}})
+	if err == nil {
+		t.Fatal("Prepare wrote below a regular file")
+	}
+	if _, err := os.Stat(filepath.Join(root, "new")); !os.IsNotExist(err) {
+		t.Error("partial Prepare not rolled back")
+	}
+}
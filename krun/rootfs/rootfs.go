@@ -0,0 +1,244 @@
+// Package rootfs prepares root filesystem directories for microVMs started
+// with [krun.Context.SetRoot].
+//
+// [Ephemeral] gives each VM a private, writable view of a shared base
+// directory, so many VMs can boot from one tree without seeing each other's
+// writes:
+//
+//	root, err := rootfs.Ephemeral("/images/alpine", rootfs.EphemeralOptions{})
+//	...
+//	err = root.Attach(ctx) // SetRoot, and remove the view when the VM exits
+//
+// With KeepUpper, what the VM changed can be listed with [Root.Diff] and
+// saved as an OCI layer with [Root.Commit]; [ApplyLayer] turns it back into
+// a rootfs directory.
+//
+// A [Snapshotter] unpacks OCI image layers once into snapshots shared by
+// every VM on the host and assembles per-VM roots from them:
+//
+//	s, err := rootfs.NewSnapshotter("/var/lib/krun/snapshots", rootfs.ModeAuto)
+//	...
+//	view, err := s.View(layers) // unpacks the layers not seen before
+//	...
+//	err = view.Attach(ctx)
+//
+// [Prepare] writes per-VM files such as /etc/hostname, /etc/resolv.conf and
+// extra CA certificates into a rootfs without following symlinks out of it,
+// and can undo them afterwards.
+//
+// [krun.Context.SetRoot]: https://pkg.go.dev/github.com/mishushakov/libkrun-go/krun#Context.SetRoot
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// VM is the part of *krun.Context this package uses.
+type VM interface {
+	SetRoot(path string) error
+	OnExit(fn func())
+}
+
+// Mode is how an ephemeral view is made writable.
+type Mode int
+
+const (
+	// ModeAuto tries ModeOverlay, then ModeClone, then ModeCopy.
+	ModeAuto Mode = iota
+	// ModeOverlay mounts overlayfs with the base as the lower layer. It
+	// needs permission to mount (root, or CAP_SYS_ADMIN) and Linux.
+	ModeOverlay
+	// ModeClone copies the tree with every regular file cloned (reflinks on
+	// Linux, clonefile on macOS), which is fast and shares disk blocks but
+	// needs the view on the same filesystem as the base.
+	ModeClone
+	// ModeCopy copies the tree. On Linux the kernel copies file data with
+	// copy_file_range where it can.
+	//
+	// Like [Copy], the copying modes leave out sockets, and device nodes
+	// when the caller may not create them, so the view lacks entries an
+	// overlay view of the same base has.
+	ModeCopy
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeAuto:
+		return "auto"
+	case ModeOverlay:
+		return "overlay"
+	case ModeClone:
+		return "clone"
+	case ModeCopy:
+		return "copy"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// ErrUnsupported is returned when the requested Mode is not available.
+var ErrUnsupported = errors.New("rootfs: mode not supported")
+
+// EphemeralOptions configures [Ephemeral].
+type EphemeralOptions struct {
+	// Dir is where the view's state directory is created. For ModeClone it
+	// must be on the same filesystem as the base. Empty means os.TempDir().
+	Dir string
+
+	// Mode forces a particular strategy. Zero means ModeAuto.
+	Mode Mode
+
+	// KeepUpper keeps the writable layer when the view is closed, for
+	// inspection with [Root.Diff] or [Root.Commit]. Its path is Root.Upper.
+	KeepUpper bool
+}
+
+// Root is a private, writable view of a base rootfs directory.
+type Root struct {
+	// Base is the shared, unmodified rootfs directory.
+	Base string
+	// Path is the view to pass to SetRoot.
+	Path string
+	// Upper holds the VM's writes: the overlayfs upper directory, or for
+	// the copying modes the whole copy.
+	Upper string
+	// Mode is the strategy in use; never ModeAuto.
+	Mode Mode
+
+	state     string // directory holding everything the view created
+	keepUpper bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Ephemeral creates a private, writable view of the rootfs directory base.
+// The caller must call [Root.Close], or [Root.Attach] to have the VM do so
+// when it exits. Views made by copying lack the base's sockets, and its
+// device nodes without the privilege to create them; see [ModeCopy].
+func Ephemeral(base string, opts EphemeralOptions) (*Root, error) {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+	if fi, err := os.Stat(base); err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("rootfs: %s is not a directory", base)
+	}
+	state, err := os.MkdirTemp(opts.Dir, "krun-rootfs-")
+	if err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+	r := &Root{Base: base, state: state, keepUpper: opts.KeepUpper}
+
+	modes := []Mode{opts.Mode}
+	if opts.Mode == ModeAuto {
+		modes = []Mode{ModeOverlay, ModeClone, ModeCopy}
+	}
+	var errs []error
+	for _, m := range modes {
+		if err := r.setup(m); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m, err))
+			continue
+		}
+		r.Mode = m
+		return r, nil
+	}
+	removeTree(state)
+	return nil, fmt.Errorf("rootfs: %w", errors.Join(errs...))
+}
+
+func (r *Root) setup(m Mode) error {
+	switch m {
+	case ModeOverlay:
+		upper := filepath.Join(r.state, "upper")
+		work := filepath.Join(r.state, "work")
+		merged := filepath.Join(r.state, "merged")
+		for _, d := range []string{upper, work, merged} {
+			if err := os.Mkdir(d, 0755); err != nil {
+				return err
+			}
+		}
+		if err := mountOverlay([]string{r.Base}, upper, work, merged); err != nil {
+			os.Remove(upper)
+			os.Remove(work)
+			os.Remove(merged)
+			return err
+		}
+		r.Path, r.Upper = merged, upper
+	case ModeClone, ModeCopy:
+		dst := filepath.Join(r.state, "root")
+		if err := copyTree(dst, r.Base, m == ModeClone); err != nil {
+			removeTree(dst)
+			return err
+		}
+		r.Path, r.Upper = dst, dst
+	default:
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// Attach sets the view as vm's root filesystem and closes it when the VM
+// exits.
+func (r *Root) Attach(vm VM) error {
+	if err := vm.SetRoot(r.Path); err != nil {
+		return err
+	}
+	vm.OnExit(func() { r.Close() })
+	return nil
+}
+
+// Close removes the view. With KeepUpper the writable layer stays at
+// r.Upper. Close is safe to call more than once.
+func (r *Root) Close() error {
+	r.closeOnce.Do(func() { r.closeErr = r.close() })
+	return r.closeErr
+}
+
+func (r *Root) close() error {
+	if r.Mode == ModeOverlay {
+		if err := unmountOverlay(r.Path); err != nil {
+			return fmt.Errorf("rootfs: %w", err)
+		}
+	}
+	if !r.keepUpper {
+		return removeTree(r.state)
+	}
+	// Keep only the writable layer.
+	entries, err := os.ReadDir(r.state)
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	for _, e := range entries {
+		if p := filepath.Join(r.state, e.Name()); p != r.Upper {
+			if err := removeTree(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeTree removes path and everything below it, making directories
+// writable first so read-only directories copied from a rootfs do not stop
+// the removal.
+func removeTree(path string) error {
+	if err := os.RemoveAll(path); err == nil {
+		return nil
+	}
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeVM records what Attach does to a *krun.Context.
+type fakeVM struct {
+	root  string
+	hooks []func()
+}
+
+func (vm *fakeVM) SetRoot(path string) error {
+	vm.root = path
+	return nil
+}
+
+func (vm *fakeVM) OnExit(fn func()) {
+	vm.hooks = append(vm.hooks, fn)
+}
+
+func (vm *fakeVM) exit() {
+	for _, fn := range vm.hooks {
+		fn()
+	}
+}
+
+func newTestBase(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	for name, content := range map[string]string{
+		"etc/hostname": "base\n",
+		"bin/sh":       "#!/bin/true\n",
+	} {
+		p := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(base, "bin/sh"), filepath.Join(base, "bin/ash")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sh", filepath.Join(base, "bin/link")); err != nil {
+		t.Fatal(err)
+	}
+	// A read-only directory must not stop the copy or the cleanup.
+	if err := os.Mkdir(filepath.Join(base, "ro"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "ro/file"), nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(base, "ro"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(base, "ro"), 0755) })
+	return base
+}
+
+func ephemeral(t *testing.T, base string, opts EphemeralOptions) *Root {
+	t.Helper()
+	if opts.Dir == "" {
+		opts.Dir = t.TempDir()
+	}
+	r, err := Ephemeral(base, opts)
+	if err != nil {
+		if opts.Mode != ModeAuto && opts.Mode != ModeCopy {
+			t.Skipf("%s not available: %v", opts.Mode, err)
+		}
+		t.Fatal(err)
+	}
+	return r
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestEphemeral(t *testing.T) {
+	for _, mode := range []Mode{ModeAuto, ModeOverlay, ModeClone, ModeCopy} {
+		t.Run(mode.String(), func(t *testing.T) {
+			base := newTestBase(t)
+			r := ephemeral(t, base, EphemeralOptions{Mode: mode})
+			if mode != ModeAuto && r.Mode != mode {
+				t.Errorf("Mode = %s, want %s", r.Mode, mode)
+			}
+			if got := readFile(t, filepath.Join(r.Path, "etc/hostname")); got != "base\n" {
+				t.Errorf("view hostname = %q", got)
+			}
+			if err := os.WriteFile(filepath.Join(r.Path, "etc/hostname"), []byte("vm\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(r.Path, "ro/new"), nil, 0644); err != nil && os.Geteuid() == 0 {
+				t.Fatal(err)
+			}
+			if got := readFile(t, filepath.Join(base, "etc/hostname")); got != "base\n" {
+				t.Errorf("write through view reached the base: %q", got)
+			}
+			if target, err := os.Readlink(filepath.Join(r.Path, "bin/link")); err != nil || target != "sh" {
+				t.Errorf("symlink = %q, %v", target, err)
+			}
+			a, _ := os.Stat(filepath.Join(r.Path, "bin/sh"))
+			b, _ := os.Stat(filepath.Join(r.Path, "bin/ash"))
+			if a == nil || b == nil || !os.SameFile(a, b) {
+				t.Error("hardlink not preserved")
+			}
+			if fi, err := os.Stat(filepath.Join(r.Path, "ro")); err != nil || fi.Mode().Perm() != 0555 {
+				t.Errorf("ro mode = %v, %v", fi.Mode(), err)
+			}
+
+			vm := &fakeVM{}
+			if err := r.Attach(vm); err != nil {
+				t.Fatal(err)
+			}
+			if vm.root != r.Path {
+				t.Errorf("SetRoot(%q), want %q", vm.root, r.Path)
+			}
+			vm.exit()
+			if _, err := os.Stat(r.state); !os.IsNotExist(err) {
+				t.Errorf("view not removed on exit: %v", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("second Close = %v", err)
+			}
+		})
+	}
+}
+
+func TestEphemeral_KeepUpper(t *testing.T) {
+	base := newTestBase(t)
+	r := ephemeral(t, base, EphemeralOptions{KeepUpper: true})
+	if err := os.WriteFile(filepath.Join(r.Path, "result"), []byte("42"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(r.Upper, "result")); got != "42" {
+		t.Errorf("upper result = %q", got)
+	}
+	if r.Path != r.Upper {
+		if _, err := os.Stat(r.Path); !os.IsNotExist(err) {
+			t.Errorf("merged view not removed: %v", err)
+		}
+	}
+	removeTree(r.state)
+}
+
+func TestEphemeral_NotDir(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(f, nil, 0644)
+	if _, err := Ephemeral(f, EphemeralOptions{Dir: t.TempDir()}); err == nil {
+		t.Error("Ephemeral accepted a regular file")
+	}
+}
@@ -0,0 +1,192 @@
+package rootfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The functions in this file modify a rootfs through directory file
+// descriptors opened with O_NOFOLLOW, so a hostile tree cannot redirect
+// writes outside itself with symlinks, not even by swapping components
+// while the writes are in progress.
+
+// walkParent opens the directory containing the slash-separated path rel
+// inside root and returns it with the final path element. Missing
+// directories are created with mode 0755 when create is set and reported
+// in created, outermost first.
+func walkParent(root, rel string, create bool) (dirfd int, name string, created []string, err error) {
+	parts := strings.Split(strings.Trim(rel, "/"), "/")
+	name = parts[len(parts)-1]
+	dirfd, err = unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	walked := ""
+	for _, part := range parts[:len(parts)-1] {
+		walked += "/" + part
+		fd, err := unix.Openat(dirfd, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if errors.Is(err, unix.ENOENT) && create {
+			if err = unix.Mkdirat(dirfd, part, 0755); err == nil {
+				created = append(created, walked)
+				fd, err = unix.Openat(dirfd, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			}
+		}
+		unix.Close(dirfd)
+		if err != nil {
+			if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.ENOTDIR) {
+				err = errors.New("symlink or not a directory")
+			}
+			return -1, "", created, &os.PathError{Op: "open", Path: walked, Err: err}
+		}
+		dirfd = fd
+	}
+	return dirfd, name, created, nil
+}
+
+// maxStateSize caps the files readState reads into memory. The files
+// Prepare replaces are small configuration files; a larger one is more
+// likely a hostile image trying to exhaust the host's memory.
+const maxStateSize = 16 << 20
+
+// fileState is a snapshot of a file in the rootfs, for writing and restoring.
+type fileState struct {
+	exists  bool
+	symlink bool
+	target  string // symlink target
+	content []byte
+	mode    uint32 // permission bits
+	uid     int
+	gid     int
+	mtime   unix.Timespec
+}
+
+// readState snapshots name in dirfd without following a final symlink.
+// Only regular files and symlinks can be read, files of at most
+// maxStateSize bytes.
+func readState(dirfd int, name string) (*fileState, error) {
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); errors.Is(err, unix.ENOENT) {
+		return &fileState{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	e := &fileState{exists: true, mode: uint32(st.Mode) & 07777, uid: int(st.Uid), gid: int(st.Gid), mtime: st.Mtim}
+	switch uint32(st.Mode) & unix.S_IFMT {
+	case unix.S_IFLNK:
+		buf := make([]byte, unix.PathMax)
+		n, err := unix.Readlinkat(dirfd, name, buf)
+		if err != nil {
+			return nil, err
+		}
+		e.symlink, e.target = true, string(buf[:n])
+	case unix.S_IFREG:
+		fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+		f := os.NewFile(uintptr(fd), name)
+		defer f.Close()
+		if st.Size > maxStateSize {
+			return nil, fmt.Errorf("file larger than %d bytes", maxStateSize)
+		}
+		// The file can grow after the Fstatat, so the read is capped too.
+		buf, err := io.ReadAll(io.LimitReader(f, maxStateSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > maxStateSize {
+			return nil, fmt.Errorf("file larger than %d bytes", maxStateSize)
+		}
+		e.content = buf
+	default:
+		return nil, errors.New("not a regular file or symlink")
+	}
+	return e, nil
+}
+
+// replaceFile atomically replaces name in dirfd with e: the new file is
+// written under a temporary name and renamed over the old one, so readers
+// see either version in full. Owners are applied only when running as root.
+func replaceFile(dirfd int, name string, e *fileState) error {
+	var suffix [6]byte
+	rand.Read(suffix[:])
+	tmp := "." + name + ".krun-" + hex.EncodeToString(suffix[:])
+	if len(tmp) > 255 {
+		tmp = ".krun-" + hex.EncodeToString(suffix[:])
+	}
+
+	if err := writeTemp(dirfd, tmp, e); err != nil {
+		unix.Unlinkat(dirfd, tmp, 0)
+		return err
+	}
+	if err := unix.Renameat(dirfd, tmp, dirfd, name); err != nil {
+		unix.Unlinkat(dirfd, tmp, 0)
+		return err
+	}
+	return nil
+}
+
+func writeTemp(dirfd int, tmp string, e *fileState) error {
+	if e.symlink {
+		if err := unix.Symlinkat(e.target, dirfd, tmp); err != nil {
+			return err
+		}
+		if os.Geteuid() == 0 {
+			if err := unix.Fchownat(dirfd, tmp, e.uid, e.gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	fd, err := unix.Openat(dirfd, tmp, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), tmp)
+	defer f.Close()
+	if _, err := f.Write(e.content); err != nil {
+		return err
+	}
+	if os.Geteuid() == 0 {
+		if err := f.Chown(e.uid, e.gid); err != nil {
+			return err
+		}
+	}
+	// After chown, which clears the setuid and setgid bits.
+	if err := unix.Fchmod(fd, e.mode); err != nil {
+		return err
+	}
+	if e.mtime != (unix.Timespec{}) {
+		if err := unix.UtimesNanoAt(dirfd, tmp, []unix.Timespec{e.mtime, e.mtime}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// removeEntry removes name from dirfd; a missing entry is not an error.
+func removeEntry(dirfd int, name string, dir bool) error {
+	flags := 0
+	if dir {
+		flags = unix.AT_REMOVEDIR
+	}
+	if err := unix.Unlinkat(dirfd, name, flags); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+func pathError(op, path string, err error) error {
+	return fmt.Errorf("rootfs: %w", &os.PathError{Op: op, Path: path, Err: err})
+}
@@ -0,0 +1,580 @@
+package rootfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Layer is an OCI image layer to unpack.
+type Layer struct {
+	// DiffID is the digest of the uncompressed layer tar, as listed in the
+	// image config's rootfs.diff_ids ("sha256:...").
+	DiffID string
+	// Open returns the uncompressed layer tar. It is only called for
+	// layers not unpacked yet.
+	Open func() (io.ReadCloser, error)
+}
+
+// Snapshotter unpacks OCI layers into a directory shared by every VM and
+// process on the host, and assembles per-VM roots from them.
+//
+// Each layer is unpacked once per chain of layers below it, into a
+// snapshot named by the OCI chain ID, so images sharing base layers share
+// their snapshots. With ModeOverlay a snapshot holds only its layer, and
+// views stack the snapshots with overlayfs. With ModeCopy a snapshot is
+// the whole tree up to its layer, cloned from the one below where the
+// filesystem supports it, and views are copies of it.
+//
+// A snapshot is kept while an image tag or a view uses it or a snapshot
+// above it; [Snapshotter.Prune] removes the rest. Views are held with
+// flock(2) locks, so the snapshots of a process that dies are released
+// with it.
+//
+// The directory holds:
+//
+//	mode              the Mode snapshots are stored for
+//	lock              flock(2)ed shared by writers, exclusively by Prune
+//	snapshots/HEX/    fs/ (the tree) and parent (the chain ID below)
+//	images/NAME       the chain ID a tag points at
+//	views/ID/         lock, snapshot, and upper/, work/, merged/ or root/
+//	tmp/              snapshots being unpacked
+type Snapshotter struct {
+	dir  string
+	mode Mode
+}
+
+// ErrDiffID is returned when a layer's content does not match its DiffID.
+var ErrDiffID = errors.New("rootfs: layer does not match its diff ID")
+
+// NewSnapshotter opens the snapshotter in dir, creating it if needed. mode
+// is ModeAuto, ModeOverlay or ModeCopy; ModeAuto picks ModeOverlay where
+// overlayfs can be mounted. A directory keeps the mode it was created
+// with.
+func NewSnapshotter(dir string, mode Mode) (*Snapshotter, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+	for _, d := range []string{"snapshots", "images", "views", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("rootfs: %w", err)
+		}
+	}
+	s := &Snapshotter{dir: dir}
+	modeFile := filepath.Join(dir, "mode")
+	if data, err := os.ReadFile(modeFile); err == nil {
+		switch string(data) {
+		case ModeOverlay.String():
+			s.mode = ModeOverlay
+		case ModeCopy.String():
+			s.mode = ModeCopy
+		default:
+			return nil, fmt.Errorf("rootfs: %s: unknown mode %q", modeFile, data)
+		}
+		if mode != ModeAuto && mode != s.mode {
+			return nil, fmt.Errorf("%w: %s holds %s snapshots", ErrUnsupported, dir, s.mode)
+		}
+		return s, nil
+	}
+
+	switch mode {
+	case ModeAuto:
+		s.mode = ModeCopy
+		if s.probeOverlay() == nil {
+			s.mode = ModeOverlay
+		}
+	case ModeOverlay:
+		if err := s.probeOverlay(); err != nil {
+			return nil, fmt.Errorf("rootfs: %w", err)
+		}
+		s.mode = mode
+	case ModeCopy:
+		s.mode = mode
+	default:
+		return nil, ErrUnsupported
+	}
+	if err := s.writeFile(modeFile, s.mode.String()); err != nil {
+		return nil, err
+	}
+	// Another process may have created the directory meanwhile.
+	return NewSnapshotter(dir, mode)
+}
+
+// probeOverlay checks that overlayfs can be mounted in s.dir.
+func (s *Snapshotter) probeOverlay() error {
+	tmp, err := os.MkdirTemp(filepath.Join(s.dir, "tmp"), "probe-")
+	if err != nil {
+		return err
+	}
+	defer removeTree(tmp)
+	var dirs []string
+	for _, d := range []string{"lower", "upper", "work", "merged"} {
+		dirs = append(dirs, filepath.Join(tmp, d))
+		if err := os.Mkdir(dirs[len(dirs)-1], 0755); err != nil {
+			return err
+		}
+	}
+	if err := mountOverlay(dirs[:1], dirs[1], dirs[2], dirs[3]); err != nil {
+		return err
+	}
+	return unmountOverlay(dirs[3])
+}
+
+// Mode returns ModeOverlay or ModeCopy.
+func (s *Snapshotter) Mode() Mode { return s.mode }
+
+// lock takes the snapshotter lock, shared or exclusive (unix.LOCK_SH or
+// unix.LOCK_EX), and returns the function releasing it.
+func (s *Snapshotter) lock(how int) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(s.dir, "lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+	if err := flock(f, how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("rootfs: lock: %w", err)
+	}
+	return func() { f.Close() }, nil
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// writeFile replaces path with data through a file in the tmp
+// directory.
+func (s *Snapshotter) writeFile(path, data string) error {
+	f, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "write-")
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	_, err = f.WriteString(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	return nil
+}
+
+// digestHex returns the hex part of a "sha256:" digest.
+func digestHex(d string) (string, error) {
+	h, ok := strings.CutPrefix(d, "sha256:")
+	if _, err := hex.DecodeString(h); !ok || err != nil || len(h) != 2*sha256.Size || strings.ToLower(h) != h {
+		return "", fmt.Errorf("rootfs: invalid digest %q", d)
+	}
+	return h, nil
+}
+
+// ChainID returns the OCI chain ID of layers, which names the snapshot
+// holding them.
+func ChainID(layers []Layer) (string, error) {
+	var chain string
+	for _, l := range layers {
+		if _, err := digestHex(l.DiffID); err != nil {
+			return "", err
+		}
+		if chain == "" {
+			chain = l.DiffID
+			continue
+		}
+		chain = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(chain+" "+l.DiffID)))
+	}
+	if chain == "" {
+		return "", errors.New("rootfs: no layers")
+	}
+	return chain, nil
+}
+
+func (s *Snapshotter) snapshotDir(chain string) string {
+	h, _ := digestHex(chain)
+	return filepath.Join(s.dir, "snapshots", h)
+}
+
+// unpack makes sure a snapshot exists for every prefix of layers and
+// returns the top one's chain ID. The caller holds the lock shared.
+func (s *Snapshotter) unpack(layers []Layer) (string, error) {
+	var parent string
+	for i := range layers {
+		chain, err := ChainID(layers[:i+1])
+		if err != nil {
+			return "", err
+		}
+		if err := s.unpackLayer(chain, parent, layers[i]); err != nil {
+			return "", err
+		}
+		parent = chain
+	}
+	if parent == "" {
+		return "", errors.New("rootfs: no layers")
+	}
+	return parent, nil
+}
+
+func (s *Snapshotter) unpackLayer(chain, parent string, l Layer) error {
+	dst := s.snapshotDir(chain)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	// One process unpacks; the others wait for it and find the snapshot.
+	h, _ := digestHex(chain)
+	lf, err := os.OpenFile(filepath.Join(s.dir, "tmp", h+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	defer lf.Close()
+	if err := flock(lf, unix.LOCK_EX); err != nil {
+		return fmt.Errorf("rootfs: lock: %w", err)
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Join(s.dir, "tmp"), "unpack-")
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	defer removeTree(tmp)
+	root := filepath.Join(tmp, "fs")
+	if s.mode == ModeCopy && parent != "" {
+		if err := Copy(root, filepath.Join(s.snapshotDir(parent), "fs")); err != nil {
+			return err
+		}
+	} else if err := os.Mkdir(root, 0755); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+
+	rc, err := l.Open()
+	if err != nil {
+		return fmt.Errorf("rootfs: open layer %s: %w", l.DiffID, err)
+	}
+	defer rc.Close()
+	hash := sha256.New()
+	r := io.TeeReader(rc, hash)
+	if err := applyLayer(root, r, s.mode == ModeOverlay); err != nil {
+		return err
+	}
+	// Hash the padding after the end of the archive too.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	if got := fmt.Sprintf("sha256:%x", hash.Sum(nil)); got != l.DiffID {
+		return fmt.Errorf("%w: got %s, want %s", ErrDiffID, got, l.DiffID)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, "parent"), []byte(parent), 0644); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	return nil
+}
+
+// chain returns the chain IDs from chain down to the base layer.
+func (s *Snapshotter) chain(chain string) ([]string, error) {
+	var ids []string
+	for chain != "" {
+		ids = append(ids, chain)
+		parent, err := os.ReadFile(filepath.Join(s.snapshotDir(chain), "parent"))
+		if err != nil {
+			return nil, fmt.Errorf("rootfs: snapshot %s: %w", chain, err)
+		}
+		chain = string(parent)
+	}
+	return ids, nil
+}
+
+func (s *Snapshotter) imagePath(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("rootfs: empty image name")
+	}
+	return filepath.Join(s.dir, "images", url.PathEscape(name)), nil
+}
+
+// Tag unpacks layers and keeps them as the image name until
+// [Snapshotter.Untag]. It returns the top snapshot's chain ID.
+func (s *Snapshotter) Tag(name string, layers []Layer) (string, error) {
+	path, err := s.imagePath(name)
+	if err != nil {
+		return "", err
+	}
+	unlock, err := s.lock(unix.LOCK_SH)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	chain, err := s.unpack(layers)
+	if err != nil {
+		return "", err
+	}
+	if err := s.writeFile(path, chain); err != nil {
+		return "", err
+	}
+	return chain, nil
+}
+
+// Untag drops the image name and removes the snapshots nothing else uses.
+func (s *Snapshotter) Untag(name string) error {
+	path, err := s.imagePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	return s.Prune()
+}
+
+// View is a private, writable root assembled from snapshots.
+type View struct {
+	// Path is the root to pass to SetRoot.
+	Path string
+	// Mode is ModeOverlay or ModeCopy.
+	Mode Mode
+	// Snapshot is the chain ID of the top snapshot.
+	Snapshot string
+
+	s         *Snapshotter
+	dir       string
+	lock      *os.File
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// View unpacks the layers not unpacked yet and assembles a private,
+// writable root from them. The caller must call [View.Close], or
+// [View.Attach] to have the VM do so when it exits.
+func (s *Snapshotter) View(layers []Layer) (*View, error) {
+	unlock, err := s.lock(unix.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	chain, err := s.unpack(layers)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := s.chain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Join(s.dir, "views"), "")
+	if err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+	v := &View{Mode: s.mode, Snapshot: chain, s: s, dir: dir}
+	if err := v.setup(ids); err != nil {
+		if v.lock != nil {
+			v.lock.Close()
+		}
+		removeTree(dir)
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *View) setup(ids []string) error {
+	// The lock marks the view live; Prune takes stale views apart.
+	f, err := os.Create(filepath.Join(v.dir, "lock"))
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	v.lock = f
+	if err := flock(f, unix.LOCK_SH); err != nil {
+		return fmt.Errorf("rootfs: lock: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(v.dir, "snapshot"), []byte(v.Snapshot), 0644); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+
+	if v.Mode == ModeCopy {
+		v.Path = filepath.Join(v.dir, "root")
+		return Copy(v.Path, filepath.Join(v.s.snapshotDir(ids[0]), "fs"))
+	}
+	lowers := make([]string, len(ids))
+	for i, id := range ids {
+		lowers[i] = filepath.Join(v.s.snapshotDir(id), "fs")
+	}
+	upper := filepath.Join(v.dir, "upper")
+	work := filepath.Join(v.dir, "work")
+	merged := filepath.Join(v.dir, "merged")
+	for _, d := range []string{upper, work, merged} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return fmt.Errorf("rootfs: %w", err)
+		}
+	}
+	if err := mountOverlay(lowers, upper, work, merged); err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	v.Path = merged
+	return nil
+}
+
+// Attach sets the view as vm's root filesystem and closes it when the VM
+// exits.
+func (v *View) Attach(vm VM) error {
+	if err := vm.SetRoot(v.Path); err != nil {
+		return err
+	}
+	vm.OnExit(func() { v.Close() })
+	return nil
+}
+
+// Close removes the view and the snapshots nothing uses any more. It is
+// safe to call more than once.
+func (v *View) Close() error {
+	v.closeOnce.Do(func() {
+		v.closeErr = v.s.removeView(v.dir)
+		v.lock.Close()
+		if v.closeErr == nil {
+			v.closeErr = v.s.Prune()
+		}
+	})
+	return v.closeErr
+}
+
+// removeView takes apart the view in dir.
+func (s *Snapshotter) removeView(dir string) error {
+	if s.mode == ModeOverlay {
+		merged := filepath.Join(dir, "merged")
+		if err := unmountOverlay(merged); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("rootfs: %w", err)
+		}
+	}
+	return removeTree(dir)
+}
+
+// Prune removes stale views left by processes that died and the snapshots
+// no image tag or view uses.
+func (s *Snapshotter) Prune() error {
+	unlock, err := s.lock(unix.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Holding the lock exclusively, nothing is being unpacked.
+	if err := clearDir(filepath.Join(s.dir, "tmp")); err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	keep := func(chain string) error {
+		ids, err := s.chain(chain)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			h, _ := digestHex(id)
+			used[h] = true
+		}
+		return nil
+	}
+	images, err := os.ReadDir(filepath.Join(s.dir, "images"))
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	for _, e := range images {
+		chain, err := os.ReadFile(filepath.Join(s.dir, "images", e.Name()))
+		if err != nil {
+			return fmt.Errorf("rootfs: %w", err)
+		}
+		if err := keep(string(chain)); err != nil {
+			return err
+		}
+	}
+	views, err := os.ReadDir(filepath.Join(s.dir, "views"))
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	for _, e := range views {
+		dir := filepath.Join(s.dir, "views", e.Name())
+		live, err := viewLive(dir)
+		if err != nil {
+			return err
+		}
+		if !live {
+			if err := s.removeView(dir); err != nil {
+				return err
+			}
+			continue
+		}
+		chain, err := os.ReadFile(filepath.Join(dir, "snapshot"))
+		if err != nil {
+			return fmt.Errorf("rootfs: %w", err)
+		}
+		if err := keep(string(chain)); err != nil {
+			return err
+		}
+	}
+
+	snapshots, err := os.ReadDir(filepath.Join(s.dir, "snapshots"))
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	for _, e := range snapshots {
+		if !used[e.Name()] {
+			if err := removeTree(filepath.Join(s.dir, "snapshots", e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// viewLive reports whether the process owning the view in dir still holds
+// its lock.
+func viewLive(dir string) (bool, error) {
+	f, err := os.Open(filepath.Join(dir, "lock"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("rootfs: %w", err)
+	}
+	defer f.Close()
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("rootfs: lock: %w", err)
+	}
+	return false, nil
+}
+
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("rootfs: %w", err)
+	}
+	for _, e := range entries {
+		if err := removeTree(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLayer builds a layer from tar headers; regular files get their name
+// as content. opened counts how often the layer is read.
+func testLayer(t *testing.T, opened *int, hdrs ...*tar.Header) Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			io.WriteString(tw, hdr.Name)
+		}
+	}
+	tw.Close()
+	data := buf.Bytes()
+	return Layer{
+		DiffID: fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Open: func() (io.ReadCloser, error) {
+			*opened++
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+func TestSnapshotter(t *testing.T) {
+	for _, mode := range []Mode{ModeOverlay, ModeCopy} {
+		t.Run(mode.String(), func(t *testing.T) {
+			s, err := NewSnapshotter(t.TempDir(), mode)
+			if err != nil {
+				if mode == ModeOverlay {
+					t.Skipf("overlay not available: %v", err)
+				}
+				t.Fatal(err)
+			}
+			var opens int
+			base := testLayer(t, &opens,
+				&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0644},
+				&tar.Header{Typeflag: tar.TypeDir, Name: "var/", Mode: 0755},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "var/cache", Mode: 0644},
+			)
+			app := testLayer(t, &opens,
+				&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.motd", Mode: 0644},
+				&tar.Header{Typeflag: tar.TypeDir, Name: "var/", Mode: 0755},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "var/.wh..wh..opq", Mode: 0644},
+				&tar.Header{Typeflag: tar.TypeReg, Name: "var/app", Mode: 0644},
+			)
+			other := testLayer(t, &opens, &tar.Header{Typeflag: tar.TypeReg, Name: "other", Mode: 0644})
+
+			if _, err := s.Tag("app", []Layer{base, app}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Tag("other", []Layer{base, other}); err != nil {
+				t.Fatal(err)
+			}
+			if opens != 3 {
+				t.Errorf("layers opened %d times, want 3", opens)
+			}
+
+			v, err := s.View([]Layer{base, app})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Mode != mode {
+				t.Errorf("Mode = %s, want %s", v.Mode, mode)
+			}
+			if got := readFile(t, filepath.Join(v.Path, "etc/hostname")); got != "etc/hostname" {
+				t.Errorf("hostname = %q", got)
+			}
+			for _, gone := range []string{"etc/motd", "var/cache"} {
+				if _, err := os.Lstat(filepath.Join(v.Path, gone)); !os.IsNotExist(err) {
+					t.Errorf("%s visible in the view: %v", gone, err)
+				}
+			}
+			if got := readFile(t, filepath.Join(v.Path, "var/app")); got != "var/app" {
+				t.Errorf("var/app = %q", got)
+			}
+			if err := os.WriteFile(filepath.Join(v.Path, "etc/hostname"), []byte("vm\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			v2, err := s.View([]Layer{base, app})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, filepath.Join(v2.Path, "etc/hostname")); got != "etc/hostname" {
+				t.Errorf("write leaked into another view: %q", got)
+			}
+			v2.Close()
+			if opens != 3 {
+				t.Errorf("layers opened %d times, want 3", opens)
+			}
+
+			// The view keeps its snapshots after the tag is gone.
+			appChain, _ := ChainID([]Layer{base, app})
+			otherChain, _ := ChainID([]Layer{base, other})
+			if err := s.Untag("app"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(s.snapshotDir(appChain)); err != nil {
+				t.Errorf("snapshot in use removed: %v", err)
+			}
+			vm := &fakeVM{}
+			if err := v.Attach(vm); err != nil {
+				t.Fatal(err)
+			}
+			vm.exit()
+			if _, err := os.Stat(s.snapshotDir(appChain)); !os.IsNotExist(err) {
+				t.Errorf("unused snapshot kept: %v", err)
+			}
+			if _, err := os.Stat(s.snapshotDir(otherChain)); err != nil {
+				t.Errorf("tagged snapshot removed: %v", err)
+			}
+			if entries, _ := os.ReadDir(filepath.Join(s.dir, "views")); len(entries) != 0 {
+				t.Errorf("views left: %v", entries)
+			}
+
+			if err := s.Untag("other"); err != nil {
+				t.Fatal(err)
+			}
+			if entries, _ := os.ReadDir(filepath.Join(s.dir, "snapshots")); len(entries) != 0 {
+				t.Errorf("snapshots left: %v", entries)
+			}
+		})
+	}
+}
+
+func TestSnapshotter_DiffID(t *testing.T) {
+	s, err := NewSnapshotter(t.TempDir(), ModeCopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opens int
+	l := testLayer(t, &opens, &tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0644})
+	l.DiffID = fmt.Sprintf("sha256:%x", sha256.Sum256(nil))
+	if _, err := s.Tag("bad", []Layer{l}); !errors.Is(err, ErrDiffID) {
+		t.Errorf("Tag = %v, want ErrDiffID", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.dir, "snapshots")); len(entries) != 0 {
+		t.Errorf("snapshots left: %v", entries)
+	}
+	if _, err := NewSnapshotter(s.dir, ModeOverlay); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("reopening with another mode = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestSnapshotter_StaleView(t *testing.T) {
+	s, err := NewSnapshotter(t.TempDir(), ModeCopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opens int
+	l := testLayer(t, &opens, &tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0644})
+	v, err := s.View([]Layer{l})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As if the owning process died: its lock goes away with it.
+	v.lock.Close()
+	if err := s.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(v.Path); !os.IsNotExist(err) {
+		t.Errorf("stale view kept: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.dir, "snapshots")); len(entries) != 0 {
+		t.Errorf("snapshots left: %v", entries)
+	}
+}
@@ -0,0 +1,43 @@
+package krun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mishushakov/libkrun-go/krun/rawdisk"
+)
+
+// ScratchDiskConfig configures a temporary disk created for a single VM by
+// [Context.AddScratchDisk].
+type ScratchDiskConfig struct {
+	BlockID     string
+	Size        int64    // in bytes
+	Dir         string   // "" = os.TempDir()
+	Partitioned bool     // GPT with one partition, /dev/vdX1 in the guest
+	Ext4        bool     // format with an empty ext4 filesystem
+	Label       string   // ext4 volume label
+	SyncMode    SyncMode // 0 = SyncNone
+}
+
+// AddScratchDisk creates a sparse raw image in cfg.Dir, attaches it with
+// [Context.AddDisk] and deletes it when the VM exits (see
+// [Context.OnExit]). It returns the path of the image.
+func (c *Context) AddScratchDisk(cfg ScratchDiskConfig) (string, error) {
+	dir, err := os.MkdirTemp(cfg.Dir, "krun-scratch-")
+	if err != nil {
+		return "", fmt.Errorf("krun: %w", err)
+	}
+	path := filepath.Join(dir, "disk.img")
+	opts := rawdisk.Options{Partitioned: cfg.Partitioned, Ext4: cfg.Ext4, Label: cfg.Label}
+	if err := rawdisk.Create(path, cfg.Size, opts); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err := c.AddDisk(DiskConfig{BlockID: cfg.BlockID, Path: path, Format: DiskFormatRaw, SyncMode: cfg.SyncMode}); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	c.OnExit(func() { os.RemoveAll(dir) })
+	return path, nil
+}
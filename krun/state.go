@@ -0,0 +1,70 @@
+package krun
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// A Context is only a libkrun context ID, so what the bindings need to
+// remember about a context's configuration is kept here.
+var (
+	stateMu sync.Mutex
+	states  = make(map[uint32]*contextState)
+)
+
+type contextState struct {
+	kernelConsole   string   // set with SetKernelConsole
+	cmdlineConsoles []string // console= values of KernelConfig.Cmdline
+
+	// Devices, in the order they were added, for Devices.
+	root              string
+	disks             []DiskConfig
+	fs                []VirtioFSConfig
+	consoles          []consoleDevice
+	noImplicitConsole bool
+	serials           []string
+	nets              []string
+	vsockPorts        []VsockPortConfig
+	displays          []uint32
+
+	channelConsole *uint32 // multiport console created by AddConsoleChannel
+	vsockDir       string  // holds the sockets of ListenVsock and DialVsock
+}
+
+// withState calls fn with c's state, holding the lock.
+func (c *Context) withState(fn func(s *contextState)) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := states[c.id]
+	if s == nil {
+		s = &contextState{}
+		states[c.id] = s
+	}
+	fn(s)
+}
+
+// forgetState drops the state of context id once it is freed or started.
+func forgetState(id uint32) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	delete(states, id)
+}
+
+// checkConsoles warns when the kernel command line names a console other
+// than the one set with SetKernelConsole. The kernel uses the last
+// console= as /dev/console, so which one wins depends on the order libkrun
+// assembles the command line in.
+func (s *contextState) checkConsoles(id uint32) {
+	if s.kernelConsole == "" {
+		return
+	}
+	want, _, _ := strings.Cut(s.kernelConsole, ",")
+	for _, con := range s.cmdlineConsoles {
+		if name, _, _ := strings.Cut(con, ","); name != want {
+			slog.Warn("krun: kernel command line console= conflicts with SetKernelConsole",
+				"ctx", id, "cmdline", con, "kernelConsole", s.kernelConsole)
+			return
+		}
+	}
+}
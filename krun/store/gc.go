@@ -0,0 +1,157 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Object describes a stored object.
+type Object struct {
+	Digest Digest
+	Kind   Kind
+	// Size is the disk space the object uses, in bytes.
+	Size int64
+	// LastUsed is when the object was last added or referenced.
+	LastUsed time.Time
+	// InUse is set while some process holds a reference to the object.
+	InUse bool
+}
+
+// List returns the stored objects, least recently used first.
+func (s *Store) List() ([]Object, error) {
+	unlock, err := s.lock(unix.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.list()
+}
+
+func (s *Store) list() ([]Object, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "objects"))
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	var objs []Object
+	for _, e := range entries {
+		d, err := ParseDigest(digestPrefix + e.Name())
+		if err != nil {
+			continue // not ours
+		}
+		path := filepath.Join(s.dir, "objects", e.Name())
+		o := Object{Digest: d, Kind: KindFile}
+		if e.IsDir() {
+			o.Kind = KindTree
+		}
+		if o.Size, err = diskUsage(path); err != nil {
+			return nil, err
+		}
+		ref := filepath.Join(s.dir, "refs", e.Name())
+		if fi, err := os.Stat(ref); err == nil {
+			o.LastUsed = fi.ModTime()
+		} else if fi, err := os.Lstat(path); err == nil {
+			o.LastUsed = fi.ModTime()
+		}
+		if o.InUse, err = referenced(ref); err != nil {
+			return nil, err
+		}
+		objs = append(objs, o)
+	}
+	sort.SliceStable(objs, func(i, j int) bool { return objs[i].LastUsed.Before(objs[j].LastUsed) })
+	return objs, nil
+}
+
+// referenced reports whether a process holds a reference on the ref file.
+func referenced(ref string) (bool, error) {
+	f, err := os.Open(ref)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("store: %w", err)
+	}
+	defer f.Close()
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("store: lock: %w", err)
+	}
+	return false, nil
+}
+
+// GC removes objects no process references, least recently used first,
+// until the store uses at most maxSize bytes, and returns the bytes freed.
+// A maxSize of 0 removes every unreferenced object. Referenced objects are
+// kept even if the store stays over budget.
+func (s *Store) GC(maxSize int64) (int64, error) {
+	unlock, err := s.lock(unix.LOCK_EX)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	// Holding the lock exclusively, anything in tmp was left by a process
+	// that died while adding or removing an object.
+	tmp := filepath.Join(s.dir, "tmp")
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return 0, fmt.Errorf("store: %w", err)
+	}
+	for _, e := range entries {
+		if err := removeTree(filepath.Join(tmp, e.Name())); err != nil {
+			return 0, err
+		}
+	}
+
+	objs, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, o := range objs {
+		total += o.Size
+	}
+	var freed int64
+	for _, o := range objs {
+		if total <= maxSize {
+			break
+		}
+		if o.InUse {
+			continue
+		}
+		if err := s.remove(o.Digest); err != nil {
+			return freed, err
+		}
+		total -= o.Size
+		freed += o.Size
+	}
+	return freed, nil
+}
+
+// remove deletes object d and its ref file. The caller holds the store
+// lock exclusively. The object is first renamed into tmp, so a process
+// dying halfway through never leaves a partial object behind.
+func (s *Store) remove(d Digest) error {
+	h, _ := d.hex()
+	trash, err := os.MkdirTemp(filepath.Join(s.dir, "tmp"), "gc-")
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	if err := os.Rename(filepath.Join(s.dir, "objects", h), filepath.Join(trash, h)); err != nil {
+		os.Remove(trash)
+		return fmt.Errorf("store: %w", err)
+	}
+	if err := os.Remove(filepath.Join(s.dir, "refs", h)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("store: %w", err)
+	}
+	return removeTree(trash)
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mishushakov/libkrun-go/krun/rootfs"
+	"golang.org/x/sys/unix"
+)
+
+// VM is the part of *krun.Context this package uses.
+type VM interface {
+	OnExit(fn func())
+}
+
+// Ref is a reference to an object. GC does not remove an object while any
+// process holds a reference to it.
+type Ref struct {
+	Digest Digest
+	// Path is the object's path.
+	Path string
+
+	f    *os.File
+	once sync.Once
+}
+
+// Acquire takes a reference to object d. The caller must call
+// [Ref.Release].
+func (s *Store) Acquire(d Digest) (*Ref, error) {
+	path, err := s.Path(d)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lock(unix.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Check again: GC may have removed it before we held the lock.
+	if _, err := s.Path(d); err != nil {
+		return nil, err
+	}
+	h, _ := d.hex()
+	if err := s.touch(h); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(s.dir, "refs", h))
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	if err := flock(f, unix.LOCK_SH); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("store: lock: %w", err)
+	}
+	return &Ref{Digest: d, Path: path, f: f}, nil
+}
+
+// Release drops the reference. It is safe to call more than once.
+func (r *Ref) Release() {
+	r.once.Do(func() { r.f.Close() })
+}
+
+// Use takes a reference to object d for as long as vm runs and returns its
+// path. For a tree it returns instead a private, writable view of the tree
+// made with [rootfs.Ephemeral] and removed when vm exits, so a VM booting
+// from it with SetRoot cannot change the shared object.
+func (s *Store) Use(vm VM, d Digest) (string, error) {
+	ref, err := s.Acquire(d)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(ref.Path)
+	if err != nil {
+		ref.Release()
+		return "", fmt.Errorf("store: %w", err)
+	}
+	if !fi.IsDir() {
+		vm.OnExit(ref.Release)
+		return ref.Path, nil
+	}
+	// Not under the store's tmp, which GC empties.
+	view, err := rootfs.Ephemeral(ref.Path, rootfs.EphemeralOptions{})
+	if err != nil {
+		ref.Release()
+		return "", fmt.Errorf("store: %w", err)
+	}
+	// Exit functions run last first: the view goes before the reference.
+	vm.OnExit(ref.Release)
+	vm.OnExit(func() { view.Close() })
+	return view.Path, nil
+}
@@ -0,0 +1,297 @@
+// Package store keeps kernels, initramfs files, disk images and rootfs
+// trees in a local content-addressed store shared by every process on the
+// host.
+//
+// Objects are named by the SHA-256 digest of their content and never change
+// once stored, so the same artifact is kept once however many VMs use it:
+//
+//	s, err := store.Open("/var/lib/krun/store")
+//	...
+//	kernel, err := s.PutFile("vmlinux")
+//	...
+//	path, err := s.Use(ctx, kernel) // referenced until the VM exits
+//	...
+//	err = ctx.SetKernel(krun.KernelConfig{Path: path, Format: krun.KernelFormatAuto})
+//
+// Files are stored read-only: attach disk images with ReadOnly set, or
+// through a qcow2 overlay. Trees keep their modes, which are part of their
+// digest, so they are shared writable directories: [Store.Use] gives each
+// VM its own view of a tree, made with [rootfs.Ephemeral]. Never write to
+// or boot from the path [Store.Path] returns for a tree.
+//
+// [Store.GC] removes objects no running VM references, least recently used
+// first, until the store fits a size budget. References are flock(2) locks
+// held by the referencing process, so a process that dies releases its
+// references with it.
+//
+// [rootfs.Ephemeral]: https://pkg.go.dev/github.com/mishushakov/libkrun-go/krun/rootfs#Ephemeral
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mishushakov/libkrun-go/krun/rootfs"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ErrNotFound is returned for digests the store does not hold.
+	ErrNotFound = errors.New("store: object not found")
+	// ErrInvalidDigest is returned for malformed digests.
+	ErrInvalidDigest = errors.New("store: invalid digest")
+)
+
+// Digest names an object, as "sha256:" followed by 64 lowercase hex digits.
+type Digest string
+
+const digestPrefix = "sha256:"
+
+// ParseDigest checks that s is a well-formed digest.
+func ParseDigest(s string) (Digest, error) {
+	d := Digest(s)
+	if _, err := d.hex(); err != nil {
+		return "", err
+	}
+	return d, nil
+}
+
+func (d Digest) hex() (string, error) {
+	h, ok := strings.CutPrefix(string(d), digestPrefix)
+	if !ok || len(h) != 2*sha256.Size || strings.ToLower(h) != h {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDigest, string(d))
+	}
+	if _, err := hex.DecodeString(h); err != nil {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDigest, string(d))
+	}
+	return h, nil
+}
+
+func newDigest(sum []byte) Digest {
+	return Digest(digestPrefix + hex.EncodeToString(sum))
+}
+
+// Kind is what an object holds.
+type Kind int
+
+const (
+	KindFile Kind = iota // a kernel, initramfs or disk image
+	KindTree             // a rootfs directory
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindFile:
+		return "file"
+	case KindTree:
+		return "tree"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Store is a content-addressed store in a directory. Its methods are safe
+// for concurrent use by goroutines and by other processes opening the same
+// directory.
+//
+// The directory holds:
+//
+//	lock         flock(2)ed shared by writers, exclusively by GC
+//	objects/HEX  files and trees, named by digest
+//	refs/HEX     flock(2)ed shared by each reference; mtime is last use
+//	tmp/         objects being added or removed
+type Store struct {
+	dir string
+}
+
+// Open opens the store in dir, creating it if needed.
+func Open(dir string) (*Store, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	for _, d := range []string{"objects", "refs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("store: %w", err)
+		}
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the store's directory.
+func (s *Store) Dir() string { return s.dir }
+
+// lock takes the store lock, shared or exclusive (unix.LOCK_SH or
+// unix.LOCK_EX), and returns the function releasing it. Each call uses a
+// file description of its own, so goroutines exclude each other just like
+// processes.
+func (s *Store) lock(how int) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(s.dir, "lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	if err := flock(f, how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("store: lock: %w", err)
+	}
+	return func() { f.Close() }, nil
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// Put adds the content read from r as a file and returns its digest.
+func (s *Store) Put(r io.Reader) (Digest, error) {
+	unlock, err := s.lock(unix.LOCK_SH)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	f, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "put-")
+	if err != nil {
+		return "", fmt.Errorf("store: %w", err)
+	}
+	tmp := f.Name()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Chmod(0444)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("store: %w", err)
+	}
+	d := newDigest(h.Sum(nil))
+	if err := s.commit(tmp, d); err != nil {
+		return "", err
+	}
+	return d, nil
+}
+
+// PutFile adds a copy of the file at path and returns its digest.
+func (s *Store) PutFile(path string) (Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("store: %w", err)
+	}
+	defer f.Close()
+	return s.Put(f)
+}
+
+// PutTree adds a copy of the directory tree at dir and returns its digest.
+// The digest covers each entry's path, type, mode, owner, extended
+// attributes, link target, device number and content; timestamps and
+// hardlinks do not count. Ownership and attributes the caller may not set
+// are those of the copy.
+func (s *Store) PutTree(dir string) (Digest, error) {
+	unlock, err := s.lock(unix.LOCK_SH)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	tmpDir, err := os.MkdirTemp(filepath.Join(s.dir, "tmp"), "put-")
+	if err != nil {
+		return "", fmt.Errorf("store: %w", err)
+	}
+	defer removeTree(tmpDir)
+	tmp := filepath.Join(tmpDir, "tree")
+	if err := rootfs.Copy(tmp, dir); err != nil {
+		return "", fmt.Errorf("store: %w", err)
+	}
+	// Hash the copy rather than dir, which may change while it is copied.
+	d, err := treeDigest(tmp)
+	if err != nil {
+		return "", err
+	}
+	if err := s.commit(tmp, d); err != nil {
+		return "", err
+	}
+	return d, nil
+}
+
+// commit moves the new object at tmp into place as d, or drops it if the
+// store already holds d, and marks d as just used. The caller holds the
+// store lock.
+func (s *Store) commit(tmp string, d Digest) error {
+	h, _ := d.hex()
+	dst := filepath.Join(s.dir, "objects", h)
+	if _, err := os.Lstat(dst); err == nil {
+		removeTree(tmp)
+	} else if err := os.Rename(tmp, dst); err != nil {
+		removeTree(tmp)
+		if _, serr := os.Lstat(dst); serr != nil {
+			return fmt.Errorf("store: %w", err)
+		}
+		// Another writer added it first.
+	}
+	return s.touch(h)
+}
+
+// touch records that the object h was just used.
+func (s *Store) touch(h string) error {
+	ref := filepath.Join(s.dir, "refs", h)
+	f, err := os.OpenFile(ref, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	f.Close()
+	now := time.Now()
+	if err := os.Chtimes(ref, now, now); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	return nil
+}
+
+// Path returns the path of object d. It does not keep GC from removing the
+// object; use [Store.Acquire] or [Store.Use] for that.
+func (s *Store) Path(d Digest) (string, error) {
+	h, err := d.hex()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.dir, "objects", h)
+	if _, err := os.Lstat(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s", ErrNotFound, d)
+		}
+		return "", fmt.Errorf("store: %w", err)
+	}
+	return path, nil
+}
+
+// removeTree removes path and everything below it, making directories
+// writable first so read-only directories in a tree do not stop the
+// removal.
+func removeTree(path string) error {
+	if err := os.RemoveAll(path); err == nil {
+		return nil
+	}
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package store
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setLastUsed backdates the last use of d by hours.
+func setLastUsed(t *testing.T, s *Store, d Digest, hours int) {
+	t.Helper()
+	h, _ := d.hex()
+	at := time.Now().Add(time.Duration(hours) * time.Hour)
+	if err := os.Chtimes(filepath.Join(s.Dir(), "refs", h), at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPut(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := s.Put(strings.NewReader("kernel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Digest(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("kernel")))); d != want {
+		t.Errorf("digest = %s, want %s", d, want)
+	}
+	path, err := s.Path(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "kernel" {
+		t.Errorf("content = %q", data)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0444 {
+		t.Errorf("mode = %v, want read-only", fi.Mode())
+	}
+
+	src := filepath.Join(t.TempDir(), "vmlinux")
+	writeFile(t, src, "kernel")
+	if d2, err := s.PutFile(src); err != nil || d2 != d {
+		t.Errorf("PutFile = %s, %v; want %s", d2, err, d)
+	}
+	objs, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].Digest != d || objs[0].Kind != KindFile {
+		t.Errorf("List = %+v", objs)
+	}
+
+	if _, err := s.Path(Digest("sha256:" + strings.Repeat("0", 64))); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Path(missing) = %v, want ErrNotFound", err)
+	}
+	for _, bad := range []Digest{"", "sha256:../../etc", "md5:" + Digest(strings.Repeat("0", 64)), "sha256:" + Digest(strings.Repeat("A", 64))} {
+		if _, err := s.Path(bad); !errors.Is(err, ErrInvalidDigest) {
+			t.Errorf("Path(%q) = %v, want ErrInvalidDigest", bad, err)
+		}
+	}
+}
+
+func TestPutTree(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "etc/hostname"), "vm\n")
+	writeFile(t, filepath.Join(src, "bin/sh"), "#!")
+	if err := os.Symlink("sh", filepath.Join(src, "bin/ash")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := s.PutTree(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := s.Path(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(path, "etc/hostname")); string(data) != "vm\n" {
+		t.Errorf("hostname = %q", data)
+	}
+	if target, _ := os.Readlink(filepath.Join(path, "bin/ash")); target != "sh" {
+		t.Errorf("link = %q", target)
+	}
+
+	// Timestamps do not count; content does.
+	old := time.Unix(0, 0)
+	os.Chtimes(filepath.Join(src, "bin/sh"), old, old)
+	if d2, err := s.PutTree(src); err != nil || d2 != d {
+		t.Errorf("PutTree after touch = %s, %v; want %s", d2, err, d)
+	}
+	writeFile(t, filepath.Join(src, "etc/hostname"), "other\n")
+	if d3, err := s.PutTree(src); err != nil || d3 == d {
+		t.Errorf("PutTree after change = %s, %v", d3, err)
+	}
+	objs, _ := s.List()
+	if len(objs) != 2 || objs[0].Kind != KindTree {
+		t.Errorf("List = %+v", objs)
+	}
+}
+
+func TestGC(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := strings.Repeat("x", 8192)
+	old, _ := s.Put(strings.NewReader("old" + block))
+	used, _ := s.Put(strings.NewReader("used" + block))
+	recent, _ := s.Put(strings.NewReader("recent" + block))
+	setLastUsed(t, s, old, -3)
+	setLastUsed(t, s, used, -2)
+	setLastUsed(t, s, recent, -1)
+
+	ref, err := s.Acquire(used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLastUsed(t, s, used, -2)
+	writeFile(t, filepath.Join(s.Dir(), "tmp", "put-stale"), "left by a crash")
+
+	objs, _ := s.List()
+	var size int64
+	for _, o := range objs {
+		size += o.Size
+		if o.InUse != (o.Digest == used) {
+			t.Errorf("%s InUse = %v", o.Digest, o.InUse)
+		}
+	}
+
+	// One object over budget: the least recently used unreferenced one goes.
+	freed, err := s.GC(size - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed == 0 {
+		t.Error("nothing freed")
+	}
+	if _, err := s.Path(old); !errors.Is(err, ErrNotFound) {
+		t.Errorf("old object kept: %v", err)
+	}
+	if _, err := s.Path(recent); err != nil {
+		t.Errorf("recent object removed: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.Dir(), "tmp")); len(entries) != 0 {
+		t.Errorf("tmp not cleaned: %v", entries)
+	}
+
+	// Referenced objects survive any budget.
+	if _, err := s.GC(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Path(used); err != nil {
+		t.Errorf("referenced object removed: %v", err)
+	}
+	if _, err := s.Path(recent); !errors.Is(err, ErrNotFound) {
+		t.Errorf("recent object kept: %v", err)
+	}
+
+	ref.Release()
+	ref.Release()
+	if _, err := s.GC(0); err != nil {
+		t.Fatal(err)
+	}
+	if objs, _ := s.List(); len(objs) != 0 {
+		t.Errorf("List after GC = %+v", objs)
+	}
+	if _, err := s.Acquire(used); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Acquire(removed) = %v, want ErrNotFound", err)
+	}
+}
+
+type fakeVM struct{ hooks []func() }
+
+func (vm *fakeVM) OnExit(fn func()) { vm.hooks = append(vm.hooks, fn) }
+
+func TestUse(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := s.Put(strings.NewReader("rootfs.img"))
+	vm := &fakeVM{}
+	path, err := s.Use(vm, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := s.Path(d); p != path {
+		t.Errorf("Use = %s, want %s", path, p)
+	}
+
+	// A second store on the same directory, as another process would open it.
+	s2, err := Open(s.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.GC(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Path(d); err != nil {
+		t.Fatalf("object removed while the VM runs: %v", err)
+	}
+	for _, fn := range vm.hooks {
+		fn()
+	}
+	if _, err := s2.GC(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Path(d); !errors.Is(err, ErrNotFound) {
+		t.Errorf("object kept after the VM exited: %v", err)
+	}
+}
+
+func TestUse_Tree(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "etc/hostname"), "vm\n")
+	d, err := s.PutTree(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, _ := s.Path(d)
+
+	vm := &fakeVM{}
+	path, err := s.Use(vm, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path == obj {
+		t.Fatal("Use returned the stored tree itself")
+	}
+	// The VM writes to its root; the stored tree does not change.
+	writeFile(t, filepath.Join(path, "etc/hostname"), "changed\n")
+	writeFile(t, filepath.Join(path, "new"), "x")
+	if data, _ := os.ReadFile(filepath.Join(obj, "etc/hostname")); string(data) != "vm\n" {
+		t.Errorf("stored hostname = %q after the VM wrote to its view", data)
+	}
+	if _, err := os.Lstat(filepath.Join(obj, "new")); !os.IsNotExist(err) {
+		t.Error("file added to the stored tree")
+	}
+	if got, err := treeDigest(obj); err != nil || got != d {
+		t.Errorf("stored tree digest = %s, %v; want %s", got, err, d)
+	}
+
+	for i := len(vm.hooks) - 1; i >= 0; i-- {
+		vm.hooks[i]()
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("view not removed on exit: %v", err)
+	}
+}
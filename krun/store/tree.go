@@ -0,0 +1,142 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// treeHeader starts the manifest a tree digest is computed over, so a tree
+// can never share a digest with a file.
+const treeHeader = "krun-tree-v1\n"
+
+// treeDigest hashes a manifest of the tree at dir: one record per entry,
+// in lexical path order, with the fields PutTree documents.
+func treeDigest(dir string) (Digest, error) {
+	h := sha256.New()
+	io.WriteString(h, treeHeader)
+	err := filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(path, &st); err != nil {
+			return &os.PathError{Op: "lstat", Path: path, Err: err}
+		}
+		fmt.Fprintf(h, "%q %o %d %d", filepath.ToSlash(rel), st.Mode, st.Uid, st.Gid)
+		switch uint32(st.Mode) & unix.S_IFMT {
+		case unix.S_IFREG:
+			sum, err := fileDigest(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %d %x", st.Size, sum)
+		case unix.S_IFLNK:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %q", target)
+		case unix.S_IFCHR, unix.S_IFBLK:
+			fmt.Fprintf(h, " %d", st.Rdev)
+		}
+		for _, x := range xattrs(path) {
+			fmt.Fprintf(h, " %q=%x", x.name, x.value)
+		}
+		io.WriteString(h, "\n")
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("store: %w", err)
+	}
+	return newDigest(h.Sum(nil)), nil
+}
+
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// xattrs returns the extended attributes of path sorted by name, or nil if
+// they cannot be read.
+func xattrs(path string) []xattr {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil
+	}
+	var xs []xattr
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(path, string(name), value); err != nil {
+			continue
+		}
+		xs = append(xs, xattr{string(name), value[:size]})
+	}
+	sort.Slice(xs, func(i, j int) bool { return xs[i].name < xs[j].name })
+	return xs
+}
+
+// diskUsage returns the disk space the file or tree at path uses, counting
+// each hardlinked file once.
+func diskUsage(path string) (int64, error) {
+	type fileID struct{ dev, ino uint64 }
+	seen := make(map[fileID]bool)
+	var total int64
+	err := filepath.WalkDir(path, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			return &os.PathError{Op: "lstat", Path: p, Err: err}
+		}
+		if uint32(st.Mode)&unix.S_IFMT != unix.S_IFDIR && st.Nlink > 1 {
+			id := fileID{uint64(st.Dev), uint64(st.Ino)}
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		total += st.Blocks * 512
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("store: %w", err)
+	}
+	return total, nil
+}
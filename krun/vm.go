@@ -20,7 +20,11 @@ func (c *Context) SetVMConfig(cfg VMConfig) error {
 func (c *Context) SetRoot(rootPath string) error {
 	cPath := C.CString(rootPath)
 	defer C.free(unsafe.Pointer(cPath))
-	return checkRet(C.krun_set_root(C.uint32_t(c.id), cPath), "krun_set_root")
+	if err := checkRet(C.krun_set_root(C.uint32_t(c.id), cPath), "krun_set_root"); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) { s.root = rootPath })
+	return nil
 }
 
 // SetNestedVirt enables or disables nested virtualization (macOS only).
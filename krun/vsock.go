@@ -18,10 +18,14 @@ type VsockPortConfig struct {
 func (c *Context) AddVsockPort(cfg VsockPortConfig) error {
 	cPath := C.CString(cfg.Path)
 	defer C.free(unsafe.Pointer(cPath))
-	return checkRet(
+	if err := checkRet(
 		C.krun_add_vsock_port2(C.uint32_t(c.id), C.uint32_t(cfg.Port), cPath, C.bool(cfg.Listen)),
 		"krun_add_vsock_port2",
-	)
+	); err != nil {
+		return err
+	}
+	c.withState(func(s *contextState) { s.vsockPorts = append(s.vsockPorts, cfg) })
+	return nil
 }
 
 // AddVsock adds a vsock device with specified TSI features.
@@ -1,8 +1,13 @@
 package krun
 
 import (
+	"context"
+	"io"
+	"net"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestAddVsockPort(t *testing.T) {
@@ -45,3 +50,75 @@ func TestDisableImplicitVsock(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestListenVsock(t *testing.T) {
+	ctx := newTestContext(t)
+	l, err := ctx.ListenVsock(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := l.Addr().String()
+	dir := filepath.Dir(path)
+	devs, _ := ctx.Devices()
+	if len(devs) == 0 || devs[len(devs)-1].Host != path {
+		t.Errorf("devices = %v, want vsock port 1024 on %s", devs, path)
+	}
+
+	// The VMM connects to the socket for each guest connection.
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(conn); string(b) != "hello" {
+		t.Errorf("read %q", b)
+	}
+	conn.Close()
+
+	runExitHooks(ctx.id)
+	if _, err := l.Accept(); err == nil {
+		t.Error("listener not closed on exit")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("socket directory left behind: %v", err)
+	}
+}
+
+func TestDialVsock(t *testing.T) {
+	ctx := newTestContext(t)
+	d, err := ctx.DialVsock(2049)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Dial(); err == nil {
+		t.Error("Dial succeeded before the VMM listens")
+	}
+
+	// Stand in for the VMM, which listens once the VM starts.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("unix", d.Path)
+		if err != nil {
+			return
+		}
+		conn, _ := l.Accept()
+		conn.Close()
+	}()
+	dctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(dctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	runExitHooks(ctx.id)
+	if _, err := os.Stat(filepath.Dir(d.Path)); !os.IsNotExist(err) {
+		t.Errorf("socket directory left behind: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package krun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ListenVsock returns a listener for connections the guest makes to vsock
+// port. The UNIX socket it maps the port to is created in a private
+// directory and removed with the listener when the VM exits (see
+// [Context.OnExit]).
+func (c *Context) ListenVsock(port uint32) (net.Listener, error) {
+	path, err := c.vsockPath(port)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("krun: %w", err)
+	}
+	if err := c.AddVsockPort(VsockPortConfig{Port: port, Path: path}); err != nil {
+		l.Close()
+		return nil, err
+	}
+	c.OnExit(func() { l.Close() })
+	return l, nil
+}
+
+// VsockDialer connects to a vsock port the guest listens on, set up with
+// [Context.DialVsock].
+type VsockDialer struct {
+	Port uint32
+	Path string // the UNIX socket the VMM listens on for the port
+}
+
+// DialVsock maps vsock port, which the guest listens on, to a UNIX socket
+// that the VMM listens on once the VM starts, in a private directory
+// removed when the VM exits. Connections are made with the returned
+// VsockDialer, from another goroutine than the one running
+// [Context.StartEnter].
+func (c *Context) DialVsock(port uint32) (*VsockDialer, error) {
+	path, err := c.vsockPath(port)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.AddVsockPort(VsockPortConfig{Port: port, Path: path, Listen: true}); err != nil {
+		return nil, err
+	}
+	return &VsockDialer{Port: port, Path: path}, nil
+}
+
+// Dial connects to the guest's port. It fails if the VM has not started
+// yet; the VMM may also close the connection at once if the guest is not
+// listening.
+func (d *VsockDialer) Dial() (net.Conn, error) {
+	conn, err := net.Dial("unix", d.Path)
+	if err != nil {
+		return nil, fmt.Errorf("krun: vsock port %d: %w", d.Port, err)
+	}
+	return conn, nil
+}
+
+// vsockDialRetry is how often DialContext retries while the VM starts.
+const vsockDialRetry = 10 * time.Millisecond
+
+// DialContext connects to the guest's port like Dial, retrying until the
+// VMM listens on the socket or ctx is done.
+func (d *VsockDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "unix", d.Path)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("krun: vsock port %d: %w", d.Port, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("krun: vsock port %d: %w", d.Port, ctx.Err())
+		case <-time.After(vsockDialRetry):
+		}
+	}
+}
+
+// vsockPath returns the socket path for port in c's private directory,
+// creating the directory on first use under $XDG_RUNTIME_DIR, the usual
+// place for a user's sockets, or else the temporary directory.
+func (c *Context) vsockPath(port uint32) (string, error) {
+	var dir string
+	var created bool
+	var err error
+	c.withState(func(s *contextState) {
+		if s.vsockDir == "" {
+			if s.vsockDir, err = os.MkdirTemp(os.Getenv("XDG_RUNTIME_DIR"), "krun-vsock-"); err != nil {
+				s.vsockDir = ""
+				return
+			}
+			created = true
+		}
+		dir = s.vsockDir
+	})
+	if err != nil {
+		return "", fmt.Errorf("krun: %w", err)
+	}
+	if created {
+		c.OnExit(func() { os.RemoveAll(dir) })
+	}
+	return filepath.Join(dir, fmt.Sprintf("port-%d.sock", port)), nil
+}